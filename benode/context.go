@@ -3,6 +3,7 @@ package benode
 import (
 	"bufio"
 	"fmt"
+	"math"
 	"tutorial/bt_demo/utils"
 )
 
@@ -33,7 +34,12 @@ func (impl *NodeContextImpl) readInt(rd *bufio.Reader) (res int64) {
 		if next < '0' || next > '9' {
 			break
 		}
-		res = res*10 + int64(next-'0')
+		digit := int64(next - '0')
+		if res > (math.MaxInt64-digit)/10 {
+			impl.addErr(fmt.Errorf("readInt: %w: integer overflow", bDataErr))
+			return 0
+		}
+		res = res*10 + digit
 		_ = impl.readByte(rd)
 	}
 	return res
@@ -58,6 +64,7 @@ func (impl *NodeContextImpl) readByte(rd *bufio.Reader) byte {
 	bs, err := readSlice(rd, 1)
 	if err != nil {
 		impl.addErr(fmt.Errorf("%w in\n %v", err, utils.LogSource()))
+		return 0
 	}
 	return bs[0]
 }
@@ -81,7 +88,12 @@ func (impl *NodeContextImpl) ScanInt(rd *bufio.Reader) *IntNode {
 	if next != IntStartSign {
 		impl.addErr(fmt.Errorf("invalid int node split sign"))
 	}
-	data := impl.readInt(rd)
+	sign := int64(1)
+	if impl.peekByte(rd) == '-' {
+		_ = impl.readByte(rd)
+		sign = -1
+	}
+	data := sign * impl.readInt(rd)
 	next = impl.readByte(rd)
 	if next != 'e' {
 		impl.addErr(fmt.Errorf("invalid int node split sign"))
@@ -118,7 +130,9 @@ func (impl *NodeContextImpl) ScanDict(rd *bufio.Reader) *DictNode {
 	if next != DictStartSign {
 		impl.addErr(fmt.Errorf("DictNode: invalid start sign"))
 	}
-	data := make(map[Benode]Benode, 0)
+	res := &DictNode{
+		data: make(map[Benode]Benode, 0),
+	}
 	for {
 		if impl.Err() != nil {
 			break
@@ -130,11 +144,9 @@ func (impl *NodeContextImpl) ScanDict(rd *bufio.Reader) *DictNode {
 		}
 		keyNode := impl.Scan(rd)
 		valNode := impl.Scan(rd)
-		data[keyNode] = valNode
-	}
-	return &DictNode{
-		data: data,
+		res.set(keyNode, valNode)
 	}
+	return res
 }
 
 func (impl *NodeContextImpl) ScanList(rd *bufio.Reader) *ListNode {
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"tutorial/bt_demo/utils"
 )
 
@@ -41,6 +43,20 @@ const (
 	BenodeTag = "benode"
 )
 
+// RawMessage is a raw encoded benode value. It can be used to delay
+// decoding or to keep the exact bytes of a value, e.g. the info dict.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Unmarshaler is implemented by types that decode themselves, e.g.
+// values that may be encoded as a string or as a list
+type Unmarshaler interface {
+	UnmarshalBenode(node Benode) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
 func CalSHA(node Benode) ([utils.SHALEN]byte, error) {
 	var buf bytes.Buffer
 	if err := node.Write(&buf); err != nil {
@@ -49,6 +65,16 @@ func CalSHA(node Benode) ([utils.SHALEN]byte, error) {
 	return sha1.Sum(buf.Bytes()), nil
 }
 
+// Parse reads one node, scanned dicts keep their key order
+func Parse(rd *bufio.Reader) (Benode, error) {
+	impl := NewNodeContext()
+	node := impl.Scan(rd)
+	if impl.Err() != nil {
+		return nil, impl.Err()
+	}
+	return node, nil
+}
+
 func Unmarshal[T any](rd *bufio.Reader, res T) error {
 	impl := NewNodeContext()
 	node := impl.Scan(rd)
@@ -69,7 +95,16 @@ func Marshal[T any](src T) (res Benode, err error) {
 }
 
 func marshalValue(srcVal reflect.Value) (res Benode, err error) {
+	if srcVal.Kind() == reflect.Interface {
+		srcVal = srcVal.Elem()
+	}
+	if isNil(srcVal) {
+		return nil, fmt.Errorf("%w: get nil value", bDataErr)
+	}
 	srcVal, _ = unwarpPtr(srcVal)
+	if srcVal.Type() == rawMessageType {
+		return parseRaw(srcVal.Bytes())
+	}
 
 	switch srcVal.Kind() {
 	case reflect.Map, reflect.Struct:
@@ -89,19 +124,143 @@ func marshalValue(srcVal reflect.Value) (res Benode, err error) {
 	return res, nil
 }
 
+// parseTag splits a field tag into its key and options, e.g. `benode:"name,omitempty"`
+func parseTag(field reflect.StructField) (name string, omitEmpty bool) {
+	tag := field.Tag.Get(BenodeTag)
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, opts == "omitempty"
+}
+
+func isNil(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		return val.IsNil()
+	}
+	return false
+}
+
+func isEmpty(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	}
+	return isNil(val) || val.IsZero()
+}
+
+// parseRaw scans an encoded value back into a node
+func parseRaw(raw []byte) (Benode, error) {
+	return Parse(bufio.NewReader(bytes.NewReader(raw)))
+}
+
+// decodeRaw stores the encoded node into resVal if it is a RawMessage,
+// or hands the node to resVal if it is an Unmarshaler
+func decodeRaw(node Benode, resVal reflect.Value) (bool, error) {
+	if resVal.CanAddr() && resVal.Addr().Type().Implements(unmarshalerType) {
+		return true, resVal.Addr().Interface().(Unmarshaler).UnmarshalBenode(node)
+	}
+	if resVal.Type() != rawMessageType {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	if err := node.Write(&buf); err != nil {
+		return true, err
+	}
+	resVal.SetBytes(buf.Bytes())
+	return true, nil
+}
+
+// DictNode keeps its keys in order: as read for scanned dicts,
+// sorted for encoded ones, so that writing back is byte exact.
 type DictNode struct {
+	keys []Benode
 	data map[Benode]Benode
 }
 
+func (e *DictNode) set(k, v Benode) {
+	if _, ok := e.data[k]; !ok {
+		e.keys = append(e.keys, k)
+	}
+	e.data[k] = v
+}
+
+func (e *DictNode) find(key string) (int, Benode) {
+	for i, k := range e.keys {
+		if keyString(k) == key {
+			return i, k
+		}
+	}
+	return -1, nil
+}
+
+// Keys returns the keys in write order
+func (e *DictNode) Keys() []string {
+	res := make([]string, len(e.keys))
+	for i, k := range e.keys {
+		res[i] = keyString(k)
+	}
+	return res
+}
+
+// Get returns the value of key, nil if absent
+func (e *DictNode) Get(key string) Benode {
+	if _, k := e.find(key); k != nil {
+		return e.data[k]
+	}
+	return nil
+}
+
+// Set replaces the value of key in place, a new key is inserted
+// before the first greater key so sorted dicts stay sorted
+func (e *DictNode) Set(key string, val Benode) {
+	if _, k := e.find(key); k != nil {
+		e.data[k] = val
+		return
+	}
+	if e.data == nil {
+		e.data = make(map[Benode]Benode)
+	}
+	k := &StringNode{data: utils.Of(key)}
+	idx := sort.Search(len(e.keys), func(i int) bool {
+		return keyString(e.keys[i]) > key
+	})
+	e.keys = append(e.keys, nil)
+	copy(e.keys[idx+1:], e.keys[idx:])
+	e.keys[idx] = k
+	e.data[k] = val
+}
+
+// Delete removes key if present
+func (e *DictNode) Delete(key string) {
+	if i, k := e.find(key); k != nil {
+		e.keys = append(e.keys[:i], e.keys[i+1:]...)
+		delete(e.data, k)
+	}
+}
+
+func (e *DictNode) sortKeys() {
+	sort.SliceStable(e.keys, func(i, j int) bool {
+		return keyString(e.keys[i]) < keyString(e.keys[j])
+	})
+}
+
+func keyString(node Benode) string {
+	if sn, ok := node.(*StringNode); ok && sn.data != nil {
+		return *sn.data
+	}
+	return ""
+}
+
 func (e *DictNode) Write(wd io.Writer) (err error) {
 	if _, err = wd.Write([]byte{DictStartSign}); err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
-	for k, v := range e.data {
+	for _, k := range e.keys {
 		if err = k.Write(wd); err != nil {
 			return err
 		}
-		if err = v.Write(wd); err != nil {
+		if err = e.data[k].Write(wd); err != nil {
 			return err
 		}
 	}
@@ -117,6 +276,9 @@ func (e *DictNode) Decode(res any) (err error) {
 }
 func (e *DictNode) DecodeValue(resVal reflect.Value) (err error) {
 	resVal, _ = unwarpPtr(resVal)
+	if ok, err := decodeRaw(e, resVal); ok {
+		return err
+	}
 	resTyp := resVal.Type()
 	var newVal reflect.Value
 
@@ -154,8 +316,9 @@ func (e *DictNode) DecodeValue(resVal reflect.Value) (err error) {
 	case reflect.Struct:
 		strMap := make(map[string]int, resTyp.NumField())
 		for i := 0; i < resTyp.NumField(); i++ {
-			elemTag := resTyp.Field(i).Tag.Get(BenodeTag)
-			strMap[elemTag] = i
+			if elemTag, _ := parseTag(resTyp.Field(i)); elemTag != "" && elemTag != "-" {
+				strMap[elemTag] = i
+			}
 		}
 
 		newVal = reflect.New(resTyp).Elem()
@@ -186,6 +349,7 @@ func (e *DictNode) EncodeValue(srcVal reflect.Value) (err error) {
 	switch srcTyp.Kind() {
 	case reflect.Map:
 		keysVal := srcVal.MapKeys()
+		e.keys = make([]Benode, 0, len(keysVal))
 		e.data = make(map[Benode]Benode, len(keysVal))
 		var knode, vnode Benode
 		for i := 0; i < len(keysVal); i++ {
@@ -195,24 +359,34 @@ func (e *DictNode) EncodeValue(srcVal reflect.Value) (err error) {
 			if vnode, err = marshalValue(srcVal.MapIndex(keysVal[i])); err != nil {
 				return err
 			}
-			e.data[knode] = vnode
+			e.set(knode, vnode)
 		}
 	case reflect.Struct:
+		e.keys = make([]Benode, 0, srcTyp.NumField())
 		e.data = make(map[Benode]Benode, srcTyp.NumField())
 		var knode, vnode Benode
 		for i := 0; i < srcTyp.NumField(); i++ {
-			field := srcTyp.Field(i)
-			if knode, err = marshalValue(reflect.ValueOf(field.Tag.Get(BenodeTag))); err != nil {
+			name, omitEmpty := parseTag(srcTyp.Field(i))
+			if name == "" || name == "-" {
+				continue
+			}
+			// nil values have no encoding, so they are always omitted
+			fieldVal := srcVal.Field(i)
+			if isNil(fieldVal) || (omitEmpty && isEmpty(fieldVal)) {
+				continue
+			}
+			if knode, err = marshalValue(reflect.ValueOf(name)); err != nil {
 				return err
 			}
-			if vnode, err = marshalValue(srcVal.Field(i)); err != nil {
+			if vnode, err = marshalValue(fieldVal); err != nil {
 				return err
 			}
-			e.data[knode] = vnode
+			e.set(knode, vnode)
 		}
 	default:
 		return fmt.Errorf("%w: DictNode get %v", bTypErr, srcTyp)
 	}
+	e.sortKeys()
 	return nil
 }
 
@@ -241,6 +415,9 @@ func (e *ListNode) Write(wd io.Writer) (err error) {
 
 func (e *ListNode) DecodeValue(resVal reflect.Value) (err error) {
 	resVal, _ = unwarpPtr(resVal)
+	if ok, err := decodeRaw(e, resVal); ok {
+		return err
+	}
 	resTyp := resVal.Type()
 	var newVal reflect.Value
 
@@ -300,7 +477,7 @@ func (e *ListNode) EncodeValue(srcVal reflect.Value) (err error) {
 		for i := 0; i < srcVal.Len(); i++ {
 			elem, err := marshalValue(srcVal.Index(i))
 			if err != nil {
-				return nil
+				return err
 			}
 			e.data[i] = elem
 		}
@@ -317,8 +494,8 @@ func unwarpPtr(resVal reflect.Value) (reflect.Value, int) {
 		if resVal.Kind() != reflect.Pointer {
 			break
 		}
-		if !resVal.Elem().CanSet() {
-			resVal.Set(reflect.New(resVal.Type()).Elem())
+		if resVal.IsNil() {
+			resVal.Set(reflect.New(resVal.Type().Elem()))
 		}
 		ptrCap++
 		resVal = resVal.Elem()
@@ -365,6 +542,9 @@ func (e *IntNode) Decode(res any) (err error) {
 
 func (e *IntNode) DecodeValue(resVal reflect.Value) (err error) {
 	resVal, _ = unwarpPtr(resVal)
+	if ok, err := decodeRaw(e, resVal); ok {
+		return err
+	}
 	resTyp := resVal.Type()
 	var newVal reflect.Value
 
@@ -420,6 +600,9 @@ func (e *StringNode) Encode(src any) (err error) {
 }
 func (e *StringNode) DecodeValue(resVal reflect.Value) (err error) {
 	resVal, _ = unwarpPtr(resVal)
+	if ok, err := decodeRaw(e, resVal); ok {
+		return err
+	}
 	resTyp := resVal.Type()
 	var newVal reflect.Value
 
@@ -471,11 +654,22 @@ func (e *StringNode) Decode(res any) (err error) {
 	return e.DecodeValue(resVal)
 }
 
+// readSlice reads l bytes. The length comes from the input, which may
+// be a peer, so the buffer only grows with the bytes actually read.
 func readSlice(rd *bufio.Reader, l int) (b []byte, err error) {
-	b = make([]byte, l)
-	var n int
-	if n, err = io.ReadFull(rd, b); err != nil {
-		return nil, fmt.Errorf("readSlice %v: %w %v", n, bIOErr, utils.LogSource())
+	if l < 0 {
+		return nil, fmt.Errorf("readSlice %v: %w %v", l, bDataErr, utils.LogSource())
+	}
+	if l <= rd.Size() {
+		b = make([]byte, l)
+		var n int
+		if n, err = io.ReadFull(rd, b); err != nil {
+			return nil, fmt.Errorf("readSlice %v: %w %v", n, bIOErr, utils.LogSource())
+		}
+		return b, nil
+	}
+	if b, err = io.ReadAll(io.LimitReader(rd, int64(l))); err != nil || len(b) != l {
+		return nil, fmt.Errorf("readSlice %v: %w %v", len(b), bIOErr, utils.LogSource())
 	}
 	return b, nil
 }
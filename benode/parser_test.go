@@ -2,6 +2,7 @@ package benode
 
 import (
 	"bufio"
+	"math"
 	"strings"
 	"testing"
 
@@ -59,6 +60,35 @@ func TestInt(t *testing.T) {
 	assert.Equal(t, int64(1234), out)
 }
 
+func TestParseHostile(t *testing.T) {
+	for _, buff := range []string{
+		// lengths far beyond the input must not be allocated
+		"d1:m99999999999999:x",
+		"9999999999999999999:a",
+		"99999999999999999999:a",
+		"i99999999999999999999e",
+		"i-99999999999999999999e",
+		"5000:abc",
+		"i12",
+	} {
+		_, err := Parse(bufio.NewReader(strings.NewReader(buff)))
+		assert.NotNil(t, err, buff)
+	}
+
+	// the largest int and strings beyond the reader buffer still work
+	node, err := Parse(bufio.NewReader(strings.NewReader("i9223372036854775807e")))
+	assert.Nil(t, err)
+	var n int64
+	assert.Nil(t, node.Decode(&n))
+	assert.Equal(t, int64(math.MaxInt64), n)
+	long := strings.Repeat("x", 10000)
+	node, err = Parse(bufio.NewReaderSize(strings.NewReader("10000:"+long), 16))
+	assert.Nil(t, err)
+	var str string
+	assert.Nil(t, node.Decode(&str))
+	assert.Equal(t, long, str)
+}
+
 func TestList(t *testing.T) {
 
 	input := `li1234e4:abcde`
@@ -178,3 +208,94 @@ func TestDict(t *testing.T) {
 		assert.Equal(t, []int64{1, 2, 3}, out.C)
 	}
 }
+
+func TestWriteOrder(t *testing.T) {
+	{
+		// scanned dicts are written back as read
+		input := `d1:bi1e1:ai2ee`
+		rd := bufio.NewReader(strings.NewReader(input))
+		res := _testCtx.ScanDict(rd)
+		assert.Nil(t, _testCtx.Err())
+		var buf strings.Builder
+		assert.Nil(t, res.Write(&buf))
+		assert.Equal(t, input, buf.String())
+	}
+	{
+		// encoded dicts are sorted
+		res, err := Marshal(map[string]int{"b": 1, "a": 2, "c": -3})
+		assert.Nil(t, err)
+		var buf strings.Builder
+		assert.Nil(t, res.Write(&buf))
+		assert.Equal(t, `d1:ai2e1:bi1e1:ci-3ee`, buf.String())
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type T1 struct {
+		A    int        `benode:"a"`
+		Info RawMessage `benode:"info"`
+	}
+	input := `d1:ai1e4:infod1:zi1e1:yli2eeee`
+	var out T1
+	err := Unmarshal(bufio.NewReader(strings.NewReader(input)), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, out.A)
+	assert.Equal(t, `d1:zi1e1:yli2eee`, string(out.Info))
+
+	res, err := Marshal(out)
+	assert.Nil(t, err)
+	var buf strings.Builder
+	assert.Nil(t, res.Write(&buf))
+	assert.Equal(t, input, buf.String())
+}
+
+func TestDictEdit(t *testing.T) {
+	node, err := Parse(bufio.NewReader(strings.NewReader(`d1:bi1e1:di2e1:fi3ee`)))
+	assert.Nil(t, err)
+	dict, ok := node.(*DictNode)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b", "d", "f"}, dict.Keys())
+
+	val, _ := Marshal(5)
+	dict.Set("e", val)
+	dict.Set("a", val)
+	dict.Set("d", val)
+	dict.Delete("f")
+	dict.Delete("z")
+	assert.Equal(t, val, dict.Get("e"))
+	assert.Nil(t, dict.Get("f"))
+
+	var buf strings.Builder
+	assert.Nil(t, dict.Write(&buf))
+	assert.Equal(t, `d1:ai5e1:bi1e1:di5e1:ei5ee`, buf.String())
+}
+
+// words decodes a string or a list of strings
+type words []string
+
+func (w *words) UnmarshalBenode(node Benode) error {
+	if _, ok := node.(*StringNode); ok {
+		var s string
+		if err := node.Decode(&s); err != nil {
+			return err
+		}
+		*w = strings.Fields(s)
+		return nil
+	}
+	return node.Decode((*[]string)(w))
+}
+
+func TestUnmarshaler(t *testing.T) {
+	type T1 struct {
+		A words  `benode:"a"`
+		B *words `benode:"b"`
+	}
+	var out T1
+	err := Unmarshal(bufio.NewReader(strings.NewReader(`d1:a3:x y1:bl1:zee`)), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, words{"x", "y"}, out.A)
+	assert.Equal(t, words{"z"}, *out.B)
+
+	err = Unmarshal(bufio.NewReader(strings.NewReader(`d1:ai1ee`)), &out)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tutorial/bt_demo/torrent"
+)
+
+func runCreate(args []string) error {
+	var trackers, webSeeds listFlag
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	fs.Var(&trackers, "t", "tracker tier, comma separated urls (repeatable)")
+	fs.Var(&webSeeds, "w", "web seed url (repeatable)")
+	out := fs.String("o", "", "output file (default <name>.torrent)")
+	comment := fs.String("c", "", "comment")
+	private := fs.Bool("p", false, "mark the torrent private")
+	source := fs.String("s", "", "source tag")
+	pieceLen := fs.Int("l", 0, "piece length in bytes (default auto)")
+	format := fs.String("f", "v1", "metainfo format: v1, v2 or hybrid")
+	quiet := fs.Bool("q", false, "do not report progress")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt create [flags] <path>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := torrent.CreateOptions{
+		Path:     fs.Arg(0),
+		WebSeeds: webSeeds,
+		Comment:  *comment,
+		Private:  *private,
+		Source:   *source,
+		PieceLen: *pieceLen,
+	}
+	switch *format {
+	case "v1":
+		opts.Format = torrent.FormatV1
+	case "v2":
+		opts.Format = torrent.FormatV2
+	case "hybrid":
+		opts.Format = torrent.FormatHybrid
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+	if !*quiet {
+		opts.Progress = func(done, total int) {
+			fmt.Fprintf(os.Stderr, "\rhashing %3d%%", done*100/total)
+		}
+	}
+
+	tf, err := torrent.Create(opts)
+	if !*quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = filepath.Base(tf.Name) + ".torrent"
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = tf.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("%v: info hash %x, %v pieces of %v bytes\n", *out, tf.InfoSHA, len(tf.PiecesSHA), tf.PieceLen)
+	return nil
+}
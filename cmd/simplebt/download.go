@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/torrent"
+)
+
+func runDownload(args []string) error {
+	var peers listFlag
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	out := fs.String("o", ".", "directory to download into")
+	fs.Var(&peers, "peer", "peer address host:port to connect to (repeatable)")
+	listen := fs.String("listen", ":6881", "address to accept peers on, empty to only dial out")
+	port := fs.Int("port", 0, "port announced to the trackers (default the listen port)")
+	ratio := fs.Float64("seed-ratio", 0, "seed until uploaded this many times the torrent size")
+	seedTime := fs.Duration("seed-time", 0, "seed for this long after the download")
+	quiet := fs.Bool("q", false, "do not report progress")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt download [flags] <file.torrent>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tf, err := torrent.ParseTorrentFile(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	d := torrent.NewDownloader(tf, *out)
+	d.ListenAddr = *listen
+	d.Port = *port
+	d.SeedRatio = *ratio
+	d.SeedTime = *seedTime
+	for _, p := range peers {
+		addr, err := net.ResolveTCPAddr("tcp", p)
+		if err != nil {
+			return err
+		}
+		d.Peers = append(d.Peers, peer.Addr{IP: addr.IP, Port: addr.Port})
+	}
+	if !*quiet {
+		d.Progress = func(p torrent.Progress) {
+			state := "downloading"
+			if p.Seeding {
+				state = "seeding"
+			}
+			fmt.Fprintf(os.Stderr, "\r%v %v/%v pieces, %v left, %v up, %v peers   ",
+				state, p.Have, p.Pieces, torrent.FormatSize(p.Left), torrent.FormatSize(p.Uploaded), p.Peers)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = d.Run(ctx)
+	if !*quiet {
+		fmt.Fprintln(os.Stderr)
+	}
+	return err
+}
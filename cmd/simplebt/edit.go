@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"tutorial/bt_demo/torrent"
+)
+
+func runEdit(args []string) error {
+	var trackers, addTrackers, webSeeds, addWebSeeds listFlag
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	fs.Var(&trackers, "t", "replace trackers with this tier, comma separated urls (repeatable)")
+	fs.Var(&addTrackers, "add-t", "append a tracker tier, comma separated urls (repeatable)")
+	fs.Var(&webSeeds, "w", "replace web seeds with this url (repeatable)")
+	fs.Var(&addWebSeeds, "add-w", "append a web seed url (repeatable)")
+	out := fs.String("o", "", "output file (default rewrite the input)")
+	comment := fs.String("c", "", "set the comment, empty to remove it")
+	createdBy := fs.String("created-by", "", "set created by, empty to remove it")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt edit [flags] <file.torrent>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	input := fs.Arg(0)
+	if *out == "" {
+		*out = input
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	err = torrent.Edit(file, &buf, func(tf *torrent.TorrentFile) error {
+		tiers := tf.Trackers()
+		if set["t"] {
+			tiers = nil
+			for _, tier := range trackers {
+				tiers = append(tiers, strings.Split(tier, ","))
+			}
+		}
+		for _, tier := range addTrackers {
+			tiers = append(tiers, strings.Split(tier, ","))
+		}
+		if set["t"] || set["add-t"] {
+			tf.SetTrackers(tiers)
+		}
+		if set["w"] {
+			tf.URLList = webSeeds
+		}
+		tf.URLList = append(tf.URLList, addWebSeeds...)
+		if set["c"] {
+			tf.Comment = *comment
+		}
+		if set["created-by"] {
+			tf.CreatedBy = *createdBy
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return writeFileAtomic(*out, buf.Bytes())
+}
+
+// writeFileAtomic replaces path so a failed write keeps the old file,
+// the new file gets the permissions of the old one
+func writeFileAtomic(path string, data []byte) (err error) {
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	// the umask may have cleared bits of mode
+	if err = f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
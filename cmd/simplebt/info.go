@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"tutorial/bt_demo/torrent"
+	"tutorial/bt_demo/utils"
+)
+
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt info [flags] <file.torrent>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tf, err := torrent.ParseTorrentFile(file)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		fmt.Println(string(utils.ToJson(tf)))
+		return nil
+	}
+	return tf.WriteSummary(os.Stdout)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"create":   {"create a .torrent from a file or directory", runCreate},
+	"download": {"download a torrent from its swarm", runDownload},
+	"edit":     {"change trackers, web seeds or comment of a .torrent", runEdit},
+	"info":     {"show the metadata of a .torrent", runInfo},
+	"scrape":   {"show seeders and leechers from the trackers", runScrape},
+	"tracker":  {"run an HTTP and UDP tracker", runTracker},
+}
+
+// listFlag collects a repeatable string flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: simplebt <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %v\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "simplebt %v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"tutorial/bt_demo/torrent"
+	"tutorial/bt_demo/tracker"
+	"tutorial/bt_demo/utils"
+)
+
+func runScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 15*time.Second, "time to wait for each tracker")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt scrape [flags] <file.torrent>...\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// group the torrents by tracker to scrape them in batches
+	var urls []string
+	byURL := make(map[string][][utils.SHALEN]byte)
+	for _, path := range fs.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		tf, err := torrent.ParseTorrentFile(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		for _, tier := range tf.Trackers() {
+			for _, u := range tier {
+				if _, ok := byURL[u]; !ok {
+					urls = append(urls, u)
+				}
+				byURL[u] = append(byURL[u], tf.SwarmHash())
+			}
+		}
+	}
+
+	for _, u := range urls {
+		tr, err := tracker.New(u)
+		if err != nil {
+			fmt.Printf("%v: %v\n", u, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		res, err := tr.Scrape(ctx, byURL[u])
+		cancel()
+		if err != nil {
+			fmt.Printf("%v: %v\n", u, err)
+			continue
+		}
+		for _, h := range byURL[u] {
+			stats, ok := res[h]
+			if !ok {
+				fmt.Printf("%v: %x: unknown torrent\n", u, h)
+				continue
+			}
+			fmt.Printf("%v: %x: seeders %v, leechers %v, downloaded %v\n",
+				u, h, stats.Complete, stats.Incomplete, stats.Downloaded)
+		}
+	}
+	return nil
+}
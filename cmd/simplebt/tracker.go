@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"tutorial/bt_demo/torrent"
+	"tutorial/bt_demo/tracker"
+	"tutorial/bt_demo/utils"
+)
+
+func runTracker(args []string) error {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "address of the HTTP tracker, empty to disable")
+	udpAddr := fs.String("udp", ":6969", "address of the UDP tracker, empty to disable")
+	var allow listFlag
+	fs.Var(&allow, "allow", "only serve this .torrent (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: simplebt tracker [flags]\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || (*httpAddr == "" && *udpAddr == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	srv := tracker.NewServer()
+	if len(allow) > 0 {
+		srv.Allowlist = make(map[[utils.SHALEN]byte]bool)
+		for _, path := range allow {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			tf, err := torrent.ParseTorrentFile(file)
+			file.Close()
+			if err != nil {
+				return fmt.Errorf("%v: %w", path, err)
+			}
+			srv.Allowlist[tf.SwarmHash()] = true
+		}
+	}
+
+	errs := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fmt.Printf("udp tracker on %v\n", conn.LocalAddr())
+		go func() { errs <- srv.ServeUDP(conn) }()
+	}
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("http tracker on http://%v/announce\n", ln.Addr())
+		go func() { errs <- http.Serve(ln, srv) }()
+	}
+	return <-errs
+}
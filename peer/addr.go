@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"tutorial/bt_demo/benode"
+)
+
+const (
+	// CompactLen is the size of a compact IPv4 peer (BEP 23)
+	CompactLen = net.IPv4len + 2
+	// Compact6Len is the size of a compact IPv6 peer (BEP 7)
+	Compact6Len = net.IPv6len + 2
+)
+
+// Addr is the address of a peer as announced by a tracker
+type Addr struct {
+	IP   net.IP
+	Port int
+	// ID is only known from dict peer lists or the handshake
+	ID []byte
+}
+
+func (a Addr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// Compact returns the 6 byte form of an IPv4 address or the 18 byte
+// form of an IPv6 one
+func (a Addr) Compact() []byte {
+	ip := a.IP.To4()
+	if ip == nil {
+		ip = a.IP.To16()
+	}
+	res := make([]byte, len(ip)+2)
+	copy(res, ip)
+	binary.BigEndian.PutUint16(res[len(ip):], uint16(a.Port))
+	return res
+}
+
+// ParseCompact reads 6 byte IPv4 peers
+func ParseCompact(b []byte) ([]Addr, error) {
+	return parseCompact(b, net.IPv4len)
+}
+
+// ParseCompact6 reads 18 byte IPv6 peers
+func ParseCompact6(b []byte) ([]Addr, error) {
+	return parseCompact(b, net.IPv6len)
+}
+
+func parseCompact(b []byte, ipLen int) ([]Addr, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, fmt.Errorf("peer: compact length %v is not a multiple of %v", len(b), size)
+	}
+	res := make([]Addr, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:])
+		res = append(res, Addr{IP: ip, Port: int(binary.BigEndian.Uint16(b[i+ipLen:]))})
+	}
+	return res, nil
+}
+
+// EncodeCompact packs the addresses into the peers and peers6
+// strings of a tracker response
+func EncodeCompact(addrs []Addr) (peers, peers6 []byte) {
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			peers = append(peers, a.Compact()...)
+		} else {
+			peers6 = append(peers6, a.Compact()...)
+		}
+	}
+	return peers, peers6
+}
+
+type rawAddr struct {
+	IP     string `benode:"ip"`
+	Port   int    `benode:"port"`
+	PeerID string `benode:"peer id"`
+}
+
+// List is the peers value of a tracker response, either a compact
+// string or a list of dicts
+type List []Addr
+
+func (l *List) UnmarshalBenode(node benode.Benode) (err error) {
+	switch node.(type) {
+	case *benode.StringNode:
+		var compact string
+		if err = node.Decode(&compact); err != nil {
+			return err
+		}
+		*l, err = ParseCompact([]byte(compact))
+		return err
+	case *benode.ListNode:
+		var raws []rawAddr
+		if err = node.Decode(&raws); err != nil {
+			return err
+		}
+		res := make(List, 0, len(raws))
+		for _, r := range raws {
+			ip := net.ParseIP(r.IP)
+			if ip == nil {
+				return fmt.Errorf("peer: invalid ip %q", r.IP)
+			}
+			a := Addr{IP: ip, Port: r.Port}
+			if r.PeerID != "" {
+				a.ID = []byte(r.PeerID)
+			}
+			res = append(res, a)
+		}
+		*l = res
+		return nil
+	}
+	return fmt.Errorf("peer: invalid peer list")
+}
+
+// List6 is the peers6 value of a tracker response
+type List6 []Addr
+
+func (l *List6) UnmarshalBenode(node benode.Benode) (err error) {
+	var compact string
+	if err = node.Decode(&compact); err != nil {
+		return err
+	}
+	*l, err = ParseCompact6([]byte(compact))
+	return err
+}
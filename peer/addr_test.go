@@ -0,0 +1,65 @@
+package peer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"tutorial/bt_demo/benode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompact(t *testing.T) {
+	v4 := Addr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	v6 := Addr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	assert.Equal(t, []byte{10, 0, 0, 1, 0x1a, 0xe1}, v4.Compact())
+	assert.Equal(t, Compact6Len, len(v6.Compact()))
+	assert.Equal(t, "10.0.0.1:6881", v4.String())
+	assert.Equal(t, "[2001:db8::1]:80", v6.String())
+
+	peers, peers6 := EncodeCompact([]Addr{v4, v6, v4})
+	assert.Equal(t, 2*CompactLen, len(peers))
+	assert.Equal(t, Compact6Len, len(peers6))
+
+	res, err := ParseCompact(peers)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(res))
+	assert.True(t, v4.IP.Equal(res[1].IP))
+	assert.Equal(t, 6881, res[1].Port)
+	res, err = ParseCompact6(peers6)
+	assert.Nil(t, err)
+	assert.True(t, v6.IP.Equal(res[0].IP))
+	assert.Equal(t, 80, res[0].Port)
+
+	_, err = ParseCompact(peers[:5])
+	assert.NotNil(t, err)
+	_, err = ParseCompact6(peers6[:17])
+	assert.NotNil(t, err)
+}
+
+func TestListUnmarshal(t *testing.T) {
+	type response struct {
+		Peers  List  `benode:"peers"`
+		Peers6 List6 `benode:"peers6"`
+	}
+	compact := string([]byte{127, 0, 0, 1, 0, 1})
+	compact6 := string(Addr{IP: net.ParseIP("::1"), Port: 2}.Compact())
+	input := "d5:peers6:" + compact + "6:peers618:" + compact6 + "e"
+	var out response
+	assert.Nil(t, benode.Unmarshal(bufio.NewReader(strings.NewReader(input)), &out))
+	assert.Equal(t, "127.0.0.1:1", out.Peers[0].String())
+	assert.Equal(t, "[::1]:2", out.Peers6[0].String())
+
+	input = "d5:peersld2:ip9:127.0.0.17:peer id20:cccccccccccccccccccc4:porti6881eed2:ip3:::14:porti1eeee"
+	out = response{}
+	assert.Nil(t, benode.Unmarshal(bufio.NewReader(strings.NewReader(input)), &out))
+	assert.Equal(t, List{
+		{IP: net.ParseIP("127.0.0.1"), Port: 6881, ID: []byte("cccccccccccccccccccc")},
+		{IP: net.ParseIP("::1"), Port: 1},
+	}, out.Peers)
+
+	for _, input := range []string{"d5:peersi1ee", "d5:peers5:abcdee", "d5:peersld2:ip3:bad4:porti1eeee", "d6:peers6lee"} {
+		assert.NotNil(t, benode.Unmarshal(bufio.NewReader(strings.NewReader(input)), &response{}), input)
+	}
+}
@@ -0,0 +1,189 @@
+package peer
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultUploadSlots        = 3
+	DefaultOptimisticSlots    = 1
+	DefaultChokeInterval      = 10 * time.Second
+	DefaultOptimisticInterval = 30 * time.Second
+)
+
+// Candidate is what the choker knows of a connection
+type Candidate struct {
+	// Peer identifies the connection, e.g. its *Conn
+	Peer       any
+	Interested bool
+	// Snubbed peers do not get a regular slot
+	Snubbed bool
+	// Downloaded and Uploaded are the payload totals of the
+	// connection, the choker turns them into rates
+	Downloaded int
+	Uploaded   int
+}
+
+// Choker implements tit-for-tat: every Interval the interested peers
+// we download from fastest get the Slots, or the peers we upload to
+// fastest when seeding. Every OptimisticInterval other peers are
+// unchoked at random so newcomers get a chance. The caller passes the
+// time in, so the choker can be driven by a fake clock.
+type Choker struct {
+	Slots              int
+	OptimisticSlots    int
+	Interval           time.Duration
+	OptimisticInterval time.Duration
+
+	rand           *rand.Rand
+	lastRound      time.Time
+	lastOptimistic time.Time
+	// prev are the totals at the last round and rates the speeds
+	// between the last two rounds
+	prev       map[any]Candidate
+	rates      map[any]float64
+	regular    map[any]bool
+	optimistic []any
+}
+
+func NewChoker() *Choker {
+	return &Choker{
+		Slots:              DefaultUploadSlots,
+		OptimisticSlots:    DefaultOptimisticSlots,
+		Interval:           DefaultChokeInterval,
+		OptimisticInterval: DefaultOptimisticInterval,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		prev:               make(map[any]Candidate),
+		rates:              make(map[any]float64),
+		regular:            make(map[any]bool),
+	}
+}
+
+// Optimistic returns the peers unchoked at random
+func (ch *Choker) Optimistic() []any {
+	return append([]any{}, ch.optimistic...)
+}
+
+// Rechoke returns the peers to unchoke, every other peer is to be
+// choked. Between rounds it only drops peers that left or lost
+// interest and fills the free slots, so it can be called on every
+// change.
+func (ch *Choker) Rechoke(now time.Time, peers []Candidate, seeding bool) []any {
+	byPeer := make(map[any]Candidate, len(peers))
+	for _, p := range peers {
+		byPeer[p.Peer] = p
+	}
+	eligible := func(p any) bool {
+		c, ok := byPeer[p]
+		return ok && c.Interested && !c.Snubbed
+	}
+
+	if ch.lastRound.IsZero() || now.Sub(ch.lastRound) >= ch.Interval {
+		ch.round(now, peers, seeding)
+	}
+	for p := range ch.regular {
+		if !eligible(p) {
+			delete(ch.regular, p)
+		}
+	}
+
+	rotate := ch.lastOptimistic.IsZero() || now.Sub(ch.lastOptimistic) >= ch.OptimisticInterval
+	if rotate {
+		ch.optimistic = nil
+		ch.lastOptimistic = now
+	}
+	optimistic := ch.optimistic[:0]
+	for _, p := range ch.optimistic {
+		if c, ok := byPeer[p]; ok && c.Interested && !ch.regular[p] {
+			optimistic = append(optimistic, p)
+		}
+	}
+	ch.optimistic = optimistic
+
+	// free regular slots go to the fastest peers waiting
+	for _, p := range ch.ranked(peers) {
+		if len(ch.regular) >= ch.Slots {
+			break
+		}
+		if !ch.regular[p] && !ch.isOptimistic(p) {
+			ch.regular[p] = true
+		}
+	}
+	// free optimistic slots go to random interested peers
+	var waiting []any
+	for _, p := range peers {
+		if p.Interested && !ch.regular[p.Peer] && !ch.isOptimistic(p.Peer) {
+			waiting = append(waiting, p.Peer)
+		}
+	}
+	ch.rand.Shuffle(len(waiting), func(i, j int) { waiting[i], waiting[j] = waiting[j], waiting[i] })
+	for _, p := range waiting {
+		if len(ch.optimistic) >= ch.OptimisticSlots {
+			break
+		}
+		ch.optimistic = append(ch.optimistic, p)
+	}
+
+	var res []any
+	for _, p := range peers {
+		if ch.regular[p.Peer] || ch.isOptimistic(p.Peer) {
+			res = append(res, p.Peer)
+		}
+	}
+	return res
+}
+
+// round measures the rates since the last round and gives the
+// regular slots to the fastest eligible peers
+func (ch *Choker) round(now time.Time, peers []Candidate, seeding bool) {
+	elapsed := now.Sub(ch.lastRound).Seconds()
+	first := ch.lastRound.IsZero()
+	prev, rates := make(map[any]Candidate, len(peers)), make(map[any]float64, len(peers))
+	for _, p := range peers {
+		if last, ok := ch.prev[p.Peer]; ok && !first && elapsed > 0 {
+			delta := p.Downloaded - last.Downloaded
+			if seeding {
+				delta = p.Uploaded - last.Uploaded
+			}
+			rates[p.Peer] = float64(delta) / elapsed
+		}
+		prev[p.Peer] = p
+	}
+	ch.prev, ch.rates = prev, rates
+	ch.lastRound = now
+
+	ch.regular = make(map[any]bool)
+	for _, p := range ch.ranked(peers) {
+		if len(ch.regular) >= ch.Slots {
+			break
+		}
+		ch.regular[p] = true
+	}
+}
+
+// ranked returns the interested peers that do not snub us, fastest
+// first with random ties
+func (ch *Choker) ranked(peers []Candidate) []any {
+	var res []any
+	for _, p := range peers {
+		if p.Interested && !p.Snubbed {
+			res = append(res, p.Peer)
+		}
+	}
+	ch.rand.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+	sort.SliceStable(res, func(i, j int) bool {
+		return ch.rates[res[i]] > ch.rates[res[j]]
+	})
+	return res
+}
+
+func (ch *Choker) isOptimistic(p any) bool {
+	for _, o := range ch.optimistic {
+		if o == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package peer
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testChoker() *Choker {
+	ch := NewChoker()
+	ch.rand = rand.New(rand.NewSource(1))
+	return ch
+}
+
+// testSwarm returns n interested peers named 0..n-1
+func testSwarm(n int) []Candidate {
+	res := make([]Candidate, n)
+	for i := range res {
+		res[i] = Candidate{Peer: i, Interested: true}
+	}
+	return res
+}
+
+func TestChokerRates(t *testing.T) {
+	ch := testChoker()
+	peers := testSwarm(6)
+	start := time.Unix(1000, 0)
+	assert.Len(t, ch.Rechoke(start, peers, false), 4)
+
+	// peer i sends i KiB a second
+	for i := range peers {
+		peers[i].Downloaded = i * 10 << 10
+		peers[i].Uploaded = (5 - i) * 10 << 10
+	}
+	// no new round before the interval
+	before := ch.Rechoke(start.Add(5*time.Second), peers, false)
+	assert.Len(t, before, 4)
+	got := ch.Rechoke(start.Add(10*time.Second), peers, false)
+	assert.Len(t, got, 4)
+	assert.Subset(t, got, []any{5, 4, 3})
+	assert.Len(t, ch.Optimistic(), 1)
+	assert.NotContains(t, []any{5, 4, 3}, ch.Optimistic()[0])
+
+	// seeding ranks by upload rate
+	for i := range peers {
+		peers[i].Uploaded *= 2
+	}
+	got = ch.Rechoke(start.Add(20*time.Second), peers, true)
+	assert.Subset(t, got, []any{0, 1, 2})
+}
+
+func TestChokerOptimistic(t *testing.T) {
+	ch := testChoker()
+	ch.Slots = 1
+	peers := testSwarm(5)
+	start := time.Unix(1000, 0)
+	ch.Rechoke(start, peers, false)
+	first := ch.Optimistic()
+	assert.Len(t, first, 1)
+
+	// kept for the whole interval, then rotated
+	seen := map[any]bool{first[0]: true}
+	for s := 10; s < 30; s += 10 {
+		ch.Rechoke(start.Add(time.Duration(s)*time.Second), peers, false)
+		assert.Equal(t, first, ch.Optimistic())
+	}
+	for s := 30; s <= 300; s += 30 {
+		ch.Rechoke(start.Add(time.Duration(s)*time.Second), peers, false)
+		seen[ch.Optimistic()[0]] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestChokerSnubbed(t *testing.T) {
+	ch := testChoker()
+	ch.OptimisticSlots = 0
+	peers := testSwarm(4)
+	start := time.Unix(1000, 0)
+	ch.Rechoke(start, peers, false)
+
+	// the fastest peer snubs us and loses its slot at once
+	for i := range peers {
+		peers[i].Downloaded = (i + 1) << 20
+	}
+	peers[3].Snubbed = true
+	got := ch.Rechoke(start.Add(10*time.Second), peers, false)
+	assert.ElementsMatch(t, []any{0, 1, 2}, got)
+
+	peers[3].Snubbed = false
+	peers[2].Snubbed = true
+	got = ch.Rechoke(start.Add(11*time.Second), peers, false)
+	assert.ElementsMatch(t, []any{0, 1, 3}, got)
+}
+
+func TestChokerInterest(t *testing.T) {
+	ch := testChoker()
+	peers := testSwarm(2)
+	peers[1].Interested = false
+	start := time.Unix(1000, 0)
+	assert.Equal(t, []any{0}, ch.Rechoke(start, peers, false))
+
+	// free slots are filled without waiting for the next round
+	peers[1].Interested = true
+	assert.Equal(t, []any{0, 1}, ch.Rechoke(start.Add(time.Second), peers, false))
+	peers[0].Interested = false
+	assert.Equal(t, []any{1}, ch.Rechoke(start.Add(2*time.Second), peers, false))
+	assert.Empty(t, ch.Rechoke(start.Add(3*time.Second), nil, false))
+}
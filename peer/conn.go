@@ -0,0 +1,1032 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	DefaultQueueDepth     = 32
+	DefaultRequestTimeout = time.Minute
+	DefaultSnubTimeout    = time.Minute
+	// DefaultKeepAlive is below the 2 minutes after which peers may
+	// drop a silent connection
+	DefaultKeepAlive   = 90 * time.Second
+	DefaultIdleTimeout = 3 * time.Minute
+
+	handshakeTimeout = 20 * time.Second
+	writeTimeout     = 30 * time.Second
+	checkInterval    = time.Second
+)
+
+var (
+	ErrChoked    = errors.New("peer: choked")
+	ErrQueueFull = errors.New("peer: request queue full")
+)
+
+// Block is a part of a piece, the unit of requests
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Blocks splits a piece into BlockLen requests
+func Blocks(index, pieceLen int) []Block {
+	res := make([]Block, 0, (pieceLen+BlockLen-1)/BlockLen)
+	for begin := 0; begin < pieceLen; begin += BlockLen {
+		length := BlockLen
+		if pieceLen-begin < length {
+			length = pieceLen - begin
+		}
+		res = append(res, Block{Index: index, Begin: begin, Length: length})
+	}
+	return res
+}
+
+type EventType int
+
+const (
+	EventBitfield EventType = iota
+	EventHave
+	EventChoke
+	EventUnchoke
+	EventInterested
+	EventNotInterested
+	// EventBlock delivers the data of a requested block
+	EventBlock
+	// EventRequest is a request of the peer while we unchoke it
+	EventRequest
+	EventCancel
+	// EventReject reports a request the peer will not serve
+	EventReject
+	// EventSuggest and EventAllowedFast are hints of the fast
+	// extension, EventAllowedFast pieces may be requested while choked
+	EventSuggest
+	EventAllowedFast
+	// EventExtHandshake reports an extended handshake of the peer
+	EventExtHandshake
+	// EventTimeout reports requests that were not answered in time
+	EventTimeout
+	// EventSnubbed is sent once when the peer stops sending blocks
+	EventSnubbed
+	// EventClosed is the last event of a connection
+	EventClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBitfield:
+		return "bitfield"
+	case EventHave:
+		return "have"
+	case EventChoke:
+		return "choke"
+	case EventUnchoke:
+		return "unchoke"
+	case EventInterested:
+		return "interested"
+	case EventNotInterested:
+		return "not interested"
+	case EventBlock:
+		return "block"
+	case EventRequest:
+		return "request"
+	case EventCancel:
+		return "cancel"
+	case EventReject:
+		return "reject"
+	case EventSuggest:
+		return "suggest"
+	case EventAllowedFast:
+		return "allowed fast"
+	case EventExtHandshake:
+		return "extended handshake"
+	case EventTimeout:
+		return "timeout"
+	case EventSnubbed:
+		return "snubbed"
+	case EventClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("event %d", int(t))
+}
+
+// Event is what a connection reports to the scheduler
+type Event struct {
+	Type EventType
+	Conn *Conn
+	// Index is the piece of EventHave, EventSuggest and
+	// EventAllowedFast
+	Index int
+	// Bitfield is the bitfield of EventBitfield as received, later
+	// pieces come with EventHave
+	Bitfield utils.Bitfield
+	// Block belongs to EventBlock, EventRequest and EventCancel
+	Block Block
+	Data  []byte
+	// Blocks are the requests lost with EventChoke, EventReject,
+	// EventTimeout and EventClosed, they have to be picked again
+	Blocks []Block
+	Err    error
+}
+
+// Conn is an established peer connection. It keeps the choke and
+// interest state of both sides and our outstanding requests.
+type Conn struct {
+	// Remote is the handshake of the peer
+	Remote Handshake
+	// QueueDepth bounds our outstanding requests
+	QueueDepth     int
+	RequestTimeout time.Duration
+	// SnubTimeout is how long the peer may hold our requests without
+	// sending a block
+	SnubTimeout time.Duration
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+	// Extensions are offered when both sides support the extension
+	// protocol
+	Extensions *Extensions
+
+	nc     net.Conn
+	pieces int
+	// fast is set when both sides support the fast extension
+	fast bool
+	// extended is set when both sides support the extension protocol
+	extended bool
+	now      func() time.Time
+	tick     time.Duration
+
+	// wake signals the writer of queued messages
+	wake chan struct{}
+
+	mu             sync.Mutex
+	outq           []*Message
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	bitfield       utils.Bitfield
+	// allowed are the pieces the peer lets us request while choked,
+	// granted the pieces we serve while choking it
+	allowed utils.Bitfield
+	granted map[int]bool
+	// remoteExt merges the extended handshakes of the peer
+	remoteExt *ExtHandshake
+	// requests maps our outstanding requests to the time they were sent
+	requests     map[Block]time.Time
+	peerRequests map[Block]bool
+	// sending counts the pieces queued but not written yet, they
+	// count against DefaultMaxPeerRequests so a peer that does not
+	// read cannot make us buffer more
+	sending    int
+	gotMessage bool
+	snubbed    bool
+	closing    bool
+	// uploaded and downloaded count piece payload bytes
+	uploaded   int
+	downloaded int
+	lastRead   time.Time
+	lastWrite  time.Time
+	lastBlock  time.Time
+}
+
+func newConn(nc net.Conn, local, remote *Handshake, pieces int) *Conn {
+	now := time.Now()
+	return &Conn{
+		Remote:         *remote,
+		QueueDepth:     DefaultQueueDepth,
+		RequestTimeout: DefaultRequestTimeout,
+		SnubTimeout:    DefaultSnubTimeout,
+		KeepAlive:      DefaultKeepAlive,
+		IdleTimeout:    DefaultIdleTimeout,
+		nc:             nc,
+		pieces:         pieces,
+		fast:           local.Reserved.Has(ReservedFast) && remote.Reserved.Has(ReservedFast),
+		extended:       local.Reserved.Has(ReservedExtended) && remote.Reserved.Has(ReservedExtended),
+		now:            time.Now,
+		tick:           checkInterval,
+		wake:           make(chan struct{}, 1),
+		amChoking:      true,
+		peerChoking:    true,
+		bitfield:       utils.NewBitfield(pieces),
+		allowed:        utils.NewBitfield(pieces),
+		granted:        make(map[int]bool),
+		requests:       make(map[Block]time.Time),
+		peerRequests:   make(map[Block]bool),
+		lastRead:       now,
+		lastWrite:      now,
+	}
+}
+
+// Dial connects to addr and exchanges handshakes for a torrent of
+// the given number of pieces
+func Dial(ctx context.Context, addr Addr, local *Handshake, pieces int) (*Conn, error) {
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("peer: %w", err)
+	}
+	return Open(nc, local, pieces)
+}
+
+// Open sends our handshake on an outgoing connection and checks the
+// answer of the peer
+func Open(nc net.Conn, local *Handshake, pieces int) (*Conn, error) {
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	errc := make(chan error, 1)
+	go func() { errc <- WriteHandshake(nc, local) }()
+	remote, err := ReadHandshake(nc)
+	if err == nil {
+		err = checkRemote(local, remote)
+	}
+	if err == nil {
+		err = <-errc
+	} else {
+		nc.Close()
+		<-errc
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return newConn(nc, local, remote, pieces), nil
+}
+
+// Accept reads the handshake of an incoming connection and answers
+// it when find knows the info hash
+func Accept(nc net.Conn, find func(infoHash [utils.SHALEN]byte) (local *Handshake, pieces int, ok bool)) (*Conn, error) {
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	remote, err := ReadHandshake(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	local, pieces, ok := find(remote.InfoHash)
+	if !ok {
+		nc.Close()
+		return nil, fmt.Errorf("peer: unknown info hash %x", remote.InfoHash)
+	}
+	if err = checkRemote(local, remote); err == nil {
+		err = WriteHandshake(nc, local)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return newConn(nc, local, remote, pieces), nil
+}
+
+func checkRemote(local, remote *Handshake) error {
+	if remote.InfoHash != local.InfoHash {
+		return fmt.Errorf("peer: info hash mismatch %x", remote.InfoHash)
+	}
+	if remote.PeerID == local.PeerID {
+		return fmt.Errorf("peer: connected to ourselves")
+	}
+	return nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.nc.RemoteAddr()
+}
+
+func (c *Conn) String() string {
+	return fmt.Sprintf("%v (%v)", c.nc.RemoteAddr(), c.Remote.PeerID.Identify())
+}
+
+// Fast reports whether both sides support the fast extension
+func (c *Conn) Fast() bool {
+	return c.fast
+}
+
+// Extended reports whether both sides support the extension protocol
+func (c *Conn) Extended() bool {
+	return c.extended
+}
+
+// RemoteExtensions returns the extended handshake of the peer, nil
+// until it arrived
+func (c *Conn) RemoteExtensions() *ExtHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteExt == nil {
+		return nil
+	}
+	h := *c.remoteExt
+	h.M = make(map[string]int, len(c.remoteExt.M))
+	for k, v := range c.remoteExt.M {
+		h.M[k] = v
+	}
+	return &h
+}
+
+func (c *Conn) AmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+func (c *Conn) AmInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amInterested
+}
+
+func (c *Conn) PeerChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerChoking
+}
+
+func (c *Conn) PeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerInterested
+}
+
+func (c *Conn) Snubbed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snubbed
+}
+
+// Uploaded is the payload we sent to the peer
+func (c *Conn) Uploaded() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uploaded
+}
+
+// Downloaded is the payload of the requested blocks we received
+func (c *Conn) Downloaded() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.downloaded
+}
+
+// Bitfield returns a copy of the pieces the peer has
+func (c *Conn) Bitfield() utils.Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(utils.Bitfield{}, c.bitfield...)
+}
+
+func (c *Conn) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.Has(index)
+}
+
+// AllowedFast returns a copy of the pieces we may request while the
+// peer chokes us
+func (c *Conn) AllowedFast() utils.Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(utils.Bitfield{}, c.allowed...)
+}
+
+// Outstanding lists our unanswered requests
+func (c *Conn) Outstanding() []Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]Block, 0, len(c.requests))
+	for b := range c.requests {
+		res = append(res, b)
+	}
+	return res
+}
+
+// Free is the number of requests that can be sent now, while choked
+// only allowed fast pieces can be requested
+func (c *Conn) Free() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	depth := c.queueDepth()
+	if (c.peerChoking && c.allowed.Count() == 0) || len(c.requests) >= depth {
+		return 0
+	}
+	return depth - len(c.requests)
+}
+
+// queueDepth is QueueDepth bounded by the reqq of the peer, with mu
+// held
+func (c *Conn) queueDepth() int {
+	if c.remoteExt != nil && c.remoteExt.Reqq > 0 && c.remoteExt.Reqq < c.QueueDepth {
+		return c.remoteExt.Reqq
+	}
+	return c.QueueDepth
+}
+
+// write queues a message for the writer of Run, so a slow peer never
+// blocks the caller
+func (c *Conn) write(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queue(m)
+}
+
+// queue is write with mu held
+func (c *Conn) queue(m *Message) error {
+	if c.closing {
+		return net.ErrClosed
+	}
+	c.outq = append(c.outq, m)
+	c.lastWrite = c.now()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeLoop sends the queued messages until ctx is done
+func (c *Conn) writeLoop(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.wake:
+		}
+		c.mu.Lock()
+		queue := c.outq
+		c.outq = nil
+		c.mu.Unlock()
+
+		var buf []byte
+		pieces := 0
+		for _, m := range queue {
+			buf = append(buf, m.Bytes()...)
+			if m != nil && m.ID == MsgPiece {
+				pieces++
+			}
+		}
+		c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.nc.Write(buf); err != nil {
+			return fmt.Errorf("peer: %w", err)
+		}
+		c.mu.Lock()
+		c.sending -= pieces
+		c.mu.Unlock()
+	}
+}
+
+// Choke stops serving the peer, its pending requests are dropped.
+// With the fast extension they are rejected, except for the allowed
+// fast pieces which are still served.
+func (c *Conn) Choke() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.amChoking {
+		return nil
+	}
+	c.amChoking = true
+	if err := c.queue(NewMessage(MsgChoke)); err != nil {
+		return err
+	}
+	for b := range c.peerRequests {
+		if c.fast && c.granted[b.Index] {
+			continue
+		}
+		delete(c.peerRequests, b)
+		if c.fast {
+			if err := c.queue(NewReject(b.Index, b.Begin, b.Length)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Unchoke() error {
+	c.mu.Lock()
+	if !c.amChoking {
+		c.mu.Unlock()
+		return nil
+	}
+	c.amChoking = false
+	c.mu.Unlock()
+	return c.write(NewMessage(MsgUnchoke))
+}
+
+// SetInterested tells the peer whether we want any of its pieces
+func (c *Conn) SetInterested(interested bool) error {
+	c.mu.Lock()
+	if c.amInterested == interested {
+		c.mu.Unlock()
+		return nil
+	}
+	c.amInterested = interested
+	c.mu.Unlock()
+	if interested {
+		return c.write(NewMessage(MsgInterested))
+	}
+	return c.write(NewMessage(MsgNotInterested))
+}
+
+func (c *Conn) Have(index int) error {
+	return c.write(NewHave(index))
+}
+
+// SendBitfield must be the first message after the handshake. With
+// the fast extension a full or empty bitfield is sent as have all or
+// have none, without it an empty bitfield is not sent at all.
+func (c *Conn) SendBitfield(bf utils.Bitfield) error {
+	switch n := bf.Count(); {
+	case c.fast && n == c.pieces:
+		return c.write(NewMessage(MsgHaveAll))
+	case c.fast && n == 0:
+		return c.write(NewMessage(MsgHaveNone))
+	case n == 0:
+		return nil
+	}
+	return c.write(NewBitfield(bf))
+}
+
+// AllowFast lets the peer request piece index while we choke it, it
+// does nothing without the fast extension
+func (c *Conn) AllowFast(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fast || c.granted[index] {
+		return nil
+	}
+	c.granted[index] = true
+	return c.queue(NewAllowedFast(index))
+}
+
+// Suggest hints a piece the peer should download, it does nothing
+// without the fast extension
+func (c *Conn) Suggest(index int) error {
+	if !c.fast {
+		return nil
+	}
+	return c.write(NewSuggest(index))
+}
+
+// Reject drops a request of the peer we will not serve, the peer is
+// told with the fast extension
+func (c *Conn) Reject(b Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok := c.peerRequests[b]
+	delete(c.peerRequests, b)
+	if !ok || !c.fast {
+		return nil
+	}
+	return c.queue(NewReject(b.Index, b.Begin, b.Length))
+}
+
+// SendExtHandshake sends our extended handshake, it does nothing
+// unless both sides support the extension protocol
+func (c *Conn) SendExtHandshake() error {
+	if !c.extended {
+		return nil
+	}
+	h := &ExtHandshake{Reqq: DefaultMaxPeerRequests}
+	if c.Extensions != nil {
+		h = c.Extensions.Handshake()
+	}
+	if addr, ok := c.nc.RemoteAddr().(*net.TCPAddr); ok {
+		ip := addr.IP.To4()
+		if ip == nil {
+			ip = addr.IP.To16()
+		}
+		h.YourIP = string(ip)
+	}
+	payload, err := h.Bytes()
+	if err != nil {
+		return err
+	}
+	return c.write(NewExtended(ExtHandshakeID, payload))
+}
+
+// SendExtended sends a message of extension name with the id the peer
+// announced, ErrNoExtension if it did not
+func (c *Conn) SendExtended(name string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteExt == nil || c.remoteExt.M[name] <= 0 || c.remoteExt.M[name] > 255 {
+		return ErrNoExtension
+	}
+	return c.queue(NewExtended(uint8(c.remoteExt.M[name]), payload))
+}
+
+// Request asks for a block unless the peer chokes us or the queue is
+// full. Blocks already requested are not sent again. While choked
+// only allowed fast pieces can be requested.
+func (c *Conn) Request(b Block) error {
+	c.mu.Lock()
+	if c.peerChoking && !c.allowed.Has(b.Index) {
+		c.mu.Unlock()
+		return ErrChoked
+	}
+	if _, ok := c.requests[b]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if len(c.requests) >= c.queueDepth() {
+		c.mu.Unlock()
+		return ErrQueueFull
+	}
+	now := c.now()
+	if len(c.requests) == 0 {
+		// the snub timer starts with the pipeline
+		c.lastBlock = now
+	}
+	c.requests[b] = now
+	c.mu.Unlock()
+
+	if err := c.write(NewRequest(b.Index, b.Begin, b.Length)); err != nil {
+		c.mu.Lock()
+		delete(c.requests, b)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Cancel withdraws an outstanding request, e.g. in endgame mode
+func (c *Conn) Cancel(b Block) error {
+	c.mu.Lock()
+	_, ok := c.requests[b]
+	delete(c.requests, b)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.write(NewCancel(b.Index, b.Begin, b.Length))
+}
+
+// SendPiece answers a request of the peer, requests that were
+// cancelled or dropped by a choke are skipped
+func (c *Conn) SendPiece(b Block, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok := c.peerRequests[b]
+	delete(c.peerRequests, b)
+	if !ok {
+		return nil
+	}
+	if err := c.queue(NewPiece(b.Index, b.Begin, data)); err != nil {
+		return err
+	}
+	c.sending++
+	c.uploaded += len(data)
+	return nil
+}
+
+// Close ends the connection, Run returns nil afterwards
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+	return c.nc.Close()
+}
+
+// Run reads messages and reports them as events until ctx is done or
+// the connection fails. It sends keep-alives and detects timed out
+// requests and snubbing. The last event is EventClosed.
+func (c *Conn) Run(ctx context.Context, events chan<- Event) error {
+	loopCtx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 2)
+	go func() { errc <- c.readLoop(loopCtx, events) }()
+	go func() { errc <- c.writeLoop(loopCtx) }()
+	running := 2
+
+	ticker := time.NewTicker(c.tick)
+	var err error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		case err = <-errc:
+			running--
+			break loop
+		case <-ticker.C:
+			evs, cerr := c.check()
+			for _, ev := range evs {
+				c.emit(ctx, events, ev)
+			}
+			if cerr != nil {
+				err = cerr
+				break loop
+			}
+		}
+	}
+	ticker.Stop()
+	cancel()
+	c.nc.Close()
+	for ; running > 0; running-- {
+		<-errc
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.closing {
+		err = nil
+	}
+	lost := make([]Block, 0, len(c.requests))
+	for b := range c.requests {
+		lost = append(lost, b)
+	}
+	c.requests = make(map[Block]time.Time)
+	c.mu.Unlock()
+	c.emit(ctx, events, Event{Type: EventClosed, Blocks: lost, Err: err})
+	return err
+}
+
+func (c *Conn) emit(ctx context.Context, events chan<- Event, ev Event) {
+	ev.Conn = c
+	select {
+	case events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+func (c *Conn) readLoop(ctx context.Context, events chan<- Event) error {
+	for {
+		m, err := ReadMessage(c.nc, MaxMessageLen)
+		if err != nil {
+			return err
+		}
+		ev, err := c.handle(m)
+		if err == nil && m != nil && m.ID == MsgExtended {
+			// handlers run without the lock, they may send messages
+			ev, err = c.handleExtended(m)
+		}
+		if err != nil {
+			return err
+		}
+		if ev != nil {
+			c.emit(ctx, events, *ev)
+		}
+	}
+}
+
+// handle updates the state for a received message and returns the
+// event to report, if any
+func (c *Conn) handle(m *Message) (*Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastRead = c.now()
+	if m == nil {
+		return nil, nil
+	}
+	first := !c.gotMessage
+	c.gotMessage = true
+
+	switch m.ID {
+	case MsgChoke:
+		c.peerChoking = true
+		if c.fast {
+			// the peer rejects the requests it drops
+			return &Event{Type: EventChoke}, nil
+		}
+		// the peer discards our requests
+		lost := make([]Block, 0, len(c.requests))
+		for b := range c.requests {
+			lost = append(lost, b)
+		}
+		c.requests = make(map[Block]time.Time)
+		return &Event{Type: EventChoke, Blocks: lost}, nil
+	case MsgUnchoke:
+		c.peerChoking = false
+		return &Event{Type: EventUnchoke}, nil
+	case MsgInterested:
+		c.peerInterested = true
+		return &Event{Type: EventInterested}, nil
+	case MsgNotInterested:
+		c.peerInterested = false
+		return &Event{Type: EventNotInterested}, nil
+	case MsgHave:
+		index, err := m.ParseHave()
+		if err != nil {
+			return nil, err
+		}
+		if index >= c.pieces {
+			return nil, fmt.Errorf("peer: have %v of %v pieces", index, c.pieces)
+		}
+		if c.bitfield.Has(index) {
+			// a repeated have must not count the piece twice
+			return nil, nil
+		}
+		c.bitfield.Set(index)
+		return &Event{Type: EventHave, Index: index}, nil
+	case MsgBitfield:
+		if !first {
+			return nil, fmt.Errorf("peer: bitfield after other messages")
+		}
+		bf, err := m.ParseBitfield(c.pieces)
+		if err != nil {
+			return nil, err
+		}
+		copy(c.bitfield, bf)
+		return &Event{Type: EventBitfield, Bitfield: bf}, nil
+	case MsgRequest:
+		b, err := c.parseBlock(m)
+		if err != nil {
+			return nil, err
+		}
+		if len(c.peerRequests)+c.sending >= DefaultMaxPeerRequests || (c.amChoking && !(c.fast && c.granted[b.Index])) {
+			if c.fast {
+				return nil, c.queue(NewReject(b.Index, b.Begin, b.Length))
+			}
+			return nil, nil
+		}
+		c.peerRequests[b] = true
+		return &Event{Type: EventRequest, Block: b}, nil
+	case MsgCancel:
+		b, err := c.parseBlock(m)
+		if err != nil {
+			return nil, err
+		}
+		delete(c.peerRequests, b)
+		return &Event{Type: EventCancel, Block: b}, nil
+	case MsgPiece:
+		index, begin, data, err := m.ParsePiece()
+		if err != nil {
+			return nil, err
+		}
+		b := Block{Index: index, Begin: begin, Length: len(data)}
+		if _, ok := c.requests[b]; !ok {
+			// cancelled or never requested
+			return nil, nil
+		}
+		delete(c.requests, b)
+		c.downloaded += len(data)
+		c.lastBlock = c.lastRead
+		c.snubbed = false
+		return &Event{Type: EventBlock, Block: b, Data: data}, nil
+	case MsgHaveAll, MsgHaveNone, MsgReject, MsgSuggest, MsgAllowedFast:
+		if !c.fast {
+			return nil, fmt.Errorf("peer: %v without fast extension", m.ID)
+		}
+		return c.handleFast(m, first)
+	case MsgExtended:
+		if !c.extended {
+			return nil, fmt.Errorf("peer: extended message without extension protocol")
+		}
+		// dispatched by handleExtended
+		return nil, nil
+	}
+	// port and unknown messages are ignored
+	return nil, nil
+}
+
+// handleFast handles the messages of the fast extension with mu held
+func (c *Conn) handleFast(m *Message, first bool) (*Event, error) {
+	switch m.ID {
+	case MsgHaveAll, MsgHaveNone:
+		if !first {
+			return nil, fmt.Errorf("peer: %v after other messages", m.ID)
+		}
+		if m.ID == MsgHaveAll {
+			for i := 0; i < c.pieces; i++ {
+				c.bitfield.Set(i)
+			}
+		}
+		return &Event{Type: EventBitfield, Bitfield: append(utils.Bitfield{}, c.bitfield...)}, nil
+	case MsgReject:
+		b, err := c.parseBlock(m)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.requests[b]; !ok {
+			// cancelled meanwhile
+			return nil, nil
+		}
+		delete(c.requests, b)
+		return &Event{Type: EventReject, Blocks: []Block{b}}, nil
+	case MsgSuggest:
+		index, err := m.ParseSuggest()
+		if err != nil || index >= c.pieces {
+			return nil, err
+		}
+		return &Event{Type: EventSuggest, Index: index}, nil
+	}
+	index, err := m.ParseAllowedFast()
+	if err != nil || index >= c.pieces {
+		// pieces out of range may be ignored
+		return nil, err
+	}
+	c.allowed.Set(index)
+	return &Event{Type: EventAllowedFast, Index: index}, nil
+}
+
+// handleExtended stores an extended handshake or passes a message to
+// the handler of its extension, messages of unknown ids are ignored
+func (c *Conn) handleExtended(m *Message) (*Event, error) {
+	id, payload, err := m.ParseExtended()
+	if err != nil {
+		return nil, err
+	}
+	if id == ExtHandshakeID {
+		h, err := ParseExtHandshake(payload)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.mergeExtensions(h)
+		c.mu.Unlock()
+		return &Event{Type: EventExtHandshake}, nil
+	}
+	if c.Extensions == nil {
+		return nil, nil
+	}
+	name, handler, ok := c.Extensions.lookup(id)
+	if !ok || handler == nil {
+		return nil, nil
+	}
+	if err := handler(c, payload); err != nil {
+		return nil, fmt.Errorf("peer: extension %v: %w", name, err)
+	}
+	return nil, nil
+}
+
+// mergeExtensions applies a handshake of the peer with mu held, later
+// handshakes only change what they contain
+func (c *Conn) mergeExtensions(h *ExtHandshake) {
+	if c.remoteExt == nil {
+		c.remoteExt = &ExtHandshake{M: make(map[string]int)}
+	}
+	for name, id := range h.M {
+		if id <= 0 {
+			delete(c.remoteExt.M, name)
+		} else {
+			c.remoteExt.M[name] = id
+		}
+	}
+	if h.V != "" {
+		c.remoteExt.V = h.V
+	}
+	if h.P > 0 {
+		c.remoteExt.P = h.P
+	}
+	if h.Reqq > 0 {
+		c.remoteExt.Reqq = h.Reqq
+	}
+	if h.YourIP != "" {
+		c.remoteExt.YourIP = h.YourIP
+	}
+	if h.MetadataSize > 0 {
+		c.remoteExt.MetadataSize = h.MetadataSize
+	}
+}
+
+func (c *Conn) parseBlock(m *Message) (Block, error) {
+	index, begin, length, err := m.ParseRequest()
+	if err != nil {
+		return Block{}, err
+	}
+	if index >= c.pieces || length <= 0 || length > MaxBlockLen {
+		return Block{}, fmt.Errorf("peer: invalid %v %v/%v/%v", m.ID, index, begin, length)
+	}
+	return Block{Index: index, Begin: begin, Length: length}, nil
+}
+
+// check runs the timers: keep-alives, request timeouts, snubbing and
+// idle peers
+func (c *Conn) check() ([]Event, error) {
+	c.mu.Lock()
+	now := c.now()
+	if now.Sub(c.lastRead) > c.IdleTimeout {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("peer: idle for %v", now.Sub(c.lastRead))
+	}
+	var events []Event
+	if !c.snubbed && len(c.requests) > 0 && now.Sub(c.lastBlock) > c.SnubTimeout {
+		c.snubbed = true
+		events = append(events, Event{Type: EventSnubbed})
+	}
+	var expired []Block
+	for b, sent := range c.requests {
+		if now.Sub(sent) > c.RequestTimeout {
+			expired = append(expired, b)
+			delete(c.requests, b)
+		}
+	}
+	if len(expired) > 0 {
+		events = append(events, Event{Type: EventTimeout, Blocks: expired})
+	}
+	keepAlive := now.Sub(c.lastWrite) >= c.KeepAlive
+	c.mu.Unlock()
+
+	if keepAlive {
+		if err := c.write(nil); err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,454 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConn returns a Conn on one end of a pipe and the raw other end
+func testConn(t *testing.T, pieces int) (*Conn, net.Conn) {
+	return testConnReserved(t, pieces, Reserved{})
+}
+
+// testConnReserved is testConn with reserved bits on both sides
+func testConnReserved(t *testing.T, pieces int, reserved Reserved) (*Conn, net.Conn) {
+	a, b := net.Pipe()
+	local := &Handshake{Reserved: reserved, InfoHash: [utils.SHALEN]byte{1}, PeerID: testID("-SB0100-local0000000")}
+	remote := &Handshake{Reserved: reserved, InfoHash: local.InfoHash, PeerID: testID("-TR3000-remote000000")}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Accept(b, func(hash [utils.SHALEN]byte) (*Handshake, int, bool) {
+			return remote, pieces, hash == remote.InfoHash
+		})
+		done <- err
+	}()
+	c, err := Open(a, local, pieces)
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return c, b
+}
+
+// runConn starts c and returns its events
+func runConn(t *testing.T, c *Conn) <-chan Event {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event, 100)
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx, events)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestBlocks(t *testing.T) {
+	assert.Equal(t, []Block{{3, 0, BlockLen}, {3, BlockLen, 100}}, Blocks(3, BlockLen+100))
+	assert.Equal(t, 2, len(Blocks(0, 2*BlockLen)))
+}
+
+func TestOpenMismatch(t *testing.T) {
+	a, b := net.Pipe()
+	local := &Handshake{InfoHash: [utils.SHALEN]byte{1}, PeerID: testID("a")}
+	go Open(b, &Handshake{InfoHash: [utils.SHALEN]byte{2}, PeerID: testID("b")}, 1)
+	_, err := Open(a, local, 1)
+	assert.NotNil(t, err)
+
+	// ourselves
+	a, b = net.Pipe()
+	go Open(b, local, 1)
+	_, err = Open(a, local, 1)
+	assert.NotNil(t, err)
+}
+
+func TestConnPipeline(t *testing.T) {
+	c, remote := testConn(t, 10)
+	c.QueueDepth = 2
+	assert.Equal(t, "-TR3000-remote000000", c.Remote.PeerID.String())
+	events := runConn(t, c)
+
+	bf := utils.NewBitfield(10)
+	bf.Set(3)
+	WriteMessage(remote, NewBitfield(bf))
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventBitfield, ev.Type)
+	assert.Equal(t, bf, ev.Bitfield)
+	assert.True(t, c.HasPiece(3))
+	WriteMessage(remote, NewHave(5))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventHave, ev.Type)
+	assert.Equal(t, 5, ev.Index)
+	assert.Equal(t, 2, c.Bitfield().Count())
+	// pieces the peer already has are not reported again
+	WriteMessage(remote, NewHave(5))
+	WriteMessage(remote, NewHave(3))
+	WriteMessage(remote, NewHave(6))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventHave, ev.Type)
+	assert.Equal(t, 6, ev.Index)
+	assert.Equal(t, 3, c.Bitfield().Count())
+
+	// nothing is requested while choked
+	assert.Equal(t, ErrChoked, c.Request(Block{3, 0, BlockLen}))
+	assert.Equal(t, 0, c.Free())
+	WriteMessage(remote, NewMessage(MsgUnchoke))
+	assert.Equal(t, EventUnchoke, nextEvent(t, events).Type)
+	assert.Equal(t, 2, c.Free())
+
+	go func() {
+		c.SetInterested(true)
+		c.Request(Block{3, 0, BlockLen})
+		c.Request(Block{3, BlockLen, BlockLen})
+	}()
+	m, err := ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgInterested, m.ID)
+	for i := 0; i < 2; i++ {
+		m, err = ReadMessage(remote, MaxMessageLen)
+		assert.Nil(t, err)
+		assert.Equal(t, MsgRequest, m.ID)
+	}
+	assert.Equal(t, ErrQueueFull, c.Request(Block{3, 2 * BlockLen, BlockLen}))
+	assert.Equal(t, 0, c.Free())
+
+	WriteMessage(remote, NewPiece(3, 0, make([]byte, BlockLen)))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventBlock, ev.Type)
+	assert.Equal(t, Block{3, 0, BlockLen}, ev.Block)
+	assert.Equal(t, BlockLen, len(ev.Data))
+	assert.Equal(t, 1, c.Free())
+
+	// unrequested blocks are dropped, a choke loses the rest
+	WriteMessage(remote, NewPiece(3, 0, make([]byte, BlockLen)))
+	WriteMessage(remote, NewMessage(MsgChoke))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventChoke, ev.Type)
+	assert.Equal(t, []Block{{3, BlockLen, BlockLen}}, ev.Blocks)
+	assert.Empty(t, c.Outstanding())
+
+	// a bitfield must come first
+	WriteMessage(remote, NewBitfield(bf))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventClosed, ev.Type)
+	assert.NotNil(t, ev.Err)
+}
+
+func TestConnServe(t *testing.T) {
+	c, remote := testConn(t, 10)
+	events := runConn(t, c)
+
+	// requests are ignored while we choke
+	WriteMessage(remote, NewMessage(MsgInterested))
+	assert.Equal(t, EventInterested, nextEvent(t, events).Type)
+	assert.True(t, c.PeerInterested())
+	WriteMessage(remote, NewRequest(1, 0, BlockLen))
+
+	assert.Nil(t, c.Unchoke())
+	m, err := ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgUnchoke, m.ID)
+	WriteMessage(remote, NewRequest(1, 0, BlockLen))
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventRequest, ev.Type)
+	assert.Equal(t, Block{1, 0, BlockLen}, ev.Block)
+
+	go func() {
+		c.SendPiece(ev.Block, []byte("data"))
+		c.Have(2)
+	}()
+	m, err = ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	index, begin, block, err := m.ParsePiece()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 0}, []int{index, begin})
+	assert.Equal(t, "data", string(block))
+	m, err = ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgHave, m.ID)
+
+	// cancelled requests are not served
+	WriteMessage(remote, NewRequest(1, BlockLen, BlockLen))
+	assert.Equal(t, EventRequest, nextEvent(t, events).Type)
+	WriteMessage(remote, NewCancel(1, BlockLen, BlockLen))
+	assert.Equal(t, EventCancel, nextEvent(t, events).Type)
+	go func() {
+		c.SendPiece(Block{1, BlockLen, BlockLen}, make([]byte, BlockLen))
+		c.Have(3)
+	}()
+	m, err = ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgHave, m.ID)
+
+	// oversized requests end the connection
+	WriteMessage(remote, NewRequest(1, 0, MaxBlockLen+1))
+	assert.Equal(t, EventClosed, nextEvent(t, events).Type)
+}
+
+func TestConnSlowReader(t *testing.T) {
+	// the remote keeps requesting but never reads our pieces
+	c, remote := testConn(t, 10)
+	events := runConn(t, c)
+	assert.Nil(t, c.Unchoke())
+	go func() {
+		for i := 0; i < DefaultMaxPeerRequests+50; i++ {
+			WriteMessage(remote, NewRequest(i%10, i/10*BlockLen, BlockLen))
+		}
+		WriteMessage(remote, NewMessage(MsgInterested))
+	}()
+
+	// pieces queued for the writer still count against the limit
+	data := make([]byte, BlockLen)
+	served := 0
+	for {
+		ev := nextEvent(t, events)
+		if ev.Type == EventInterested {
+			break
+		}
+		assert.Equal(t, EventRequest, ev.Type)
+		assert.Nil(t, c.SendPiece(ev.Block, data))
+		served++
+	}
+	assert.Equal(t, DefaultMaxPeerRequests, served)
+}
+
+func TestConnTimers(t *testing.T) {
+	c, remote := testConn(t, 10)
+	c.tick = 5 * time.Millisecond
+	c.KeepAlive = 20 * time.Millisecond
+	c.SnubTimeout = 30 * time.Millisecond
+	c.RequestTimeout = 60 * time.Millisecond
+	c.IdleTimeout = time.Hour
+	events := runConn(t, c)
+
+	WriteMessage(remote, NewMessage(MsgUnchoke))
+	assert.Equal(t, EventUnchoke, nextEvent(t, events).Type)
+	go c.Request(Block{0, 0, BlockLen})
+	m, err := ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, MsgRequest, m.ID)
+
+	// keep-alives flow while the request is pending
+	go func() {
+		for {
+			if _, err := ReadMessage(remote, MaxMessageLen); err != nil {
+				return
+			}
+		}
+	}()
+	assert.Equal(t, EventSnubbed, nextEvent(t, events).Type)
+	assert.True(t, c.Snubbed())
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventTimeout, ev.Type)
+	assert.Equal(t, []Block{{0, 0, BlockLen}}, ev.Blocks)
+	assert.Empty(t, c.Outstanding())
+
+	// a silent peer is dropped
+	c.mu.Lock()
+	c.IdleTimeout = 10 * time.Millisecond
+	c.mu.Unlock()
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventClosed, ev.Type)
+	assert.NotNil(t, ev.Err)
+}
+
+func TestConnClose(t *testing.T) {
+	c, remote := testConn(t, 10)
+	events := runConn(t, c)
+	WriteMessage(remote, NewMessage(MsgUnchoke))
+	assert.Equal(t, EventUnchoke, nextEvent(t, events).Type)
+	go c.Request(Block{0, 0, BlockLen})
+	ReadMessage(remote, MaxMessageLen)
+
+	c.Close()
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventClosed, ev.Type)
+	assert.Nil(t, ev.Err)
+	assert.Equal(t, []Block{{0, 0, BlockLen}}, ev.Blocks)
+}
+
+// readID reads the next message of the raw end and checks its type
+func readID(t *testing.T, remote net.Conn, id MessageID) *Message {
+	m, err := ReadMessage(remote, MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, id, m.ID)
+	return m
+}
+
+func TestConnFast(t *testing.T) {
+	// fast messages need the extension on both sides
+	c, remote := testConn(t, 10)
+	assert.False(t, c.Fast())
+	events := runConn(t, c)
+	WriteMessage(remote, NewMessage(MsgHaveAll))
+	assert.Equal(t, EventClosed, nextEvent(t, events).Type)
+
+	var reserved Reserved
+	reserved.Set(ReservedFast)
+	c, remote = testConnReserved(t, 10, reserved)
+	assert.True(t, c.Fast())
+	events = runConn(t, c)
+	go c.SendBitfield(utils.NewBitfield(10))
+	readID(t, remote, MsgHaveNone)
+	WriteMessage(remote, NewMessage(MsgHaveAll))
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventBitfield, ev.Type)
+	assert.Equal(t, 10, ev.Bitfield.Count())
+	assert.Equal(t, 10, c.Bitfield().Count())
+
+	// a have after have all changes nothing and is not reported
+	WriteMessage(remote, NewHave(4))
+
+	// allowed fast pieces can be requested while choked
+	WriteMessage(remote, NewAllowedFast(2))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventAllowedFast, ev.Type)
+	assert.Equal(t, 2, ev.Index)
+	assert.Equal(t, DefaultQueueDepth, c.Free())
+	assert.Equal(t, ErrChoked, c.Request(Block{3, 0, BlockLen}))
+	assert.Nil(t, c.Request(Block{2, 0, BlockLen}))
+	readID(t, remote, MsgRequest)
+	WriteMessage(remote, NewReject(2, 0, BlockLen))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventReject, ev.Type)
+	assert.Equal(t, []Block{{2, 0, BlockLen}}, ev.Blocks)
+	assert.Empty(t, c.Outstanding())
+
+	// a choke keeps our requests, the peer rejects what it drops
+	WriteMessage(remote, NewMessage(MsgUnchoke))
+	assert.Equal(t, EventUnchoke, nextEvent(t, events).Type)
+	assert.Nil(t, c.Request(Block{3, 0, BlockLen}))
+	readID(t, remote, MsgRequest)
+	WriteMessage(remote, NewMessage(MsgChoke))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventChoke, ev.Type)
+	assert.Empty(t, ev.Blocks)
+	assert.Equal(t, []Block{{3, 0, BlockLen}}, c.Outstanding())
+
+	// while we choke only the pieces we allow are requested
+	go c.AllowFast(5)
+	readID(t, remote, MsgAllowedFast)
+	WriteMessage(remote, NewRequest(1, 0, BlockLen))
+	m := readID(t, remote, MsgReject)
+	index, _, _, err := m.ParseRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+	WriteMessage(remote, NewRequest(5, 0, BlockLen))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventRequest, ev.Type)
+	assert.Equal(t, 5, ev.Block.Index)
+
+	// choking rejects the pending requests but the allowed ones
+	assert.Nil(t, c.Unchoke())
+	readID(t, remote, MsgUnchoke)
+	WriteMessage(remote, NewRequest(1, 0, BlockLen))
+	assert.Equal(t, EventRequest, nextEvent(t, events).Type)
+	go func() {
+		c.Choke()
+		c.SendPiece(Block{5, 0, BlockLen}, []byte("data"))
+		c.Reject(Block{5, 0, BlockLen})
+		c.Suggest(7)
+	}()
+	readID(t, remote, MsgChoke)
+	m = readID(t, remote, MsgReject)
+	index, _, _, err = m.ParseRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+	readID(t, remote, MsgPiece)
+	readID(t, remote, MsgSuggest)
+
+	WriteMessage(remote, NewSuggest(4))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventSuggest, ev.Type)
+	assert.Equal(t, 4, ev.Index)
+}
+
+func TestConnExtended(t *testing.T) {
+	// extended messages need the extension protocol on both sides
+	c, remote := testConn(t, 10)
+	assert.False(t, c.Extended())
+	assert.Nil(t, c.SendExtHandshake())
+	events := runConn(t, c)
+	WriteMessage(remote, NewExtended(ExtHandshakeID, []byte("d1:mdee")))
+	assert.Equal(t, EventClosed, nextEvent(t, events).Type)
+
+	var reserved Reserved
+	reserved.Set(ReservedExtended)
+	c, remote = testConnReserved(t, 10, reserved)
+	assert.True(t, c.Extended())
+	c.Extensions = NewExtensions()
+	assert.Nil(t, c.Extensions.Register("ut_echo", func(c *Conn, payload []byte) error {
+		return c.SendExtended("ut_echo", append([]byte("echo "), payload...))
+	}))
+	assert.Nil(t, c.Extensions.Register("ut_fail", func(c *Conn, payload []byte) error {
+		return ErrNoExtension
+	}))
+	events = runConn(t, c)
+
+	go c.SendExtHandshake()
+	id, payload, err := readID(t, remote, MsgExtended).ParseExtended()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(ExtHandshakeID), id)
+	h, err := ParseExtHandshake(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"ut_echo": 1, "ut_fail": 2}, h.M)
+	assert.Equal(t, ClientVersion, h.V)
+
+	// the ids of the peer are used to send, its reqq bounds our queue
+	assert.Equal(t, ErrNoExtension, c.SendExtended("ut_echo", nil))
+	remoteExt := &ExtHandshake{M: map[string]int{"ut_echo": 7}, Reqq: 2}
+	data, _ := remoteExt.Bytes()
+	WriteMessage(remote, NewExtended(ExtHandshakeID, data))
+	assert.Equal(t, EventExtHandshake, nextEvent(t, events).Type)
+	assert.Equal(t, remoteExt, c.RemoteExtensions())
+	WriteMessage(remote, NewMessage(MsgUnchoke))
+	assert.Equal(t, EventUnchoke, nextEvent(t, events).Type)
+	assert.Equal(t, 2, c.Free())
+
+	// incoming messages go to the handler of our id, unknown ids are
+	// ignored
+	WriteMessage(remote, NewExtended(9, []byte("?")))
+	WriteMessage(remote, NewExtended(1, []byte("ping")))
+	id, payload, err = readID(t, remote, MsgExtended).ParseExtended()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(7), id)
+	assert.Equal(t, "echo ping", string(payload))
+
+	// a later handshake disables the extension
+	WriteMessage(remote, NewExtended(ExtHandshakeID, []byte("d1:md7:ut_echoi0eee")))
+	assert.Equal(t, EventExtHandshake, nextEvent(t, events).Type)
+	assert.Equal(t, ErrNoExtension, c.SendExtended("ut_echo", nil))
+	assert.Equal(t, 2, c.RemoteExtensions().Reqq)
+
+	// handler errors end the connection
+	WriteMessage(remote, NewExtended(2, nil))
+	ev := nextEvent(t, events)
+	assert.Equal(t, EventClosed, ev.Type)
+	assert.ErrorIs(t, ev.Err, ErrNoExtension)
+
+	// a hostile handshake ends the connection, not the process
+	c, remote = testConnReserved(t, 10, reserved)
+	events = runConn(t, c)
+	WriteMessage(remote, NewExtended(ExtHandshakeID, []byte("d1:m99999999999999:x")))
+	ev = nextEvent(t, events)
+	assert.Equal(t, EventClosed, ev.Type)
+	assert.ErrorContains(t, ev.Err, "extended handshake")
+}
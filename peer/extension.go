@@ -0,0 +1,142 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"tutorial/bt_demo/benode"
+)
+
+const (
+	// ExtHandshakeID is the extended message id of the handshake
+	ExtHandshakeID = 0
+	// DefaultMaxPeerRequests is the reqq we announce, requests of the
+	// peer beyond it are dropped
+	DefaultMaxPeerRequests = 250
+)
+
+var ErrNoExtension = errors.New("peer: extension not supported by peer")
+
+// ExtHandshake is the bencoded handshake of the extension protocol
+// (BEP 10). M maps extension names to the message ids the sender
+// wants to receive them with, 0 disables an extension.
+type ExtHandshake struct {
+	M map[string]int `benode:"m"`
+	// V is the client name and version
+	V string `benode:"v,omitempty"`
+	// P is the listen port of the sender
+	P int `benode:"p,omitempty"`
+	// Reqq is how many requests the sender queues
+	Reqq int `benode:"reqq,omitempty"`
+	// YourIP is the compact address the sender sees for the receiver
+	YourIP       string `benode:"yourip,omitempty"`
+	MetadataSize int    `benode:"metadata_size,omitempty"`
+}
+
+// Bytes returns the bencoded handshake
+func (h *ExtHandshake) Bytes() ([]byte, error) {
+	src := *h
+	if src.M == nil {
+		// m is mandatory
+		src.M = map[string]int{}
+	}
+	node, err := benode.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := node.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseExtHandshake decodes the payload of an extended handshake
+func ParseExtHandshake(payload []byte) (*ExtHandshake, error) {
+	var h ExtHandshake
+	if err := benode.Unmarshal(bufio.NewReader(bytes.NewReader(payload)), &h); err != nil {
+		return nil, fmt.Errorf("peer: extended handshake: %w", err)
+	}
+	return &h, nil
+}
+
+// YourAddr returns the address in YourIP, nil if unset or invalid
+func (h *ExtHandshake) YourAddr() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(h.YourIP)
+}
+
+// ExtensionHandler receives the payload of an extended message, an
+// error ends the connection. It runs on the reader of the connection.
+type ExtensionHandler func(c *Conn, payload []byte) error
+
+// Extensions is the registry of the extensions we support. Our
+// message ids follow the order of registration. Register everything
+// before the first connection uses the registry.
+type Extensions struct {
+	// Version, Port and MetadataSize are announced in the handshake
+	Version      string
+	Port         int
+	MetadataSize int
+
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+func NewExtensions() *Extensions {
+	return &Extensions{
+		Version:  ClientVersion,
+		handlers: make(map[string]ExtensionHandler),
+	}
+}
+
+// Register adds an extension, e.g. "ut_metadata"
+func (e *Extensions) Register(name string, h ExtensionHandler) error {
+	if _, ok := e.handlers[name]; ok {
+		return fmt.Errorf("peer: extension %v registered twice", name)
+	}
+	if name == "" || len(e.names) == 255 {
+		return fmt.Errorf("peer: cannot register extension %q", name)
+	}
+	e.names = append(e.names, name)
+	e.handlers[name] = h
+	return nil
+}
+
+// ID is the message id we receive extension name with
+func (e *Extensions) ID(name string) (uint8, bool) {
+	for i, n := range e.names {
+		if n == name {
+			return uint8(i + 1), true
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the extension of one of our message ids
+func (e *Extensions) lookup(id uint8) (string, ExtensionHandler, bool) {
+	if id == ExtHandshakeID || int(id) > len(e.names) {
+		return "", nil, false
+	}
+	name := e.names[id-1]
+	return name, e.handlers[name], true
+}
+
+// Handshake returns our extended handshake
+func (e *Extensions) Handshake() *ExtHandshake {
+	h := &ExtHandshake{
+		M:            make(map[string]int, len(e.names)),
+		V:            e.Version,
+		P:            e.Port,
+		Reqq:         DefaultMaxPeerRequests,
+		MetadataSize: e.MetadataSize,
+	}
+	for i, name := range e.names {
+		h.M[name] = i + 1
+	}
+	return h
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtensions(t *testing.T) {
+	e := NewExtensions()
+	assert.Nil(t, e.Register("ut_metadata", nil))
+	assert.Nil(t, e.Register("ut_pex", nil))
+	assert.NotNil(t, e.Register("ut_pex", nil))
+	assert.NotNil(t, e.Register("", nil))
+	id, ok := e.ID("ut_pex")
+	assert.True(t, ok)
+	assert.Equal(t, uint8(2), id)
+	_, ok = e.ID("lt_donthave")
+	assert.False(t, ok)
+	name, _, ok := e.lookup(1)
+	assert.True(t, ok)
+	assert.Equal(t, "ut_metadata", name)
+	_, _, ok = e.lookup(ExtHandshakeID)
+	assert.False(t, ok)
+	_, _, ok = e.lookup(3)
+	assert.False(t, ok)
+
+	e.Port = 6881
+	e.MetadataSize = 1000
+	h := e.Handshake()
+	h.YourIP = string(net.ParseIP("10.0.0.1").To4())
+	data, err := h.Bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei1000e1:pi6881e"+
+		"4:reqqi250e1:v16:SimpleBT 0.1.0.06:yourip4:\x0a\x00\x00\x01e", string(data))
+
+	res, err := ParseExtHandshake(data)
+	assert.Nil(t, err)
+	assert.Equal(t, h, res)
+	assert.Equal(t, "10.0.0.1", res.YourAddr().String())
+
+	// m is always sent, unknown keys are skipped
+	data, err = (&ExtHandshake{}).Bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "d1:mdee", string(data))
+	res, err = ParseExtHandshake([]byte("d1:md6:ut_pexi0ee1:xi1e6:yourip2:abe"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"ut_pex": 0}, res.M)
+	assert.Nil(t, res.YourAddr())
+	_, err = ParseExtHandshake([]byte("d1:m"))
+	assert.NotNil(t, err)
+
+	// lengths and ints from the peer are not trusted
+	for _, payload := range []string{
+		"d1:m99999999999999:x",
+		"9999999999999999999:a",
+		"d1:pi99999999999999999999ee",
+	} {
+		_, err = ParseExtHandshake([]byte(payload))
+		assert.NotNil(t, err, payload)
+	}
+}
@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"tutorial/bt_demo/utils"
+)
+
+// DefaultAllowedFast is the size of the allowed fast set we grant
+const DefaultAllowedFast = 10
+
+// AllowedFastSet returns the k pieces a peer at ip may request while
+// choked, computed as in BEP 6. The spec only covers IPv4, other
+// addresses get no set.
+func AllowedFastSet(k, pieces int, infoHash [utils.SHALEN]byte, ip net.IP) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieces <= 0 {
+		return nil
+	}
+	if k > pieces {
+		k = pieces
+	}
+	x := make([]byte, 0, 4+utils.SHALEN)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	var res []int
+	for len(res) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(res) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(pieces))
+			if !containsInt(res, index) {
+				res = append(res, index)
+			}
+		}
+	}
+	return res
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// the example of BEP 6
+	var hash [20]byte
+	for i := range hash {
+		hash[i] = 0xaa
+	}
+	ip := net.ParseIP("80.4.4.200")
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188}, AllowedFastSet(7, 1313, hash, ip))
+	assert.Equal(t, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, AllowedFastSet(9, 1313, hash, ip))
+	// the last byte of the address does not matter
+	assert.Equal(t, AllowedFastSet(9, 1313, hash, ip), AllowedFastSet(9, 1313, hash, net.ParseIP("80.4.4.1")))
+
+	assert.ElementsMatch(t, []int{0, 1, 2}, AllowedFastSet(10, 3, hash, ip))
+	assert.Nil(t, AllowedFastSet(10, 3, hash, net.ParseIP("::1")))
+}
@@ -0,0 +1,79 @@
+package peer
+
+import (
+	"fmt"
+	"io"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	// Protocol is the protocol string that starts every handshake
+	Protocol = "BitTorrent protocol"
+	// HandshakeLen is the size of a handshake on the wire
+	HandshakeLen = 1 + len(Protocol) + 8 + utils.SHALEN + utils.SHALEN
+)
+
+// Reserved bits, numbered from the last bit of the reserved bytes
+const (
+	// ReservedDHT announces support of the port message (BEP 5)
+	ReservedDHT = 0
+	// ReservedFast announces the fast extension (BEP 6)
+	ReservedFast = 2
+	// ReservedExtended announces the extension protocol (BEP 10)
+	ReservedExtended = 20
+)
+
+// Reserved are the 8 feature bytes of the handshake
+type Reserved [8]byte
+
+func (r Reserved) Has(bit int) bool {
+	return r[7-bit/8]&(1<<(bit%8)) != 0
+}
+
+func (r *Reserved) Set(bit int) {
+	r[7-bit/8] |= 1 << (bit % 8)
+}
+
+type Handshake struct {
+	Reserved Reserved
+	InfoHash [utils.SHALEN]byte
+	PeerID   PeerID
+}
+
+func (h *Handshake) Bytes() []byte {
+	buf := make([]byte, 0, HandshakeLen)
+	buf = append(buf, byte(len(Protocol)))
+	buf = append(buf, Protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	return append(buf, h.PeerID[:]...)
+}
+
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	_, err := w.Write(h.Bytes())
+	return err
+}
+
+// ReadHandshake reads the handshake of the remote peer, other
+// protocols are rejected
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, HandshakeLen)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return nil, err
+	}
+	if int(buf[0]) != len(Protocol) {
+		return nil, fmt.Errorf("peer: unknown protocol length %v", buf[0])
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		return nil, err
+	}
+	if string(buf[1:1+len(Protocol)]) != Protocol {
+		return nil, fmt.Errorf("peer: unknown protocol %q", buf[1:1+len(Protocol)])
+	}
+	h := &Handshake{}
+	off := 1 + len(Protocol)
+	copy(h.Reserved[:], buf[off:])
+	copy(h.InfoHash[:], buf[off+8:])
+	copy(h.PeerID[:], buf[off+8+utils.SHALEN:])
+	return h, nil
+}
@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserved(t *testing.T) {
+	var r Reserved
+	r.Set(ReservedDHT)
+	r.Set(20)
+	assert.Equal(t, Reserved{0, 0, 0, 0, 0, 0x10, 0, 0x01}, r)
+	assert.True(t, r.Has(ReservedDHT))
+	assert.True(t, r.Has(20))
+	assert.False(t, r.Has(ReservedFast))
+	r.Set(ReservedFast)
+	assert.Equal(t, byte(0x05), r[7])
+}
+
+func TestHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	h := &Handshake{InfoHash: [20]byte{1, 2, 3}, PeerID: testID("-SB0100-abcdefghijkl")}
+	h.Reserved.Set(ReservedDHT)
+	go WriteHandshake(a, h)
+	res, err := ReadHandshake(b)
+	assert.Nil(t, err)
+	assert.Equal(t, h, res)
+	assert.Equal(t, HandshakeLen, len(h.Bytes()))
+	assert.Equal(t, "\x13BitTorrent protocol", string(h.Bytes()[:20]))
+
+	// other protocols are refused
+	bad := h.Bytes()
+	bad[19] = 'X'
+	go a.Write(bad)
+	_, err = ReadHandshake(b)
+	assert.NotNil(t, err)
+	go a.Write([]byte{4})
+	_, err = ReadHandshake(b)
+	assert.NotNil(t, err)
+}
+
+func testID(s string) (id PeerID) {
+	copy(id[:], s)
+	return id
+}
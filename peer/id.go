@@ -0,0 +1,194 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"tutorial/bt_demo/utils"
+)
+
+// ClientPrefix is our Azureus style prefix: SimpleBT 0.1.0.0
+const ClientPrefix = "-SB0100-"
+
+// ClientVersion names us in the extended handshake
+const ClientVersion = "SimpleBT 0.1.0.0"
+
+// PeerID identifies a client in announces and handshakes
+type PeerID [utils.SHALEN]byte
+
+// idChars keeps generated ids printable
+const idChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// NewPeerID returns ClientPrefix followed by random characters
+func NewPeerID() (id PeerID, err error) {
+	copy(id[:], ClientPrefix)
+	suffix := id[len(ClientPrefix):]
+	if _, err = rand.Read(suffix); err != nil {
+		return PeerID{}, err
+	}
+	for i, b := range suffix {
+		suffix[i] = idChars[int(b)%len(idChars)]
+	}
+	return id, nil
+}
+
+var (
+	defaultID     PeerID
+	defaultIDOnce sync.Once
+)
+
+// DefaultPeerID is generated on first use and kept for the lifetime
+// of the process
+func DefaultPeerID() PeerID {
+	defaultIDOnce.Do(func() {
+		id, err := NewPeerID()
+		if err != nil {
+			panic(fmt.Sprintf("peer: generate id: %v", err))
+		}
+		defaultID = id
+	})
+	return defaultID
+}
+
+func (id PeerID) IsZero() bool {
+	return id == PeerID{}
+}
+
+// String shows printable ids as text and others in hex
+func (id PeerID) String() string {
+	for _, b := range id {
+		if b < 0x20 || b > 0x7e {
+			return hex.EncodeToString(id[:])
+		}
+	}
+	return string(id[:])
+}
+
+// Client is the software a peer id was generated by
+type Client struct {
+	Name    string
+	Version string
+}
+
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// azureusClients maps the two letter codes of -XX1234- style ids
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"SB": "SimpleBT",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the letter of S58B----- style ids
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the version digits of shadow style ids
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// Identify guesses the client from the id, the Azureus, Shadow and
+// Mainline styles are known. Unknown ids give an empty Client.
+func (id PeerID) Identify() Client {
+	s := string(id[:])
+	switch {
+	case s[0] == '-' && s[7] == '-':
+		name, ok := azureusClients[s[1:3]]
+		if !ok {
+			name = "unknown " + s[1:3]
+		}
+		return Client{Name: name, Version: azureusVersion(s[1:3], s[3:7])}
+	case s[0] == 'M' || s[0] == 'Q':
+		if version, ok := mainlineVersion(s[1:8]); ok {
+			name := "BitTorrent"
+			if s[0] == 'Q' {
+				name = "Queen Bee"
+			}
+			return Client{Name: name, Version: version}
+		}
+	}
+	if name, ok := shadowClients[s[0]]; ok && strings.HasPrefix(s[6:9], "---") {
+		var parts []string
+		for _, c := range []byte(strings.TrimRight(s[1:6], "-")) {
+			d := strings.IndexByte(shadowDigits, c)
+			if d < 0 {
+				return Client{}
+			}
+			parts = append(parts, fmt.Sprint(d))
+		}
+		return Client{Name: name, Version: strings.Join(parts, ".")}
+	}
+	return Client{}
+}
+
+// azureusVersion reads the four version characters, most clients use
+// one digit per part and Transmission uses major and two minor digits
+func azureusVersion(code, v string) string {
+	if code == "TR" {
+		switch {
+		case v[3] == 'Z' || v[3] == 'X':
+			return fmt.Sprintf("%c.%v+", v[0], v[1:3])
+		case v[0] == '0':
+			return fmt.Sprintf("%c.%v", v[1], v[2:4])
+		default:
+			return fmt.Sprintf("%c.%v", v[0], v[1:3])
+		}
+	}
+	parts := make([]string, 0, 4)
+	for _, c := range []byte(v) {
+		switch {
+		case c >= '0' && c <= '9':
+			parts = append(parts, string(c))
+		case c >= 'A' && c <= 'Z':
+			parts = append(parts, fmt.Sprint(int(c-'A')+10))
+		default:
+			return v
+		}
+	}
+	// 4.2.5.0 reads as 4.2.5, 0.1.0.0 as 0.1
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// mainlineVersion reads the 4-3-6-- part of M4-3-6-- style ids
+func mainlineVersion(s string) (string, bool) {
+	parts := strings.SplitN(s, "-", 4)
+	if len(parts) < 4 {
+		return "", false
+	}
+	for _, p := range parts[:3] {
+		if p == "" || strings.Trim(p, "0123456789") != "" {
+			return "", false
+		}
+	}
+	return strings.Join(parts[:3], "."), true
+}
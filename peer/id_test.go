@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPeerID(t *testing.T) {
+	a, err := NewPeerID()
+	assert.Nil(t, err)
+	b, err := NewPeerID()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(a.String(), ClientPrefix))
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, Client{Name: "SimpleBT", Version: "0.1"}, a.Identify())
+	assert.False(t, a.IsZero())
+
+	assert.Equal(t, DefaultPeerID(), DefaultPeerID())
+	assert.True(t, PeerID{}.IsZero())
+	assert.Equal(t, strings.Repeat("00", 20), PeerID{}.String())
+}
+
+func TestIdentify(t *testing.T) {
+	for id, want := range map[string]Client{
+		"-qB4250-abcdefghijkl": {"qBittorrent", "4.2.5"},
+		"-TR2840-abcdefghijkl": {"Transmission", "2.84"},
+		"-TR0072-abcdefghijkl": {"Transmission", "0.72"},
+		"-TR400Z-abcdefghijkl": {"Transmission", "4.00+"},
+		"-UT3550-abcdefghijkl": {"µTorrent", "3.5.5"},
+		"-AZ12a4-abcdefghijkl": {"Vuze", "12a4"},
+		"-LT1B20-abcdefghijkl": {"libtorrent", "1.11.2"},
+		"-ZZ1000-abcdefghijkl": {"unknown ZZ", "1.0"},
+		"M7-10-3--abcdefghijk": {"BitTorrent", "7.10.3"},
+		"Q1-2-3--abcdefghijkl": {"Queen Bee", "1.2.3"},
+		"S58B-----abcdefghijk": {"Shadow", "5.8.11"},
+		"T03I--00abcdefghijkl": {"", ""},
+		"abcdefghijklmnopqrst": {"", ""},
+	} {
+		var p PeerID
+		copy(p[:], id)
+		assert.Equal(t, want, p.Identify(), id)
+	}
+	assert.Equal(t, "qBittorrent 4.2.5", Client{"qBittorrent", "4.2.5"}.String())
+	assert.Equal(t, "Shadow", Client{Name: "Shadow"}.String())
+}
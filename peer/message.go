@@ -0,0 +1,317 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"tutorial/bt_demo/utils"
+)
+
+type MessageID uint8
+
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+	// fast extension (BEP 6)
+	MsgSuggest     MessageID = 0x0d
+	MsgHaveAll     MessageID = 0x0e
+	MsgHaveNone    MessageID = 0x0f
+	MsgReject      MessageID = 0x10
+	MsgAllowedFast MessageID = 0x11
+	// MsgExtended carries the extension protocol (BEP 10)
+	MsgExtended MessageID = 20
+)
+
+const (
+	// BlockLen is the size of the blocks requested from peers
+	BlockLen = 16 << 10
+	// MaxBlockLen is the largest request we serve
+	MaxBlockLen = 128 << 10
+	// MaxMessageLen bounds incoming messages, it fits a piece message
+	// of MaxBlockLen (id, index and begin come first) and the bitfield
+	// of 1M pieces, which is 1 + 1<<17 bytes
+	MaxMessageLen = 9 + MaxBlockLen
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggest:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgReject:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	}
+	return fmt.Sprintf("message %d", uint8(id))
+}
+
+// payloadLen is the fixed payload size of a message, -1 if it varies
+// and -2 for unknown messages
+func payloadLen(id MessageID) int {
+	switch id {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return 0
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return 4
+	case MsgRequest, MsgCancel, MsgReject:
+		return 12
+	case MsgPort:
+		return 2
+	case MsgBitfield, MsgPiece, MsgExtended:
+		return -1
+	}
+	return -2
+}
+
+// Message is a framed peer message, a nil *Message is a keep-alive
+type Message struct {
+	ID      MessageID
+	Payload []byte
+}
+
+func (m *Message) String() string {
+	if m == nil {
+		return "keep-alive"
+	}
+	return fmt.Sprintf("%v [%d]", m.ID, len(m.Payload))
+}
+
+// Bytes returns the message with its length prefix
+func (m *Message) Bytes() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+	buf := make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(m.Payload)))
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+func WriteMessage(w io.Writer, m *Message) error {
+	_, err := w.Write(m.Bytes())
+	return err
+}
+
+// ReadMessage reads one message, messages longer than maxLen and
+// known messages of the wrong size are rejected. A keep-alive is
+// returned as nil.
+func ReadMessage(r io.Reader, maxLen int) (*Message, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n == 0 {
+		return nil, nil
+	}
+	if n > uint32(maxLen) {
+		return nil, fmt.Errorf("peer: message of %v bytes exceeds %v", n, maxLen)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	m := &Message{ID: MessageID(buf[0])}
+	if n > 1 {
+		m.Payload = buf[1:]
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Message) validate() error {
+	switch want := payloadLen(m.ID); {
+	case want >= 0 && len(m.Payload) != want:
+		return fmt.Errorf("peer: %v with %v bytes of payload, want %v", m.ID, len(m.Payload), want)
+	case m.ID == MsgPiece && len(m.Payload) < 8:
+		return fmt.Errorf("peer: piece with %v bytes of payload", len(m.Payload))
+	case m.ID == MsgExtended && len(m.Payload) < 1:
+		return fmt.Errorf("peer: extended message without id")
+	}
+	return nil
+}
+
+func NewHave(index int) *Message {
+	return newIndexMessage(MsgHave, index)
+}
+
+func NewSuggest(index int) *Message {
+	return newIndexMessage(MsgSuggest, index)
+}
+
+func NewAllowedFast(index int) *Message {
+	return newIndexMessage(MsgAllowedFast, index)
+}
+
+func newIndexMessage(id MessageID, index int) *Message {
+	m := &Message{ID: id, Payload: make([]byte, 4)}
+	binary.BigEndian.PutUint32(m.Payload, uint32(index))
+	return m
+}
+
+func NewBitfield(bf utils.Bitfield) *Message {
+	return &Message{ID: MsgBitfield, Payload: append([]byte{}, bf...)}
+}
+
+func NewRequest(index, begin, length int) *Message {
+	return newBlockMessage(MsgRequest, index, begin, length)
+}
+
+func NewCancel(index, begin, length int) *Message {
+	return newBlockMessage(MsgCancel, index, begin, length)
+}
+
+func NewReject(index, begin, length int) *Message {
+	return newBlockMessage(MsgReject, index, begin, length)
+}
+
+func newBlockMessage(id MessageID, index, begin, length int) *Message {
+	m := &Message{ID: id, Payload: make([]byte, 12)}
+	binary.BigEndian.PutUint32(m.Payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(m.Payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(m.Payload[8:12], uint32(length))
+	return m
+}
+
+func NewPiece(index, begin int, block []byte) *Message {
+	m := &Message{ID: MsgPiece, Payload: make([]byte, 8+len(block))}
+	binary.BigEndian.PutUint32(m.Payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(m.Payload[4:8], uint32(begin))
+	copy(m.Payload[8:], block)
+	return m
+}
+
+func NewPort(port int) *Message {
+	m := &Message{ID: MsgPort, Payload: make([]byte, 2)}
+	binary.BigEndian.PutUint16(m.Payload, uint16(port))
+	return m
+}
+
+// NewExtended wraps the payload of extended message id, 0 is the
+// extended handshake
+func NewExtended(id uint8, payload []byte) *Message {
+	return &Message{ID: MsgExtended, Payload: append([]byte{id}, payload...)}
+}
+
+// NewMessage returns a message without payload, e.g. choke
+func NewMessage(id MessageID) *Message {
+	return &Message{ID: id}
+}
+
+func (m *Message) expect(id MessageID) error {
+	if m == nil || m.ID != id {
+		return fmt.Errorf("peer: expected %v, got %v", id, m)
+	}
+	return m.validate()
+}
+
+func (m *Message) ParseHave() (int, error) {
+	return m.parseIndex(MsgHave)
+}
+
+func (m *Message) ParseSuggest() (int, error) {
+	return m.parseIndex(MsgSuggest)
+}
+
+func (m *Message) ParseAllowedFast() (int, error) {
+	return m.parseIndex(MsgAllowedFast)
+}
+
+func (m *Message) parseIndex(id MessageID) (int, error) {
+	if err := m.expect(id); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+// ParseRequest reads a request, cancel or reject message
+func (m *Message) ParseRequest() (index, begin, length int, err error) {
+	if m == nil || (m.ID != MsgRequest && m.ID != MsgCancel && m.ID != MsgReject) {
+		return 0, 0, 0, fmt.Errorf("peer: expected request, cancel or reject, got %v", m)
+	}
+	if err = m.validate(); err != nil {
+		return 0, 0, 0, err
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func (m *Message) ParsePiece() (index, begin int, block []byte, err error) {
+	if err = m.expect(MsgPiece); err != nil {
+		return 0, 0, nil, err
+	}
+	index = int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
+
+func (m *Message) ParseExtended() (id uint8, payload []byte, err error) {
+	if err = m.expect(MsgExtended); err != nil {
+		return 0, nil, err
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
+
+// ParseBitfield checks the bitfield against the piece count, spare
+// bits must be clear
+func (m *Message) ParseBitfield(pieces int) (utils.Bitfield, error) {
+	if err := m.expect(MsgBitfield); err != nil {
+		return nil, err
+	}
+	if len(m.Payload) != (pieces+7)/8 {
+		return nil, fmt.Errorf("peer: bitfield of %v bytes for %v pieces", len(m.Payload), pieces)
+	}
+	bf := utils.Bitfield(m.Payload)
+	for i := pieces; i < len(bf)*8; i++ {
+		if bf.Has(i) {
+			return nil, fmt.Errorf("peer: bitfield has spare bit %v set", i)
+		}
+	}
+	return bf, nil
+}
+
+func (m *Message) ParsePort() (int, error) {
+	if err := m.expect(MsgPort); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(m.Payload)), nil
+}
@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	bf := utils.NewBitfield(10)
+	bf.Set(0)
+	bf.Set(9)
+	msgs := []*Message{
+		nil,
+		NewMessage(MsgChoke),
+		NewMessage(MsgUnchoke),
+		NewMessage(MsgInterested),
+		NewMessage(MsgNotInterested),
+		NewHave(7),
+		NewBitfield(bf),
+		NewRequest(1, BlockLen, BlockLen),
+		NewPiece(1, BlockLen, []byte("data")),
+		NewCancel(1, BlockLen, BlockLen),
+		NewPort(6881),
+		NewSuggest(3),
+		NewMessage(MsgHaveAll),
+		NewMessage(MsgHaveNone),
+		NewReject(1, 0, BlockLen),
+		NewAllowedFast(4),
+		NewExtended(3, []byte("d1:ai1ee")),
+	}
+	go func() {
+		for _, m := range msgs {
+			WriteMessage(a, m)
+		}
+	}()
+	for _, want := range msgs {
+		m, err := ReadMessage(b, MaxMessageLen)
+		assert.Nil(t, err)
+		assert.Equal(t, want, m)
+	}
+
+	have, err := msgs[5].ParseHave()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, have)
+	res, err := msgs[6].ParseBitfield(10)
+	assert.Nil(t, err)
+	assert.True(t, res.Has(9))
+	index, begin, length, err := msgs[9].ParseRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, BlockLen, BlockLen}, []int{index, begin, length})
+	index, begin, block, err := msgs[8].ParsePiece()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, BlockLen}, []int{index, begin})
+	assert.Equal(t, "data", string(block))
+	port, err := msgs[10].ParsePort()
+	assert.Nil(t, err)
+	assert.Equal(t, 6881, port)
+
+	index, err = msgs[11].ParseSuggest()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, index)
+	index, begin, length, err = msgs[14].ParseRequest()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 0, BlockLen}, []int{index, begin, length})
+	index, err = msgs[15].ParseAllowedFast()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, index)
+	assert.Equal(t, "reject request [12]", msgs[14].String())
+	id, payload, err := msgs[16].ParseExtended()
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(3), id)
+	assert.Equal(t, "d1:ai1ee", string(payload))
+
+	_, err = msgs[5].ParsePort()
+	assert.NotNil(t, err)
+	_, err = msgs[0].ParseHave()
+	assert.NotNil(t, err)
+}
+
+func TestMessageMaxLen(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// the largest piece and bitfield messages must be accepted
+	block := bytes.Repeat([]byte{7}, MaxBlockLen)
+	bf := utils.NewBitfield(1 << 20)
+	bf.Set(1<<20 - 1)
+	msgs := []*Message{NewPiece(1, 0, block), NewBitfield(bf)}
+	go func() {
+		for _, m := range msgs {
+			WriteMessage(a, m)
+		}
+	}()
+	for _, want := range msgs {
+		m, err := ReadMessage(b, MaxMessageLen)
+		assert.Nil(t, err)
+		assert.Equal(t, want, m)
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	frame := func(n uint32, rest ...byte) *bytes.Reader {
+		buf := binary.BigEndian.AppendUint32(nil, n)
+		return bytes.NewReader(append(buf, rest...))
+	}
+	// too long
+	_, err := ReadMessage(frame(MaxMessageLen+1), MaxMessageLen)
+	assert.NotNil(t, err)
+	// have with a short payload
+	_, err = ReadMessage(frame(3, byte(MsgHave), 0, 0), MaxMessageLen)
+	assert.NotNil(t, err)
+	// choke with a payload
+	_, err = ReadMessage(frame(2, byte(MsgChoke), 0), MaxMessageLen)
+	assert.NotNil(t, err)
+	// piece without begin
+	_, err = ReadMessage(frame(5, byte(MsgPiece), 0, 0, 0, 1), MaxMessageLen)
+	assert.NotNil(t, err)
+	// extended without its id
+	_, err = ReadMessage(frame(1, byte(MsgExtended)), MaxMessageLen)
+	assert.NotNil(t, err)
+	// truncated message
+	_, err = ReadMessage(frame(5, byte(MsgHave), 0), MaxMessageLen)
+	assert.NotNil(t, err)
+	// unknown messages pass through
+	m, err := ReadMessage(frame(3, 99, 1, 2), MaxMessageLen)
+	assert.Nil(t, err)
+	assert.Equal(t, &Message{ID: 99, Payload: []byte{1, 2}}, m)
+	assert.Equal(t, "message 99 [2]", m.String())
+
+	// bitfields must match the piece count
+	bf := NewBitfield(utils.Bitfield{0xff, 0xc0})
+	_, err = bf.ParseBitfield(10)
+	assert.Nil(t, err)
+	_, err = bf.ParseBitfield(9)
+	assert.NotNil(t, err)
+	_, err = bf.ParseBitfield(17)
+	assert.NotNil(t, err)
+}
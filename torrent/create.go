@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	minPieceLen    = 16 << 10
+	maxPieceLen    = 16 << 20
+	targetPieceCnt = 1500
+
+	defaultCreatedBy = "SimpleBT"
+)
+
+type CreateOptions struct {
+	// Path is the file or directory to share
+	Path string
+	// Trackers are the announce tiers, the first url is used as announce
+	Trackers [][]string
+	WebSeeds []string
+	Comment  string
+	// CreatedBy defaults to SimpleBT
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	Source       string
+	// Format defaults to FormatV1
+	Format Format
+	// PieceLen is chosen from the total size when 0
+	PieceLen int
+	// Workers defaults to the number of CPUs
+	Workers int
+	// Progress is called with the hashed and total bytes
+	Progress func(done, total int)
+}
+
+// PieceLenFor picks a power of two piece length giving roughly
+// targetPieceCnt pieces, between 16 KiB and 16 MiB
+func PieceLenFor(total int) int {
+	pieceLen := minPieceLen
+	for pieceLen < maxPieceLen && total/pieceLen > targetPieceCnt {
+		pieceLen *= 2
+	}
+	return pieceLen
+}
+
+// Create builds a torrent from the file or directory at opts.Path
+func Create(opts CreateOptions) (*TorrentFile, error) {
+	if n := opts.PieceLen; n != 0 && (n < minPieceLen || n&(n-1) != 0) {
+		return nil, fmt.Errorf("create: piece length %v is not a power of two of at least %v", n, minPieceLen)
+	}
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &TorrentFile{
+		Name:      filepath.Base(root),
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		URLList:   opts.WebSeeds,
+		Private:   opts.Private,
+		Source:    opts.Source,
+	}
+	if tf.CreatedBy == "" {
+		tf.CreatedBy = defaultCreatedBy
+	}
+	tf.CreationDate = opts.CreationDate
+	if tf.CreationDate.IsZero() {
+		tf.CreationDate = time.Unix(time.Now().Unix(), 0)
+	}
+	tf.SetTrackers(opts.Trackers)
+
+	var paths []string
+	if stat.IsDir() {
+		if paths, err = walkFiles(root); err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("create: no files in %v", root)
+		}
+		for _, p := range paths {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return nil, err
+			}
+			info, err := os.Stat(p)
+			if err != nil {
+				return nil, err
+			}
+			tf.Files = append(tf.Files, FileInfo{
+				Length: int(info.Size()),
+				Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+			tf.FileLen += int(info.Size())
+		}
+	} else {
+		paths = []string{root}
+		tf.FileLen = int(stat.Size())
+	}
+	if tf.FileLen == 0 {
+		return nil, fmt.Errorf("create: %v has no data", root)
+	}
+
+	tf.PieceLen = opts.PieceLen
+	if tf.PieceLen == 0 {
+		tf.PieceLen = PieceLenFor(tf.FileLen)
+	}
+	switch opts.Format {
+	case FormatV1:
+		tf.PiecesSHA, err = hashPieces(paths, tf.FileLen, tf.PieceLen, opts.Workers, opts.Progress)
+	case FormatV2, FormatHybrid:
+		err = createV2(tf, paths, opts)
+	default:
+		err = fmt.Errorf("create: unknown format %v", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := tf.infoBytes()
+	if err != nil {
+		return nil, err
+	}
+	tf.setInfo(info)
+	return tf, nil
+}
+
+// walkFiles lists the regular files below root sorted by path
+// elements, the order of the v2 file tree
+func walkFiles(root string) (paths []string, err error) {
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Slice(paths, func(i, j int) bool {
+		a := strings.Split(paths[i], string(filepath.Separator))
+		b := strings.Split(paths[j], string(filepath.Separator))
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return paths, err
+}
+
+type pieceJob struct {
+	idx  int
+	data []byte
+}
+
+// hashPieces reads the files as one stream and hashes its pieces
+// on workers goroutines
+func hashPieces(paths []string, total, pieceLen, workers int, progress func(done, total int)) ([][utils.SHALEN]byte, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	cnt := (total + pieceLen - 1) / pieceLen
+	res := make([][utils.SHALEN]byte, cnt)
+
+	jobs := make(chan pieceJob, workers)
+	done := make(chan int, workers)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(jobs)
+		readErr <- readPieces(paths, pieceLen, jobs)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				// files that grew while reading are caught by the size check
+				if job.idx < cnt {
+					res[job.idx] = sha1.Sum(job.data)
+				}
+				done <- len(job.data)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	hashed := 0
+	for n := range done {
+		hashed += n
+		if progress != nil {
+			progress(hashed, total)
+		}
+	}
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	if hashed != total {
+		return nil, fmt.Errorf("create: read %v bytes, expected %v", hashed, total)
+	}
+	return res, nil
+}
+
+func readPieces(paths []string, pieceLen int, jobs chan<- pieceJob) error {
+	idx := 0
+	buf := make([]byte, 0, pieceLen)
+	for _, p := range paths {
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		for {
+			n, err := io.ReadFull(file, buf[len(buf):pieceLen])
+			buf = buf[:len(buf)+n]
+			if len(buf) == pieceLen {
+				jobs <- pieceJob{idx: idx, data: buf}
+				idx++
+				buf = make([]byte, 0, pieceLen)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+	}
+	if len(buf) > 0 {
+		jobs <- pieceJob{idx: idx, data: buf}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, path string, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	assert.Nil(t, os.WriteFile(path, data, 0o644))
+	return data
+}
+
+func TestPieceLenFor(t *testing.T) {
+	assert.Equal(t, 16<<10, PieceLenFor(0))
+	assert.Equal(t, 16<<10, PieceLenFor(1500*(16<<10)))
+	assert.Equal(t, 32<<10, PieceLenFor(1500*(16<<10)+(16<<10)))
+	assert.Equal(t, 1<<20, PieceLenFor(1<<30))
+	assert.Equal(t, 16<<20, PieceLenFor(1<<50))
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	data := writeTestFile(t, path, 100000)
+
+	var last int
+	tf, err := Create(CreateOptions{
+		Path:         path,
+		Trackers:     [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}},
+		WebSeeds:     []string{"http://seed/data.bin"},
+		Comment:      "test",
+		CreationDate: time.Unix(1000, 0),
+		Private:      true,
+		Source:       "SRC",
+		PieceLen:     16 << 10,
+		Workers:      3,
+		Progress: func(done, total int) {
+			assert.True(t, done > last)
+			assert.Equal(t, len(data), total)
+			last = done
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), last)
+	assert.Equal(t, "data.bin", tf.Name)
+	assert.Equal(t, "http://a/announce", tf.Announce)
+	assert.Equal(t, 7, len(tf.PiecesSHA))
+	assert.Equal(t, sha1.Sum(data[:16<<10]), tf.PiecesSHA[0])
+	assert.Equal(t, sha1.Sum(data[6*(16<<10):]), tf.PiecesSHA[6])
+
+	var buf bytes.Buffer
+	assert.Nil(t, tf.Write(&buf))
+	res, err := ParseTorrentFile(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, tf.InfoSHA, res.InfoSHA)
+	assert.Equal(t, tf.AnnounceList, res.AnnounceList)
+	assert.Equal(t, tf.URLList, res.URLList)
+	assert.Equal(t, "test", res.Comment)
+	assert.Equal(t, defaultCreatedBy, res.CreatedBy)
+	assert.Equal(t, time.Unix(1000, 0), res.CreationDate)
+	assert.True(t, res.Private)
+	assert.Equal(t, "SRC", res.Source)
+	assert.Equal(t, len(data), res.FileLen)
+	assert.Equal(t, tf.PiecesSHA, res.PiecesSHA)
+	assert.False(t, res.IsMultiFile())
+}
+
+func TestCreateDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	a := writeTestFile(t, filepath.Join(root, "b", "a.bin"), 20000)
+	b := writeTestFile(t, filepath.Join(root, "c.bin"), 30000)
+	writeTestFile(t, filepath.Join(root, "empty"), 0)
+
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 16 << 10})
+	assert.Nil(t, err)
+	assert.Equal(t, "share", tf.Name)
+	assert.Equal(t, []FileInfo{
+		{Length: 20000, Path: []string{"b", "a.bin"}},
+		{Length: 30000, Path: []string{"c.bin"}},
+		{Length: 0, Path: []string{"empty"}},
+	}, tf.Files)
+	assert.Equal(t, 50000, tf.FileLen)
+
+	// pieces span file boundaries
+	all := append(append([]byte{}, a...), b...)
+	assert.Equal(t, 4, len(tf.PiecesSHA))
+	assert.Equal(t, sha1.Sum(all[16<<10:32<<10]), tf.PiecesSHA[1])
+	assert.Equal(t, sha1.Sum(all[48<<10:]), tf.PiecesSHA[3])
+
+	var buf bytes.Buffer
+	assert.Nil(t, tf.Write(&buf))
+	res, err := ParseTorrentFile(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, tf.InfoSHA, res.InfoSHA)
+	assert.Equal(t, tf.Files, res.Files)
+	assert.Equal(t, tf.PiecesSHA, res.PiecesSHA)
+}
+
+func TestCreateEmpty(t *testing.T) {
+	_, err := Create(CreateOptions{Path: t.TempDir()})
+	assert.NotNil(t, err)
+	_, err = Create(CreateOptions{Path: filepath.Join(t.TempDir(), "missing")})
+	assert.NotNil(t, err)
+}
+
+func TestCreatePieceLen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.bin")
+	assert.Nil(t, os.WriteFile(path, make([]byte, 100), 0o644))
+	for _, n := range []int{-1, 1, 8 << 10, 48 << 10} {
+		_, err := Create(CreateOptions{Path: path, PieceLen: n})
+		assert.NotNil(t, err, n)
+	}
+	tf, err := Create(CreateOptions{Path: path, PieceLen: 32 << 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 32<<10, tf.PieceLen)
+}
@@ -0,0 +1,587 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/tracker"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	defaultMaxPeers         = 50
+	defaultProgressInterval = time.Second
+)
+
+// Progress is a snapshot of a running download
+type Progress struct {
+	// Have of Pieces are verified
+	Have   int
+	Pieces int
+	// Uploaded and Downloaded count payload bytes, Left the bytes of
+	// the wanted pieces still missing
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Peers      int
+	Endgame    bool
+	Seeding    bool
+}
+
+// Downloader fetches a torrent from its swarm into dir. Data already
+// present is verified first, so an interrupted download resumes.
+type Downloader struct {
+	// PeerID defaults to peer.DefaultPeerID
+	PeerID peer.PeerID
+	// ListenAddr accepts incoming peers when set, e.g. ":6881"
+	ListenAddr string
+	// Port is announced to the trackers, it defaults to the port of
+	// ListenAddr
+	Port int
+	// Peers are dialed in addition to the peers from the trackers
+	Peers    []peer.Addr
+	MaxPeers int
+	// QueueDepth is the request pipeline of every connection
+	QueueDepth int
+	// Extensions are offered to peers of the extension protocol,
+	// register them before Run
+	Extensions *peer.Extensions
+	// UploadSlots are unchoked by rate every peer.DefaultChokeInterval,
+	// OptimisticSlots at random
+	UploadSlots     int
+	OptimisticSlots int
+	// SeedRatio and SeedTime keep serving the torrent once it is
+	// complete until the upload reaches SeedRatio times its size or
+	// SeedTime has passed. With both zero Run returns when complete.
+	SeedRatio float64
+	SeedTime  time.Duration
+	// Progress is called every ProgressInterval and when done
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+
+	tf     *TorrentFile
+	dir    string
+	st     *storage
+	picker *Picker
+	choker *peer.Choker
+
+	mu         sync.Mutex
+	uploaded   int
+	downloaded int
+	left       int
+	addr       net.Addr
+
+	// the fields below belong to the event loop
+	// conns maps a connection to the pieces counted for it in the
+	// picker, built from its events only
+	conns     map[*peer.Conn]utils.Bitfield
+	addrs     map[string]bool
+	buffers   map[int][]byte
+	seeding   bool
+	seedUntil time.Time
+}
+
+func NewDownloader(tf *TorrentFile, dir string) *Downloader {
+	return &Downloader{
+		MaxPeers:         defaultMaxPeers,
+		QueueDepth:       peer.DefaultQueueDepth,
+		Extensions:       peer.NewExtensions(),
+		UploadSlots:      peer.DefaultUploadSlots,
+		OptimisticSlots:  peer.DefaultOptimisticSlots,
+		ProgressInterval: defaultProgressInterval,
+		tf:               tf,
+		dir:              dir,
+	}
+}
+
+// Download fetches tf into dir with the default settings
+func Download(ctx context.Context, tf *TorrentFile, dir string) error {
+	return NewDownloader(tf, dir).Run(ctx)
+}
+
+// Stats returns the payload bytes sent and received and the bytes
+// left to download
+func (d *Downloader) Stats() (uploaded, downloaded, left int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.uploaded, d.downloaded, d.left
+}
+
+// Addr is the address peers connect to, nil until Run listens
+func (d *Downloader) Addr() net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addr
+}
+
+type dialResult struct {
+	addr string
+	conn *peer.Conn
+}
+
+// Run downloads until every wanted piece is verified and written,
+// then seeds if SeedRatio or SeedTime is set. It returns early when
+// ctx is done.
+func (d *Downloader) Run(ctx context.Context) error {
+	tf := d.tf
+	if !tf.HasV1() || tf.PieceLen <= 0 {
+		return fmt.Errorf("download: torrent has no v1 pieces")
+	}
+	if d.PeerID.IsZero() {
+		d.PeerID = peer.DefaultPeerID()
+	}
+	d.st = newStorage(tf, d.dir)
+	d.picker = NewPicker(tf)
+	d.choker = peer.NewChoker()
+	d.choker.Slots, d.choker.OptimisticSlots = d.UploadSlots, d.OptimisticSlots
+	d.conns = make(map[*peer.Conn]utils.Bitfield)
+	d.addrs = make(map[string]bool)
+	d.buffers = make(map[int][]byte)
+
+	res, err := Verify(tf, d.dir)
+	if err != nil {
+		return err
+	}
+	d.picker.SetHave(res.Pieces)
+	d.setLeft()
+	if d.picker.Complete() {
+		if err := d.st.materialize(); err != nil {
+			return err
+		}
+		if d.SeedRatio <= 0 && d.SeedTime <= 0 {
+			d.report()
+			return nil
+		}
+		d.startSeeding()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// dialed delivers outgoing and incoming connections, addrs holds
+	// the outgoing ones being dialed or connected
+	dialed := make(chan dialResult)
+	if d.ListenAddr != "" {
+		ln, err := net.Listen("tcp", d.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("download: %w", err)
+		}
+		d.mu.Lock()
+		d.addr = ln.Addr()
+		d.mu.Unlock()
+		if d.Port == 0 {
+			d.Port = ln.Addr().(*net.TCPAddr).Port
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			d.accept(ctx, ln, dialed)
+		}()
+	}
+	if d.Extensions.Port == 0 {
+		d.Extensions.Port = d.Port
+	}
+
+	var found <-chan peer.Addr
+	var manager *tracker.Manager
+	if tiers := tf.Trackers(); len(tiers) > 0 {
+		manager = tracker.NewManager(tiers, tracker.AnnounceRequest{
+			InfoHash: tf.InfoSHA,
+			PeerID:   d.PeerID,
+			Port:     d.Port,
+		})
+		manager.Progress = d.Stats
+		found = manager.Peers()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			manager.Run(ctx)
+		}()
+	}
+
+	events := make(chan peer.Event)
+	dial := func(addr peer.Addr) {
+		key := addr.String()
+		if d.addrs[key] || len(d.addrs) >= d.MaxPeers {
+			return
+		}
+		d.addrs[key] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := peer.Dial(ctx, addr, d.handshake(), tf.NumPieces())
+			if err != nil {
+				c = nil
+			}
+			select {
+			case dialed <- dialResult{addr: key, conn: c}:
+			case <-ctx.Done():
+				if c != nil {
+					c.Close()
+				}
+			}
+		}()
+	}
+	if !d.seeding {
+		for _, addr := range d.Peers {
+			dial(addr)
+		}
+	}
+
+	ticker := time.NewTicker(d.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			d.rechoke()
+			d.report()
+			if d.seeding && d.seedDone() {
+				return nil
+			}
+			if manager != nil && !d.seeding && len(d.conns) == 0 {
+				manager.Reannounce()
+			}
+		case addr, ok := <-found:
+			if !ok {
+				found = nil
+				continue
+			}
+			if !d.seeding {
+				dial(addr)
+			}
+		case r := <-dialed:
+			if r.conn == nil {
+				delete(d.addrs, r.addr)
+				continue
+			}
+			if r.addr == "" && len(d.conns) >= d.MaxPeers {
+				r.conn.Close()
+				continue
+			}
+			if !d.start(ctx, r.conn, events, &wg) {
+				delete(d.addrs, r.addr)
+			}
+		case ev := <-events:
+			if err := d.handle(ev); err != nil {
+				return err
+			}
+			if ev.Type == peer.EventClosed {
+				delete(d.addrs, ev.Conn.RemoteAddr().String())
+			}
+			if !d.seeding && d.picker.Complete() {
+				d.report()
+				if err := d.st.materialize(); err != nil {
+					return err
+				}
+				if manager != nil {
+					manager.Completed()
+				}
+				if d.SeedRatio <= 0 && d.SeedTime <= 0 {
+					return nil
+				}
+				d.startSeeding()
+				d.report()
+			}
+			if d.seeding && d.seedDone() {
+				d.report()
+				return nil
+			}
+		}
+	}
+}
+
+// accept hands incoming connections for our info hash to the loop
+func (d *Downloader) accept(ctx context.Context, ln net.Listener, dialed chan<- dialResult) {
+	find := func(hash [utils.SHALEN]byte) (*peer.Handshake, int, bool) {
+		return d.handshake(), d.tf.NumPieces(), hash == d.tf.InfoSHA
+	}
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c, err := peer.Accept(nc, find)
+			if err != nil {
+				return
+			}
+			select {
+			case dialed <- dialResult{conn: c}:
+			case <-ctx.Done():
+				c.Close()
+			}
+		}()
+	}
+}
+
+func (d *Downloader) handshake() *peer.Handshake {
+	h := &peer.Handshake{InfoHash: d.tf.InfoSHA, PeerID: d.PeerID}
+	h.Reserved.Set(peer.ReservedFast)
+	h.Reserved.Set(peer.ReservedExtended)
+	return h
+}
+
+// startSeeding closes the connections to other seeders, they have
+// nothing left to exchange with us
+func (d *Downloader) startSeeding() {
+	d.seeding = true
+	d.seedUntil = time.Now().Add(d.SeedTime)
+	for c := range d.conns {
+		d.dropSeeder(c)
+	}
+}
+
+func (d *Downloader) seedDone() bool {
+	uploaded, _, _ := d.Stats()
+	if d.SeedRatio > 0 && float64(uploaded) >= d.SeedRatio*float64(d.tf.FileLen) {
+		return true
+	}
+	return d.SeedTime > 0 && !time.Now().Before(d.seedUntil)
+}
+
+func (d *Downloader) dropSeeder(c *peer.Conn) {
+	if d.seeding && c.Bitfield().Count() == d.tf.NumPieces() {
+		c.Close()
+	}
+}
+
+// start sends our pieces to a new connection and runs it, false if
+// the connection failed
+func (d *Downloader) start(ctx context.Context, c *peer.Conn, events chan<- peer.Event, wg *sync.WaitGroup) bool {
+	c.QueueDepth = d.QueueDepth
+	c.Extensions = d.Extensions
+	if err := c.SendBitfield(d.picker.Have()); err != nil {
+		c.Close()
+		return false
+	}
+	if err := c.SendExtHandshake(); err != nil {
+		c.Close()
+		return false
+	}
+	d.allowFast(c)
+	d.conns[c] = utils.NewBitfield(d.tf.NumPieces())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Run(ctx, events)
+	}()
+	return true
+}
+
+// allowFast grants a fast peer the pieces of its allowed fast set we
+// have, so a newcomer gets data before it is unchoked
+func (d *Downloader) allowFast(c *peer.Conn) {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !c.Fast() || !ok {
+		return
+	}
+	for _, i := range peer.AllowedFastSet(peer.DefaultAllowedFast, d.tf.NumPieces(), d.tf.InfoSHA, addr.IP) {
+		if d.picker.HasPiece(i) {
+			c.AllowFast(i)
+		}
+	}
+}
+
+// handle applies a connection event, errors are local failures that
+// end the download
+func (d *Downloader) handle(ev peer.Event) error {
+	c := ev.Conn
+	switch ev.Type {
+	case peer.EventBitfield:
+		// the live bitfield may hold haves whose events are pending
+		copy(d.conns[c], ev.Bitfield)
+		d.picker.AddPeer(ev.Bitfield)
+		d.updateInterest(c)
+		d.dropSeeder(c)
+	case peer.EventHave:
+		if bf := d.conns[c]; !bf.Has(ev.Index) {
+			bf.Set(ev.Index)
+			d.picker.PeerHave(ev.Index)
+		}
+		d.updateInterest(c)
+		d.dropSeeder(c)
+	case peer.EventInterested, peer.EventNotInterested:
+		d.rechoke()
+		return nil
+	case peer.EventRequest:
+		return d.serve(c, ev.Block)
+	case peer.EventChoke, peer.EventReject, peer.EventTimeout:
+		d.picker.Abort(c, ev.Blocks)
+		d.requestAll()
+		return nil
+	case peer.EventBlock:
+		if err := d.received(c, ev.Block, ev.Data); err != nil {
+			return err
+		}
+		// only c freed a slot, the others are refilled on their own
+		// events
+		d.request(c)
+		return nil
+	case peer.EventClosed:
+		d.picker.Abort(c, ev.Blocks)
+		d.picker.RemovePeer(d.conns[c])
+		delete(d.conns, c)
+		d.rechoke()
+		d.requestAll()
+		return nil
+	}
+	d.request(c)
+	return nil
+}
+
+// rechoke lets the choker pick the peers we upload to
+func (d *Downloader) rechoke() {
+	cands := make([]peer.Candidate, 0, len(d.conns))
+	for c := range d.conns {
+		cands = append(cands, peer.Candidate{
+			Peer:       c,
+			Interested: c.PeerInterested(),
+			Snubbed:    c.Snubbed(),
+			Downloaded: c.Downloaded(),
+			Uploaded:   c.Uploaded(),
+		})
+	}
+	unchoke := make(map[any]bool)
+	for _, p := range d.choker.Rechoke(time.Now(), cands, d.seeding) {
+		unchoke[p] = true
+	}
+	for c := range d.conns {
+		if unchoke[c] {
+			c.Unchoke()
+		} else {
+			c.Choke()
+		}
+	}
+}
+
+// serve answers a request from our verified pieces, requests for
+// pieces we lack are rejected
+func (d *Downloader) serve(c *peer.Conn, b peer.Block) error {
+	if !d.picker.HasPiece(b.Index) || b.Begin+b.Length > d.tf.PieceSize(b.Index) {
+		c.Reject(b)
+		return nil
+	}
+	data := make([]byte, b.Length)
+	if err := d.st.readBlock(b.Index, b.Begin, data); err != nil {
+		return fmt.Errorf("download: read piece %v: %w", b.Index, err)
+	}
+	before := c.Uploaded()
+	c.SendPiece(b, data)
+	d.mu.Lock()
+	d.uploaded += c.Uploaded() - before
+	d.mu.Unlock()
+	return nil
+}
+
+// received stores a block and checks its piece once complete
+func (d *Downloader) received(c *peer.Conn, blk peer.Block, data []byte) error {
+	cancel, complete, ok := d.picker.Received(c, blk)
+	if !ok {
+		// a late duplicate, the block is buffered or verified already
+		return nil
+	}
+	for _, o := range cancel {
+		o.(*peer.Conn).Cancel(blk)
+		d.request(o.(*peer.Conn))
+	}
+	buf, ok := d.buffers[blk.Index]
+	if !ok {
+		buf = make([]byte, d.tf.PieceSize(blk.Index))
+		d.buffers[blk.Index] = buf
+	}
+	copy(buf[blk.Begin:], data)
+	d.mu.Lock()
+	d.downloaded += len(data)
+	d.mu.Unlock()
+	if !complete {
+		return nil
+	}
+
+	delete(d.buffers, blk.Index)
+	if sha1.Sum(buf) != d.tf.PiecesSHA[blk.Index] {
+		// the blocks of the piece can be picked by any peer again
+		d.picker.Failed(blk.Index)
+		d.requestAll()
+		return nil
+	}
+	if err := d.st.writePiece(blk.Index, buf); err != nil {
+		return fmt.Errorf("download: write piece %v: %w", blk.Index, err)
+	}
+	d.picker.Done(blk.Index)
+	d.setLeft()
+	for o := range d.conns {
+		o.Have(blk.Index)
+		d.updateInterest(o)
+	}
+	return nil
+}
+
+func (d *Downloader) updateInterest(c *peer.Conn) {
+	c.SetInterested(d.picker.Interesting(c.Bitfield()))
+}
+
+// request fills the pipeline of c, while choked with its allowed
+// fast pieces only
+func (d *Downloader) request(c *peer.Conn) {
+	free := c.Free()
+	if free == 0 || c.Snubbed() {
+		return
+	}
+	bf := c.Bitfield()
+	if c.PeerChoking() {
+		allowed := c.AllowedFast()
+		for i := range bf {
+			bf[i] &= allowed[i]
+		}
+	}
+	for _, blk := range d.picker.Pick(c, bf, free) {
+		if err := c.Request(blk); err != nil {
+			d.picker.Abort(c, []peer.Block{blk})
+		}
+	}
+}
+
+// requestAll refills every connection after blocks were released,
+// connections with a full pipeline cost no pick
+func (d *Downloader) requestAll() {
+	for c := range d.conns {
+		d.request(c)
+	}
+}
+
+func (d *Downloader) setLeft() {
+	left := d.picker.Left()
+	d.mu.Lock()
+	d.left = left
+	d.mu.Unlock()
+}
+
+func (d *Downloader) report() {
+	if d.Progress == nil {
+		return
+	}
+	uploaded, downloaded, left := d.Stats()
+	d.Progress(Progress{
+		Have:       d.picker.Have().Count(),
+		Pieces:     d.tf.NumPieces(),
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Peers:      len(d.conns),
+		Endgame:    d.picker.Endgame(),
+		Seeding:    d.seeding,
+	})
+}
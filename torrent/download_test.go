@@ -0,0 +1,379 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/tracker"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// swarmTorrent shares three files of random data below a new dir
+func swarmTorrent(t *testing.T, trackers [][]string) (*TorrentFile, string) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "share")
+	rnd := rand.New(rand.NewSource(1))
+	for name, size := range map[string]int{"a.bin": 100000, "b/c.bin": 70000, "d.bin": 0} {
+		data := make([]byte, size)
+		rnd.Read(data)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755))
+		assert.Nil(t, os.WriteFile(filepath.Join(root, name), data, 0o644))
+	}
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 32 << 10, Trackers: trackers})
+	assert.Nil(t, err)
+	return tf, dir
+}
+
+// testSeeder serves the pieces of bf from dir, corrupt pieces are
+// sent with a flipped byte
+func testSeeder(t *testing.T, tf *TorrentFile, dir string, bf utils.Bitfield, corrupt int) peer.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+	})
+	id, _ := peer.NewPeerID()
+	local := &peer.Handshake{InfoHash: tf.InfoSHA, PeerID: id}
+	st := newStorage(tf, dir)
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, err := peer.Accept(nc, func([utils.SHALEN]byte) (*peer.Handshake, int, bool) {
+					return local, tf.NumPieces(), true
+				})
+				if err != nil {
+					return
+				}
+				events := make(chan peer.Event)
+				go c.Run(ctx, events)
+				c.SendBitfield(bf)
+				for ev := range events {
+					switch ev.Type {
+					case peer.EventInterested:
+						c.Unchoke()
+					case peer.EventRequest:
+						b := ev.Block
+						data := make([]byte, tf.PieceSize(b.Index))
+						if !bf.Has(b.Index) || st.readPiece(b.Index, data) != nil {
+							continue
+						}
+						block := data[b.Begin : b.Begin+b.Length]
+						if b.Index == corrupt {
+							block[0]++
+						}
+						c.SendPiece(b, block)
+					case peer.EventClosed:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return peer.Addr{IP: net.ParseIP("127.0.0.1"), Port: ln.Addr().(*net.TCPAddr).Port}
+}
+
+func allPieces(tf *TorrentFile) utils.Bitfield {
+	bf := utils.NewBitfield(tf.NumPieces())
+	for i := 0; i < tf.NumPieces(); i++ {
+		bf.Set(i)
+	}
+	return bf
+}
+
+func assertSameFiles(t *testing.T, tf *TorrentFile, want, got string) {
+	for _, f := range tf.Files {
+		rel := filepath.Join(append([]string{tf.Name}, f.Path...)...)
+		a, err := os.ReadFile(filepath.Join(want, rel))
+		assert.Nil(t, err)
+		b, err := os.ReadFile(filepath.Join(got, rel))
+		assert.Nil(t, err)
+		assert.Equal(t, a, b, rel)
+	}
+}
+
+func TestDownloadSwarm(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewServer())
+	defer srv.Close()
+	announce := srv.URL + "/announce"
+	tf, seedDir := swarmTorrent(t, [][]string{{announce}})
+	all := allPieces(tf)
+
+	// seeders are found through the tracker, one of them sends bad data
+	for i, corrupt := range []int{-1, -1, 0} {
+		addr := testSeeder(t, tf, seedDir, all, corrupt)
+		_, err := tracker.NewHTTPClient(announce).Announce(context.Background(), &tracker.AnnounceRequest{
+			InfoHash: tf.InfoSHA, PeerID: testSeederID(i), Port: addr.Port, Event: tracker.EventStarted,
+		})
+		assert.Nil(t, err)
+	}
+
+	dir := t.TempDir()
+	d := NewDownloader(tf, dir)
+	d.PeerID, _ = peer.NewPeerID()
+	d.QueueDepth = 4
+	d.ProgressInterval = 10 * time.Millisecond
+	var last Progress
+	d.Progress = func(p Progress) { last = p }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	assert.Nil(t, d.Run(ctx))
+
+	assertSameFiles(t, tf, seedDir, dir)
+	assert.Equal(t, Progress{Have: 6, Pieces: 6, Downloaded: last.Downloaded, Peers: last.Peers}, last)
+	assert.GreaterOrEqual(t, last.Downloaded, tf.FileLen)
+	res, err := Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, res.Valid)
+}
+
+func testSeederID(i int) peer.PeerID {
+	var id peer.PeerID
+	copy(id[:], "-TS0001-seeder")
+	id[19] = byte('0' + i)
+	return id
+}
+
+func TestDownloadResume(t *testing.T) {
+	tf, seedDir := swarmTorrent(t, nil)
+	dir := t.TempDir()
+	// the first two pieces are on disk, the seeder lacks them
+	st := newStorage(tf, dir)
+	data := make([]byte, tf.PieceLen)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, newStorage(tf, seedDir).readPiece(i, data))
+		assert.Nil(t, st.writePiece(i, data))
+	}
+	partial := allPieces(tf)
+	partial.Clear(0)
+	partial.Clear(1)
+
+	d := NewDownloader(tf, dir)
+	d.PeerID, _ = peer.NewPeerID()
+	d.Peers = []peer.Addr{testSeeder(t, tf, seedDir, partial, -1)}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	assert.Nil(t, d.Run(ctx))
+	assertSameFiles(t, tf, seedDir, dir)
+	_, downloaded, left := d.Stats()
+	assert.Equal(t, tf.FileLen-2*tf.PieceLen, downloaded)
+	assert.Equal(t, 0, left)
+
+	// nothing is left to fetch
+	assert.Nil(t, Download(context.Background(), tf, dir))
+}
+
+func TestDownloadCancel(t *testing.T) {
+	tf, _ := swarmTorrent(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, Download(ctx, tf, t.TempDir()))
+
+	tf.MetaVersion, tf.PiecesSHA = 2, nil
+	assert.NotNil(t, Download(context.Background(), tf, t.TempDir()))
+}
+
+func waitAddr(t *testing.T, d *Downloader) peer.Addr {
+	for i := 0; i < 500; i++ {
+		if addr := d.Addr(); addr != nil {
+			return peer.Addr{IP: net.ParseIP("127.0.0.1"), Port: addr.(*net.TCPAddr).Port}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("not listening")
+	return peer.Addr{}
+}
+
+func seedPeer(tf *TorrentFile, dir string) *Downloader {
+	d := NewDownloader(tf, dir)
+	d.PeerID, _ = peer.NewPeerID()
+	d.ListenAddr = "127.0.0.1:0"
+	d.ProgressInterval = 10 * time.Millisecond
+	return d
+}
+
+// runSeeder starts d and returns a func stopping it
+func runSeeder(ctx context.Context, d *Downloader) (stop func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() { errc <- d.Run(ctx) }()
+	return func() error {
+		cancel()
+		return <-errc
+	}
+}
+
+func TestSeedChain(t *testing.T) {
+	tf, seedDir := swarmTorrent(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	seeder := seedPeer(tf, seedDir)
+	seeder.SeedTime = time.Hour
+	stopSeeder := runSeeder(ctx, seeder)
+
+	// the middle peer only learns of pieces from the seeder and the
+	// last one only from the middle one, through have messages
+	middle := seedPeer(tf, t.TempDir())
+	middle.Peers = []peer.Addr{waitAddr(t, seeder)}
+	middle.SeedTime = time.Hour
+	var progress Progress
+	var mu sync.Mutex
+	middle.Progress = func(p Progress) {
+		mu.Lock()
+		progress = p
+		mu.Unlock()
+	}
+	stopMiddle := runSeeder(ctx, middle)
+
+	last := seedPeer(tf, t.TempDir())
+	last.Peers = []peer.Addr{waitAddr(t, middle)}
+	assert.Nil(t, last.Run(ctx))
+	assertSameFiles(t, tf, seedDir, last.dir)
+
+	assert.Equal(t, context.Canceled, stopMiddle())
+	uploaded, downloaded, left := middle.Stats()
+	assert.Equal(t, tf.FileLen, uploaded)
+	assert.Equal(t, tf.FileLen, downloaded)
+	assert.Equal(t, 0, left)
+	mu.Lock()
+	assert.True(t, progress.Seeding)
+	mu.Unlock()
+
+	assert.Equal(t, context.Canceled, stopSeeder())
+	uploaded, downloaded, _ = seeder.Stats()
+	assert.Equal(t, tf.FileLen, uploaded)
+	assert.Equal(t, 0, downloaded)
+}
+
+func TestSeedRatio(t *testing.T) {
+	tf, seedDir := swarmTorrent(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// the seeder leaves after uploading half of the torrent
+	seeder := seedPeer(tf, seedDir)
+	seeder.SeedRatio = 0.5
+	seedErr := make(chan error, 1)
+	go func() { seedErr <- seeder.Run(ctx) }()
+
+	leecher := seedPeer(tf, t.TempDir())
+	leecher.Peers = []peer.Addr{waitAddr(t, seeder)}
+	stopLeecher := runSeeder(ctx, leecher)
+	assert.Nil(t, <-seedErr)
+	uploaded, _, _ := seeder.Stats()
+	assert.GreaterOrEqual(t, uploaded, tf.FileLen/2)
+	assert.Equal(t, context.Canceled, stopLeecher())
+}
+
+func TestSeedTime(t *testing.T) {
+	tf, seedDir := swarmTorrent(t, nil)
+	d := NewDownloader(tf, seedDir)
+	d.SeedTime = 30 * time.Millisecond
+	d.ProgressInterval = 5 * time.Millisecond
+	start := time.Now()
+	assert.Nil(t, d.Run(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), d.SeedTime)
+}
+
+func TestDownloadAllowedFast(t *testing.T) {
+	tf, seedDir := swarmTorrent(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// the seeder never unchokes, the allowed fast set of 10 covers
+	// all 6 pieces
+	seeder := seedPeer(tf, seedDir)
+	seeder.SeedTime = time.Hour
+	seeder.UploadSlots, seeder.OptimisticSlots = 0, 0
+	stopSeeder := runSeeder(ctx, seeder)
+
+	leecher := seedPeer(tf, t.TempDir())
+	leecher.Peers = []peer.Addr{waitAddr(t, seeder)}
+	assert.Nil(t, leecher.Run(ctx))
+	assertSameFiles(t, tf, seedDir, leecher.dir)
+	assert.Equal(t, context.Canceled, stopSeeder())
+}
+
+// testDownloader sets up the state of Run without connecting, events
+// are fed to handle directly
+func testDownloader(t *testing.T, tf *TorrentFile) *Downloader {
+	d := NewDownloader(tf, t.TempDir())
+	d.st = newStorage(tf, d.dir)
+	d.picker = testPicker(tf)
+	d.choker = peer.NewChoker()
+	d.conns = make(map[*peer.Conn]utils.Bitfield)
+	d.buffers = make(map[int][]byte)
+	return d
+}
+
+func TestDownloadAvailability(t *testing.T) {
+	tf := layoutTorrent(BlockLen, 4*BlockLen)
+	d := testDownloader(t, tf)
+	c := &peer.Conn{}
+	d.conns[c] = utils.NewBitfield(4)
+
+	// the event carries the bitfield as received, the haves that
+	// followed are counted from their own events
+	assert.Nil(t, d.handle(peer.Event{Type: peer.EventBitfield, Conn: c, Bitfield: bitfield(4, 0)}))
+	assert.Nil(t, d.handle(peer.Event{Type: peer.EventHave, Conn: c, Index: 1}))
+	assert.Nil(t, d.handle(peer.Event{Type: peer.EventHave, Conn: c, Index: 1}))
+	assert.Nil(t, d.handle(peer.Event{Type: peer.EventHave, Conn: c, Index: 0}))
+	assert.Equal(t, []int{1, 1, 0, 0}, availability(d.picker))
+
+	// only what was counted is removed
+	assert.Nil(t, d.handle(peer.Event{Type: peer.EventClosed, Conn: c}))
+	assert.Equal(t, []int{0, 0, 0, 0}, availability(d.picker))
+	assert.Empty(t, d.conns)
+}
+
+func availability(p *Picker) []int {
+	res := make([]int, len(p.availability))
+	for i := range res {
+		res[i] = p.Availability(i)
+	}
+	return res
+}
+
+func TestDownloadDuplicateBlock(t *testing.T) {
+	// one piece of two blocks, requested from two peers in endgame
+	tf := layoutTorrent(2*BlockLen, 2*BlockLen)
+	data := make([]byte, tf.FileLen)
+	rand.Read(data)
+	tf.PiecesSHA = [][20]byte{sha1.Sum(data)}
+	d := testDownloader(t, tf)
+	all := bitfield(1, 0)
+	a, b := &peer.Conn{}, &peer.Conn{}
+	d.picker.AddPeer(all)
+	d.picker.AddPeer(all)
+	blocks := d.picker.Pick(a, all, 2)
+	assert.Equal(t, 2, len(blocks))
+	assert.Equal(t, 2, len(d.picker.Pick(b, all, 2)))
+
+	for _, blk := range blocks {
+		assert.Nil(t, d.received(a, blk, data[blk.Begin:blk.Begin+blk.Length]))
+	}
+	assert.True(t, d.picker.Complete())
+	// the late copy of the last block neither buffers nor counts
+	last := blocks[1]
+	assert.Nil(t, d.received(b, last, data[last.Begin:last.Begin+last.Length]))
+	assert.Empty(t, d.buffers)
+	_, downloaded, _ := d.Stats()
+	assert.Equal(t, tf.FileLen, downloaded)
+}
@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"tutorial/bt_demo/benode"
+)
+
+var ErrInfoChanged = errors.New("edit: the info dict must not change")
+
+// editableKeys are the top-level keys Edit rewrites
+var editableKeys = []string{
+	"announce", "announce-list", "comment", "created by", "creation date",
+	"encoding", "httpseeds", "nodes", "url-list",
+}
+
+// Edit loads the torrent from rd, lets fn change it and writes the
+// result to wd. Only the keys fn changed are rewritten, everything
+// else, the info dict and unknown keys included, is copied verbatim.
+// Edit fails with ErrInfoChanged if fn changed any info field.
+func Edit(rd io.Reader, wd io.Writer, fn func(tf *TorrentFile) error) error {
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	node, err := benode.Parse(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return err
+	}
+	root, ok := node.(*benode.DictNode)
+	if !ok {
+		return fmt.Errorf("edit: torrent is not a dict")
+	}
+	orig, err := ParseTorrentFileUnchecked(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tf, err := ParseTorrentFileUnchecked(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tf); err != nil {
+		return err
+	}
+	if tf.InfoSHA != orig.InfoSHA || tf.InfoSHA256 != orig.InfoSHA256 {
+		return ErrInfoChanged
+	}
+	origInfo, err := orig.encodeInfo()
+	if err != nil {
+		return err
+	}
+	newInfo, err := tf.encodeInfo()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(origInfo, newInfo) {
+		return ErrInfoChanged
+	}
+
+	origTop, err := marshalDict(orig.rawFile(nil))
+	if err != nil {
+		return err
+	}
+	newTop, err := marshalDict(tf.rawFile(nil))
+	if err != nil {
+		return err
+	}
+	for _, key := range editableKeys {
+		changed, err := nodeChanged(origTop.Get(key), newTop.Get(key))
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		if val := newTop.Get(key); val != nil {
+			root.Set(key, val)
+		} else {
+			root.Delete(key)
+		}
+	}
+	return root.Write(wd)
+}
+
+func marshalDict(src any) (*benode.DictNode, error) {
+	node, err := benode.Marshal(src)
+	if err != nil {
+		return nil, err
+	}
+	return node.(*benode.DictNode), nil
+}
+
+func nodeChanged(a, b benode.Benode) (bool, error) {
+	if a == nil || b == nil {
+		return a != b, nil
+	}
+	var bufA, bufB bytes.Buffer
+	if err := a.Write(&bufA); err != nil {
+		return false, err
+	}
+	if err := b.Write(&bufB); err != nil {
+		return false, err
+	}
+	return !bytes.Equal(bufA.Bytes(), bufB.Bytes()), nil
+}
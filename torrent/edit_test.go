@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditNoop(t *testing.T) {
+	data, err := os.ReadFile(FileName)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = Edit(bytes.NewReader(data), &out, func(tf *TorrentFile) error { return nil })
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+}
+
+func TestEdit(t *testing.T) {
+	data, err := os.ReadFile(FileName)
+	assert.Nil(t, err)
+	orig, err := ParseTorrentFile(bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = Edit(bytes.NewReader(data), &out, func(tf *TorrentFile) error {
+		tf.SetTrackers([][]string{{"http://a/announce"}, {"udp://b:80"}})
+		tf.URLList = append(tf.URLList, "http://seed/")
+		tf.Comment = ""
+		return nil
+	})
+	assert.Nil(t, err)
+
+	res, err := ParseTorrentFile(bytes.NewReader(out.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, orig.InfoSHA, res.InfoSHA)
+	assert.Equal(t, [][]string{{"http://a/announce"}, {"udp://b:80"}}, res.Trackers())
+	assert.Equal(t, []string{"http://seed/"}, res.URLList)
+	assert.Equal(t, "", res.Comment)
+	assert.Equal(t, orig.HTTPSeeds, res.HTTPSeeds)
+	assert.Equal(t, orig.CreationDate, res.CreationDate)
+	assert.True(t, bytes.Contains(out.Bytes(), orig.info))
+	assert.False(t, bytes.Contains(out.Bytes(), []byte("7:comment")))
+}
+
+func TestEditKeepsUnknownKeys(t *testing.T) {
+	input := `d8:announce4:tr-17:x-extrali1ei2ee4:infod6:lengthi8e4:name1:a12:piece lengthi16384e` +
+		`6:pieces20:aaaaaaaaaaaaaaaaaaaa5:x-keyi1eee`
+	var out bytes.Buffer
+	err := Edit(strings.NewReader(input), &out, func(tf *TorrentFile) error {
+		tf.Comment = "hi"
+		return nil
+	})
+	assert.Nil(t, err)
+	// comment is inserted in key order, the rest is untouched
+	assert.Equal(t, strings.Replace(input, "7:x-extra", "7:comment2:hi7:x-extra", 1), out.String())
+}
+
+func TestEditRejectsInfo(t *testing.T) {
+	data, err := os.ReadFile(FileName)
+	assert.Nil(t, err)
+
+	for _, fn := range []func(tf *TorrentFile){
+		func(tf *TorrentFile) { tf.Name = "other" },
+		func(tf *TorrentFile) { tf.Private = true },
+		func(tf *TorrentFile) { tf.Source = "SRC" },
+		func(tf *TorrentFile) { tf.PiecesSHA[0][0]++ },
+		func(tf *TorrentFile) { tf.InfoSHA[0]++ },
+	} {
+		var out bytes.Buffer
+		err = Edit(bytes.NewReader(data), &out, func(tf *TorrentFile) error {
+			fn(tf)
+			return nil
+		})
+		assert.True(t, errors.Is(err, ErrInfoChanged))
+		assert.Equal(t, 0, out.Len())
+	}
+
+	fnErr := errors.New("abort")
+	err = Edit(bytes.NewReader(data), &bytes.Buffer{}, func(tf *TorrentFile) error { return fnErr })
+	assert.Equal(t, fnErr, err)
+}
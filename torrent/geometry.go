@@ -0,0 +1,107 @@
+package torrent
+
+// FileRange is the part of a file covered by a piece, File indexes
+// Files, or is 0 for a single file torrent
+type FileRange struct {
+	File   int
+	Offset int
+	Length int
+}
+
+// NumPieces returns the number of pieces of FileLen bytes
+func (tf *TorrentFile) NumPieces() int {
+	if tf.PieceLen <= 0 {
+		return 0
+	}
+	return (tf.FileLen + tf.PieceLen - 1) / tf.PieceLen
+}
+
+// PieceOffset returns the offset of piece i in the torrent stream
+func (tf *TorrentFile) PieceOffset(i int) int {
+	return i * tf.PieceLen
+}
+
+// PieceSize returns the length of piece i, only the last piece
+// may be short, 0 if i is out of range
+func (tf *TorrentFile) PieceSize(i int) int {
+	if i < 0 || i >= tf.NumPieces() {
+		return 0
+	}
+	if i == tf.NumPieces()-1 {
+		return tf.FileLen - i*tf.PieceLen
+	}
+	return tf.PieceLen
+}
+
+// NumBlocks returns the number of BlockLen requests of piece i
+func (tf *TorrentFile) NumBlocks(i int) int {
+	return (tf.PieceSize(i) + BlockLen - 1) / BlockLen
+}
+
+// BlockSize returns the length of block b of piece i, only the
+// last block of the last piece may be short
+func (tf *TorrentFile) BlockSize(i, b int) int {
+	size := tf.PieceSize(i) - b*BlockLen
+	switch {
+	case b < 0 || size <= 0:
+		return 0
+	case size > BlockLen:
+		return BlockLen
+	}
+	return size
+}
+
+// FileByteRange returns the [begin, end) bytes of a file in the
+// torrent stream
+func (tf *TorrentFile) FileByteRange(file int) (begin, end int) {
+	files := tf.fileList()
+	if file < 0 || file >= len(files) {
+		return 0, 0
+	}
+	for i := 0; i < file; i++ {
+		begin += files[i].Length
+	}
+	return begin, begin + files[file].Length
+}
+
+// FilePieceRange returns the [first, end) pieces holding bytes of
+// a file, empty for empty files
+func (tf *TorrentFile) FilePieceRange(file int) (first, end int) {
+	begin, stop := tf.FileByteRange(file)
+	if begin == stop || tf.PieceLen <= 0 {
+		return 0, 0
+	}
+	return begin / tf.PieceLen, (stop + tf.PieceLen - 1) / tf.PieceLen
+}
+
+// PieceFileRanges returns the parts of the files covered by piece i
+// in stream order, empty files are skipped
+func (tf *TorrentFile) PieceFileRanges(i int) []FileRange {
+	size := tf.PieceSize(i)
+	if size == 0 {
+		return nil
+	}
+	begin, end := tf.PieceOffset(i), tf.PieceOffset(i)+size
+
+	var res []FileRange
+	offset := 0
+	for idx, f := range tf.fileList() {
+		fileBegin, fileEnd := offset, offset+f.Length
+		offset = fileEnd
+		if fileEnd <= begin || f.Length == 0 {
+			continue
+		}
+		if fileBegin >= end {
+			break
+		}
+		from, to := begin, end
+		if fileBegin > from {
+			from = fileBegin
+		}
+		if fileEnd < to {
+			to = fileEnd
+		}
+		res = append(res, FileRange{File: idx, Offset: from - fileBegin, Length: to - from})
+	}
+	return res
+}
@@ -0,0 +1,133 @@
+package torrent
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func layoutTorrent(pieceLen int, lengths ...int) *TorrentFile {
+	tf := &TorrentFile{Name: "t", PieceLen: pieceLen}
+	for i, l := range lengths {
+		tf.Files = append(tf.Files, FileInfo{Length: l, Path: []string{string(rune('a' + i))}})
+		tf.FileLen += l
+	}
+	return tf
+}
+
+func TestPieceSize(t *testing.T) {
+	tf := &TorrentFile{Name: "t", FileLen: 40000, PieceLen: 16 << 10}
+	assert.Equal(t, 3, tf.NumPieces())
+	assert.Equal(t, 16384, tf.PieceSize(0))
+	assert.Equal(t, 16384, tf.PieceSize(1))
+	assert.Equal(t, 40000-32768, tf.PieceSize(2))
+	assert.Equal(t, 0, tf.PieceSize(3))
+	assert.Equal(t, 0, tf.PieceSize(-1))
+
+	// an exact multiple has no short piece
+	tf.FileLen = 32768
+	assert.Equal(t, 2, tf.NumPieces())
+	assert.Equal(t, 16384, tf.PieceSize(1))
+
+	tf.FileLen = 0
+	assert.Equal(t, 0, tf.NumPieces())
+	assert.Equal(t, 0, tf.PieceSize(0))
+
+	tf.PieceLen = 0
+	assert.Equal(t, 0, tf.NumPieces())
+}
+
+func TestBlockSize(t *testing.T) {
+	tf := &TorrentFile{Name: "t", FileLen: 3*65536 + 20000, PieceLen: 64 << 10}
+	assert.Equal(t, 4, tf.NumBlocks(0))
+	assert.Equal(t, BlockLen, tf.BlockSize(0, 3))
+	assert.Equal(t, 0, tf.BlockSize(0, 4))
+	assert.Equal(t, 0, tf.BlockSize(0, -1))
+	assert.Equal(t, 2, tf.NumBlocks(3))
+	assert.Equal(t, BlockLen, tf.BlockSize(3, 0))
+	assert.Equal(t, 20000-BlockLen, tf.BlockSize(3, 1))
+	assert.Equal(t, 0, tf.NumBlocks(4))
+}
+
+func TestPieceFileRanges(t *testing.T) {
+	// zero length files at the start, middle and end
+	tf := layoutTorrent(10, 0, 4, 0, 3, 0, 0, 8, 0)
+	assert.Equal(t, 2, tf.NumPieces())
+	assert.Equal(t, []FileRange{
+		{File: 1, Offset: 0, Length: 4},
+		{File: 3, Offset: 0, Length: 3},
+		{File: 6, Offset: 0, Length: 3},
+	}, tf.PieceFileRanges(0))
+	assert.Equal(t, []FileRange{{File: 6, Offset: 3, Length: 5}}, tf.PieceFileRanges(1))
+	assert.Nil(t, tf.PieceFileRanges(2))
+
+	b, e := tf.FileByteRange(2)
+	assert.Equal(t, [2]int{4, 4}, [2]int{b, e})
+	b, e = tf.FileByteRange(6)
+	assert.Equal(t, [2]int{7, 15}, [2]int{b, e})
+	b, e = tf.FileByteRange(8)
+	assert.Equal(t, [2]int{0, 0}, [2]int{b, e})
+
+	first, end := tf.FilePieceRange(6)
+	assert.Equal(t, [2]int{0, 2}, [2]int{first, end})
+	first, end = tf.FilePieceRange(7)
+	assert.Equal(t, [2]int{0, 0}, [2]int{first, end})
+
+	// a single file torrent is file 0
+	single := &TorrentFile{Name: "t", FileLen: 25, PieceLen: 10}
+	assert.Equal(t, []FileRange{{File: 0, Offset: 20, Length: 5}}, single.PieceFileRanges(2))
+	b, e = single.FileByteRange(0)
+	assert.Equal(t, [2]int{0, 25}, [2]int{b, e})
+}
+
+// TestGeometryModel checks random layouts of tiny files against a
+// byte by byte model of the stream
+func TestGeometryModel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		lengths := make([]int, 1+rnd.Intn(30))
+		for i := range lengths {
+			if rnd.Intn(4) > 0 {
+				lengths[i] = rnd.Intn(7)
+			}
+		}
+		tf := layoutTorrent(1+rnd.Intn(16), lengths...)
+
+		// owner[b] is the file and offset of stream byte b
+		type owner struct{ file, offset int }
+		var stream []owner
+		for i, l := range lengths {
+			for off := 0; off < l; off++ {
+				stream = append(stream, owner{i, off})
+			}
+		}
+
+		total := 0
+		for i := 0; i < tf.NumPieces(); i++ {
+			total += tf.PieceSize(i)
+			var got []owner
+			for _, r := range tf.PieceFileRanges(i) {
+				assert.True(t, r.Length > 0)
+				for off := 0; off < r.Length; off++ {
+					got = append(got, owner{r.File, r.Offset + off})
+				}
+			}
+			assert.Equal(t, stream[tf.PieceOffset(i):tf.PieceOffset(i)+tf.PieceSize(i)], got)
+		}
+		assert.Equal(t, len(stream), total)
+
+		for i, l := range lengths {
+			begin, end := tf.FileByteRange(i)
+			assert.Equal(t, l, end-begin)
+			first, last := tf.FilePieceRange(i)
+			for p := 0; p < tf.NumPieces(); p++ {
+				covers := false
+				for _, r := range tf.PieceFileRanges(p) {
+					covers = covers || r.File == i
+				}
+				assert.Equal(t, covers, p >= first && p < last, "file %v piece %v", i, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	magnetScheme = "magnet"
+	btihPrefix   = "urn:btih:"
+	btmhPrefix   = "urn:btmh:"
+	// multihash code and length of a sha2-256 digest
+	sha256Multihash = "1220"
+	// maxSelectOnly bounds the indices of so, links are untrusted
+	maxSelectOnly = 1 << 16
+)
+
+// Magnet is a magnet link (BEP 9), it names a torrent by its info
+// hashes so the metadata can be fetched from peers
+type Magnet struct {
+	// InfoSHA is the v1 info hash, zero if the link has none
+	InfoSHA [utils.SHALEN]byte
+	// InfoSHA256 is the v2 info hash, zero if the link has none
+	InfoSHA256 [utils.SHA256LEN]byte
+	Name       string
+	Trackers   []string
+	WebSeeds   []string
+	// Peers are host:port addresses given by x.pe
+	Peers []string
+	// SelectOnly lists the file indices given by so (BEP 53)
+	SelectOnly []int
+}
+
+func (m *Magnet) HasV1() bool {
+	return m.InfoSHA != [utils.SHALEN]byte{}
+}
+
+func (m *Magnet) HasV2() bool {
+	return m.InfoSHA256 != [utils.SHA256LEN]byte{}
+}
+
+// ParseMagnet parses a magnet link, it needs a btih or btmh
+// exact topic
+func ParseMagnet(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("magnet: %w", err)
+	}
+	if u.Scheme != magnetScheme {
+		return nil, fmt.Errorf("magnet: invalid scheme %q", u.Scheme)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("magnet: %w", err)
+	}
+
+	m := &Magnet{}
+	// parameters may be numbered, e.g. tr.1 and tr.2, they are read
+	// in numeric order so tr.10 follows tr.9
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		nameA, numA := splitKey(keys[a])
+		nameB, numB := splitKey(keys[b])
+		if nameA != nameB {
+			return nameA < nameB
+		}
+		if numA != numB {
+			return numA < numB
+		}
+		return keys[a] < keys[b]
+	})
+	for _, key := range keys {
+		name, _ := splitKey(key)
+		for _, val := range params[key] {
+			switch name {
+			case "xt":
+				if err = m.parseTopic(val); err != nil {
+					return nil, err
+				}
+			case "dn":
+				m.Name = val
+			case "tr":
+				m.Trackers = append(m.Trackers, val)
+			case "ws":
+				m.WebSeeds = append(m.WebSeeds, val)
+			case "x.pe":
+				m.Peers = append(m.Peers, val)
+			case "so":
+				// repeated so parameters add up
+				if m.SelectOnly, err = parseSelectOnly(m.SelectOnly, val); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if !m.HasV1() && !m.HasV2() {
+		return nil, fmt.Errorf("magnet: missing btih or btmh exact topic")
+	}
+	return m, nil
+}
+
+// splitKey returns the name of a parameter and its number, -1 for
+// parameters without one
+func splitKey(key string) (string, int) {
+	if base, num, ok := strings.Cut(key, "."); ok {
+		if n, err := strconv.Atoi(num); err == nil && n >= 0 {
+			return base, n
+		}
+	}
+	return key, -1
+}
+
+// parseTopic reads a btih hash in hex or base32, or a btmh sha2-256
+// multihash in hex
+func (m *Magnet) parseTopic(xt string) error {
+	switch {
+	case strings.HasPrefix(xt, btihPrefix):
+		hash := xt[len(btihPrefix):]
+		var raw []byte
+		var err error
+		switch len(hash) {
+		case 2 * utils.SHALEN:
+			raw, err = hex.DecodeString(hash)
+		case 32:
+			raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+		default:
+			err = fmt.Errorf("invalid length %v", len(hash))
+		}
+		if err != nil {
+			return fmt.Errorf("magnet: invalid btih %q: %v", hash, err)
+		}
+		copy(m.InfoSHA[:], raw)
+	case strings.HasPrefix(xt, btmhPrefix):
+		hash := xt[len(btmhPrefix):]
+		if !strings.HasPrefix(hash, sha256Multihash) || len(hash) != len(sha256Multihash)+2*utils.SHA256LEN {
+			return fmt.Errorf("magnet: unsupported btmh %q", hash)
+		}
+		raw, err := hex.DecodeString(hash[len(sha256Multihash):])
+		if err != nil {
+			return fmt.Errorf("magnet: invalid btmh %q: %v", hash, err)
+		}
+		copy(m.InfoSHA256[:], raw)
+	}
+	// other topics, e.g. ed2k, are ignored
+	return nil
+}
+
+// parseSelectOnly adds a list of indices and ranges, e.g. 0,2,4-6,
+// to res, which holds at most maxSelectOnly indices. Indices already
+// in res are skipped.
+func parseSelectOnly(res []int, so string) ([]int, error) {
+	seen := make(map[int]bool, len(res))
+	for _, i := range res {
+		seen[i] = true
+	}
+	for _, part := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("magnet: invalid so %q", so)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("magnet: invalid so %q", so)
+			}
+		}
+		if end-start >= maxSelectOnly-len(res) {
+			return nil, fmt.Errorf("magnet: so selects more than %v files", maxSelectOnly)
+		}
+		for i := start; i <= end; i++ {
+			if !seen[i] {
+				seen[i] = true
+				res = append(res, i)
+			}
+		}
+	}
+	return res, nil
+}
+
+func formatSelectOnly(indices []int) string {
+	sorted := append([]int{}, indices...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// String builds the magnet link, hashes are written in hex
+func (m *Magnet) String() string {
+	var params []string
+	add := func(key, val string) {
+		params = append(params, key+"="+url.QueryEscape(val))
+	}
+	if m.HasV1() {
+		params = append(params, "xt="+btihPrefix+hex.EncodeToString(m.InfoSHA[:]))
+	}
+	if m.HasV2() {
+		params = append(params, "xt="+btmhPrefix+sha256Multihash+hex.EncodeToString(m.InfoSHA256[:]))
+	}
+	if m.Name != "" {
+		add("dn", m.Name)
+	}
+	for _, tr := range m.Trackers {
+		add("tr", tr)
+	}
+	for _, ws := range m.WebSeeds {
+		add("ws", ws)
+	}
+	for _, pe := range m.Peers {
+		add("x.pe", pe)
+	}
+	if len(m.SelectOnly) > 0 {
+		params = append(params, "so="+formatSelectOnly(m.SelectOnly))
+	}
+	return magnetScheme + ":?" + strings.Join(params, "&")
+}
+
+// Magnet returns the magnet link of the torrent with its trackers
+// and web seeds
+func (tf *TorrentFile) Magnet() *Magnet {
+	m := &Magnet{Name: tf.Name, WebSeeds: tf.URLList}
+	if tf.HasV1() {
+		m.InfoSHA = tf.InfoSHA
+	}
+	if tf.HasV2() {
+		m.InfoSHA256 = tf.InfoSHA256
+	}
+	seen := make(map[string]bool)
+	for _, tier := range tf.Trackers() {
+		for _, tr := range tier {
+			if !seen[tr] {
+				seen[tr] = true
+				m.Trackers = append(m.Trackers, tr)
+			}
+		}
+	}
+	return m
+}
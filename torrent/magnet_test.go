@@ -0,0 +1,114 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testBTIH = "28c55196f57753c40aceb6fb58617e6995a7eddb"
+	testBTMH = "1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e"
+)
+
+func TestParseMagnet(t *testing.T) {
+	link := "magnet:?xt=urn:btih:" + testBTIH + "&xt=urn:btmh:" + testBTMH +
+		"&dn=debian+11.iso&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A80" +
+		"&ws=http%3A%2F%2Fseed%2F&x.pe=10.0.0.1%3A6881&x.pe=%5B::1%5D:6881&so=0,2,4-6"
+	m, err := ParseMagnet(link)
+	assert.Nil(t, err)
+	assert.True(t, m.HasV1())
+	assert.True(t, m.HasV2())
+	assert.Equal(t, testBTIH, hex.EncodeToString(m.InfoSHA[:]))
+	assert.Equal(t, testBTMH[4:], hex.EncodeToString(m.InfoSHA256[:]))
+	assert.Equal(t, "debian 11.iso", m.Name)
+	assert.Equal(t, []string{"http://a/announce", "udp://b:80"}, m.Trackers)
+	assert.Equal(t, []string{"http://seed/"}, m.WebSeeds)
+	assert.Equal(t, []string{"10.0.0.1:6881", "[::1]:6881"}, m.Peers)
+	assert.Equal(t, []int{0, 2, 4, 5, 6}, m.SelectOnly)
+
+	// String writes the same link back
+	res, err := ParseMagnet(m.String())
+	assert.Nil(t, err)
+	assert.Equal(t, m, res)
+	assert.Contains(t, m.String(), "so=0,2,4-6")
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:fdcvdfxvo5j4icwow35vqyl6ngk2p3o3")
+	assert.Nil(t, err)
+	assert.Equal(t, testBTIH, hex.EncodeToString(m.InfoSHA[:]))
+	assert.False(t, m.HasV2())
+	assert.Equal(t, "magnet:?xt=urn:btih:"+testBTIH, m.String())
+
+	// numbered parameters
+	m, err = ParseMagnet("magnet:?xt.1=urn:btih:" + testBTIH + "&tr.1=http://a&tr.2=http://b")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"http://a", "http://b"}, m.Trackers)
+
+	// numbers are ordered numerically, not as strings
+	link := "magnet:?xt=urn:btih:" + testBTIH
+	var want []string
+	for i := 1; i <= 12; i++ {
+		link += fmt.Sprintf("&tr.%d=http://t%d", i, i)
+		want = append(want, fmt.Sprintf("http://t%d", i))
+	}
+	m, err = ParseMagnet(link)
+	assert.Nil(t, err)
+	assert.Equal(t, want, m.Trackers)
+
+	// repeated so parameters are merged
+	m, err = ParseMagnet("magnet:?xt=urn:btih:" + testBTIH + "&so=0,2&so=2-4&so.1=9")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 2, 3, 4, 9}, m.SelectOnly)
+	assert.Contains(t, m.String(), "so=0,2-4,9")
+}
+
+func TestParseMagnetInvalid(t *testing.T) {
+	for _, link := range []string{
+		"http://example.com/?xt=urn:btih:" + testBTIH,
+		"magnet:?dn=nohash",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:" + testBTIH[:39] + "x",
+		"magnet:?xt=urn:btmh:1114" + testBTMH[4:],
+		"magnet:?xt=urn:btih:" + testBTIH + "&so=3-1",
+		// huge ranges are refused instead of expanded
+		"magnet:?xt=urn:btih:" + testBTIH + "&so=0-2147483647",
+		"magnet:?xt=urn:btih:" + testBTIH + "&so=0-9223372036854775807",
+		"magnet:?xt=urn:btih:" + testBTIH + "&so=0-40000,50000-90000",
+	} {
+		_, err := ParseMagnet(link)
+		assert.NotNil(t, err, link)
+	}
+	m, err := ParseMagnet("magnet:?xt=urn:btih:" + testBTIH + "&so=0-65535")
+	assert.Nil(t, err)
+	assert.Equal(t, maxSelectOnly, len(m.SelectOnly))
+}
+
+func TestTorrentFileMagnet(t *testing.T) {
+	tf := &TorrentFile{
+		Name:         "data",
+		Announce:     "http://a/announce",
+		AnnounceList: [][]string{{"http://a/announce", "http://b/announce"}, {"http://a/announce"}},
+		URLList:      []string{"http://seed/data"},
+		MetaVersion:  1,
+		PiecesSHA:    make([][20]byte, 1),
+	}
+	tf.InfoSHA[0] = 1
+	m := tf.Magnet()
+	assert.Equal(t, tf.InfoSHA, m.InfoSHA)
+	assert.False(t, m.HasV2())
+	assert.Equal(t, []string{"http://a/announce", "http://b/announce"}, m.Trackers)
+	assert.Equal(t, "magnet:?xt=urn:btih:0100000000000000000000000000000000000000&dn=data"+
+		"&tr=http%3A%2F%2Fa%2Fannounce&tr=http%3A%2F%2Fb%2Fannounce&ws=http%3A%2F%2Fseed%2Fdata", m.String())
+
+	// v2 only torrents only have a btmh topic
+	tf.MetaVersion = 2
+	tf.PiecesSHA = nil
+	tf.InfoSHA256[0] = 2
+	m = tf.Magnet()
+	assert.False(t, m.HasV1())
+	assert.Equal(t, tf.InfoSHA256, m.InfoSHA256)
+}
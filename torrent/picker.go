@@ -0,0 +1,402 @@
+package torrent
+
+import (
+	"container/heap"
+	"math/rand"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+// Priority orders the pieces of a download, PrioritySkip pieces are
+// not downloaded at all
+type Priority int
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 4
+	PriorityHigh   Priority = 7
+)
+
+// pieceState tracks the blocks of a piece being downloaded
+type pieceState struct {
+	received []bool
+	// owners are the peers a block is requested from, more than one
+	// only in endgame mode
+	owners   [][]any
+	nreceive int
+}
+
+// Picker decides which blocks to request from which peer. Peers are
+// identified by any comparable owner, e.g. their *peer.Conn. It is
+// not safe for concurrent use.
+type Picker struct {
+	tf           *TorrentFile
+	have         utils.Bitfield
+	availability []int
+	priority     []Priority
+	files        []Priority
+	pieces       map[int]*pieceState
+	rand         *rand.Rand
+}
+
+func NewPicker(tf *TorrentFile) *Picker {
+	n := tf.NumPieces()
+	p := &Picker{
+		tf:           tf,
+		have:         utils.NewBitfield(n),
+		availability: make([]int, n),
+		priority:     make([]Priority, n),
+		files:        make([]Priority, len(tf.fileList())),
+		pieces:       make(map[int]*pieceState),
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i := range p.priority {
+		p.priority[i] = PriorityNormal
+	}
+	for i := range p.files {
+		p.files[i] = PriorityNormal
+	}
+	return p
+}
+
+// SetHave marks the pieces already verified on disk
+func (p *Picker) SetHave(bf utils.Bitfield) {
+	copy(p.have, bf)
+	for i := range p.pieces {
+		if p.have.Has(i) {
+			delete(p.pieces, i)
+		}
+	}
+}
+
+// Have returns a copy of the verified pieces
+func (p *Picker) Have() utils.Bitfield {
+	return append(utils.Bitfield{}, p.have...)
+}
+
+func (p *Picker) HasPiece(i int) bool {
+	return p.have.Has(i)
+}
+
+// AddPeer counts the pieces of a new peer or of its bitfield
+func (p *Picker) AddPeer(bf utils.Bitfield) {
+	for i := range p.availability {
+		if bf.Has(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+// RemovePeer forgets the pieces of a disconnected peer
+func (p *Picker) RemovePeer(bf utils.Bitfield) {
+	for i := range p.availability {
+		if bf.Has(i) && p.availability[i] > 0 {
+			p.availability[i]--
+		}
+	}
+}
+
+// PeerHave counts a have message, the caller counts a piece once per
+// peer
+func (p *Picker) PeerHave(i int) {
+	if i >= 0 && i < len(p.availability) {
+		p.availability[i]++
+	}
+}
+
+func (p *Picker) Availability(i int) int {
+	return p.availability[i]
+}
+
+func (p *Picker) SetPiecePriority(i int, prio Priority) {
+	if i >= 0 && i < len(p.priority) {
+		p.priority[i] = prio
+	}
+}
+
+func (p *Picker) PiecePriority(i int) Priority {
+	return p.priority[i]
+}
+
+// SetFilePriority sets the priority of the pieces of a file, pieces
+// shared with other files get the highest priority of their files
+func (p *Picker) SetFilePriority(file int, prio Priority) {
+	if file < 0 || file >= len(p.files) {
+		return
+	}
+	p.files[file] = prio
+	first, end := p.tf.FilePieceRange(file)
+	for i := first; i < end; i++ {
+		res := PrioritySkip
+		for _, r := range p.tf.PieceFileRanges(i) {
+			if p.files[r.File] > res {
+				res = p.files[r.File]
+			}
+		}
+		p.priority[i] = res
+	}
+}
+
+// wanted reports pieces that are missing and not skipped
+func (p *Picker) wanted(i int) bool {
+	return !p.have.Has(i) && p.priority[i] != PrioritySkip
+}
+
+// Interesting reports whether the peer has a piece we want
+func (p *Picker) Interesting(bf utils.Bitfield) bool {
+	for i := range p.priority {
+		if bf.Has(i) && p.wanted(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete reports whether every wanted piece is verified
+func (p *Picker) Complete() bool {
+	for i := range p.priority {
+		if p.wanted(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Left is the number of bytes of the wanted pieces still missing
+func (p *Picker) Left() int {
+	res := 0
+	for i := range p.priority {
+		if p.wanted(i) {
+			res += p.tf.PieceSize(i)
+		}
+	}
+	return res
+}
+
+// Endgame reports whether every missing block is requested, from
+// then on blocks are requested from several peers
+func (p *Picker) Endgame() bool {
+	for i := range p.priority {
+		if !p.wanted(i) {
+			continue
+		}
+		st, ok := p.pieces[i]
+		if !ok {
+			return false
+		}
+		for b, owners := range st.owners {
+			if !st.received[b] && len(owners) == 0 {
+				return false
+			}
+		}
+	}
+	return !p.Complete()
+}
+
+func (p *Picker) state(i int) *pieceState {
+	st, ok := p.pieces[i]
+	if !ok {
+		n := p.tf.NumBlocks(i)
+		st = &pieceState{received: make([]bool, n), owners: make([][]any, n)}
+		p.pieces[i] = st
+	}
+	return st
+}
+
+// candidate is a wanted piece of the peer with its sort key
+type candidate struct {
+	index   int
+	prio    Priority
+	started bool
+	avail   int
+	// tie orders pieces of equal rank at random
+	tie int64
+}
+
+func (a candidate) less(b candidate) bool {
+	if a.prio != b.prio {
+		return a.prio > b.prio
+	}
+	if a.started != b.started {
+		return a.started
+	}
+	if a.avail != b.avail {
+		return a.avail < b.avail
+	}
+	return a.tie < b.tie
+}
+
+type candidateHeap []candidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(i, j int) bool { return h[i].less(h[j]) }
+func (h candidateHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *candidateHeap) Push(x any)        { *h = append(*h, x.(candidate)) }
+func (h *candidateHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// pieceOrder yields the wanted pieces of the peer: by priority, then
+// pieces in progress, then rarest first with random ties. Pieces are
+// taken from a heap as needed, a few blocks cost no full sort.
+type pieceOrder struct {
+	heap   candidateHeap
+	popped []int
+}
+
+func (p *Picker) candidates(bf utils.Bitfield) *pieceOrder {
+	o := &pieceOrder{}
+	for i := range p.priority {
+		if bf.Has(i) && p.wanted(i) {
+			_, started := p.pieces[i]
+			o.heap = append(o.heap, candidate{
+				index:   i,
+				prio:    p.priority[i],
+				started: started,
+				avail:   p.availability[i],
+				tie:     p.rand.Int63(),
+			})
+		}
+	}
+	heap.Init(&o.heap)
+	return o
+}
+
+// at returns the k-th piece in order, false past the last
+func (o *pieceOrder) at(k int) (int, bool) {
+	for len(o.popped) <= k && o.heap.Len() > 0 {
+		o.popped = append(o.popped, heap.Pop(&o.heap).(candidate).index)
+	}
+	if k >= len(o.popped) {
+		return 0, false
+	}
+	return o.popped[k], true
+}
+
+// Pick returns up to n blocks to request from a peer with the pieces
+// of bf. In endgame mode blocks requested from other peers are
+// returned as well.
+func (p *Picker) Pick(owner any, bf utils.Bitfield, n int) []peer.Block {
+	if n <= 0 {
+		return nil
+	}
+	var res []peer.Block
+	cands := p.candidates(bf)
+	for k := 0; len(res) < n; k++ {
+		i, ok := cands.at(k)
+		if !ok {
+			break
+		}
+		st := p.state(i)
+		for b := range st.received {
+			if len(res) == n {
+				break
+			}
+			if !st.received[b] && len(st.owners[b]) == 0 {
+				st.owners[b] = append(st.owners[b], owner)
+				res = append(res, p.block(i, b))
+			}
+		}
+	}
+	if len(res) == n || !p.Endgame() {
+		return res
+	}
+	for k := 0; ; k++ {
+		i, ok := cands.at(k)
+		if !ok {
+			return res
+		}
+		st := p.state(i)
+		for b := range st.received {
+			if len(res) == n {
+				return res
+			}
+			if !st.received[b] && !hasOwner(st.owners[b], owner) {
+				st.owners[b] = append(st.owners[b], owner)
+				res = append(res, p.block(i, b))
+			}
+		}
+	}
+}
+
+func (p *Picker) block(i, b int) peer.Block {
+	return peer.Block{Index: i, Begin: b * BlockLen, Length: p.tf.BlockSize(i, b)}
+}
+
+func hasOwner(owners []any, owner any) bool {
+	for _, o := range owners {
+		if o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// blockIndex returns the state and block number of a block, false
+// for blocks we did not ask for
+func (p *Picker) blockIndex(blk peer.Block) (*pieceState, int, bool) {
+	st, ok := p.pieces[blk.Index]
+	if !ok || blk.Begin%BlockLen != 0 {
+		return nil, 0, false
+	}
+	b := blk.Begin / BlockLen
+	if b >= len(st.received) || blk.Length != p.tf.BlockSize(blk.Index, b) {
+		return nil, 0, false
+	}
+	return st, b, true
+}
+
+// Received marks a block as downloaded. It returns the other peers
+// the block was requested from, which should get a cancel, and
+// whether all blocks of the piece are there to be verified. ok is
+// false for a block we did not ask for or already have, its data
+// must be dropped.
+func (p *Picker) Received(owner any, blk peer.Block) (cancel []any, complete, ok bool) {
+	st, b, ok := p.blockIndex(blk)
+	if !ok || st.received[b] {
+		return nil, false, false
+	}
+	for _, o := range st.owners[b] {
+		if o != owner {
+			cancel = append(cancel, o)
+		}
+	}
+	st.received[b] = true
+	st.owners[b] = nil
+	st.nreceive++
+	return cancel, st.nreceive == len(st.received), true
+}
+
+// Abort releases requests that will not be answered, e.g. after a
+// choke or a timeout, so they can be picked again
+func (p *Picker) Abort(owner any, blocks []peer.Block) {
+	for _, blk := range blocks {
+		st, b, ok := p.blockIndex(blk)
+		if !ok {
+			continue
+		}
+		owners := st.owners[b][:0]
+		for _, o := range st.owners[b] {
+			if o != owner {
+				owners = append(owners, o)
+			}
+		}
+		st.owners[b] = owners
+	}
+}
+
+// Done marks piece i as verified
+func (p *Picker) Done(i int) {
+	p.have.Set(i)
+	delete(p.pieces, i)
+}
+
+// Failed forgets the blocks of a piece that did not match its hash
+func (p *Picker) Failed(i int) {
+	delete(p.pieces, i)
+}
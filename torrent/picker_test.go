@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"math/rand"
+	"testing"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bitfield(n int, pieces ...int) utils.Bitfield {
+	bf := utils.NewBitfield(n)
+	for _, i := range pieces {
+		bf.Set(i)
+	}
+	return bf
+}
+
+func blk(index, begin, length int) peer.Block {
+	return peer.Block{Index: index, Begin: begin, Length: length}
+}
+
+func testPicker(tf *TorrentFile) *Picker {
+	p := NewPicker(tf)
+	p.rand = rand.New(rand.NewSource(1))
+	return p
+}
+
+func TestPickerRarestFirst(t *testing.T) {
+	// 4 pieces of 2 blocks
+	tf := layoutTorrent(2*BlockLen, 8*BlockLen)
+	p := testPicker(tf)
+	all := bitfield(4, 0, 1, 2, 3)
+	p.AddPeer(all)
+	p.AddPeer(bitfield(4, 0, 1, 3))
+	p.PeerHave(0)
+	// availability: 3 2 1 2
+	assert.Equal(t, 1, p.Availability(2))
+	assert.True(t, p.Interesting(all))
+
+	blocks := p.Pick("a", all, 3)
+	assert.Equal(t, []peer.Block{blk(2, 0, BlockLen), blk(2, BlockLen, BlockLen), blk(blocks[2].Index, 0, BlockLen)}, blocks)
+	assert.Contains(t, []int{1, 3}, blocks[2].Index)
+
+	// the started piece comes before rarer ones
+	p.PeerHave(2)
+	p.PeerHave(2)
+	next := p.Pick("b", all, 1)
+	assert.Equal(t, []peer.Block{blk(blocks[2].Index, BlockLen, BlockLen)}, next)
+
+	// ties are broken at random
+	seen := map[int]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		q := NewPicker(tf)
+		q.rand = rand.New(rand.NewSource(seed))
+		seen[q.Pick("a", all, 1)[0].Index] = true
+	}
+	assert.Equal(t, 4, len(seen))
+
+	// peers only get their own pieces
+	assert.Empty(t, p.Pick("c", bitfield(4, 2), 4))
+	assert.Equal(t, 0, p.Pick("c", bitfield(4, 0), 4)[0].Index)
+}
+
+func TestPickerPickFew(t *testing.T) {
+	tf := layoutTorrent(BlockLen, 1000*BlockLen)
+	p := testPicker(tf)
+	all := utils.NewBitfield(1000)
+	for i := 0; i < 1000; i++ {
+		all.Set(i)
+	}
+	p.AddPeer(all)
+	p.PeerHave(500)
+
+	// a full pipeline picks nothing and starts no piece
+	assert.Empty(t, p.Pick("a", all, 0))
+	assert.Empty(t, p.pieces)
+
+	// only as many pieces as needed are taken in order
+	order := p.candidates(all)
+	i, ok := order.at(0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(order.popped))
+	assert.Equal(t, 999, order.heap.Len())
+	assert.NotEqual(t, 500, i)
+	blocks := p.Pick("a", all, 2)
+	assert.Equal(t, 2, len(blocks))
+	assert.Equal(t, 2, len(p.pieces))
+}
+
+func TestPickerPriorities(t *testing.T) {
+	// files a, b, c of 1.5, 1 and 1.5 pieces
+	tf := layoutTorrent(2*BlockLen, 3*BlockLen, 2*BlockLen, 3*BlockLen)
+	p := testPicker(tf)
+	all := bitfield(4, 0, 1, 2, 3)
+	p.AddPeer(all)
+
+	p.SetFilePriority(0, PrioritySkip)
+	p.SetFilePriority(2, PrioritySkip)
+	// piece 1 and 2 share b
+	assert.Equal(t, []Priority{PrioritySkip, PriorityNormal, PriorityNormal, PrioritySkip},
+		[]Priority{p.PiecePriority(0), p.PiecePriority(1), p.PiecePriority(2), p.PiecePriority(3)})
+	assert.Equal(t, 4*BlockLen, p.Left())
+	assert.False(t, p.Interesting(bitfield(4, 0, 3)))
+
+	p.SetPiecePriority(2, PriorityHigh)
+	blocks := p.Pick("a", all, 10)
+	assert.Equal(t, 4, len(blocks))
+	assert.Equal(t, 2, blocks[0].Index)
+	assert.Equal(t, 2, blocks[1].Index)
+
+	for _, b := range blocks {
+		p.Received("a", b)
+	}
+	p.Done(1)
+	p.Done(2)
+	assert.True(t, p.Complete())
+	assert.Equal(t, 0, p.Left())
+}
+
+func TestPickerEndgame(t *testing.T) {
+	tf := layoutTorrent(2*BlockLen, 4*BlockLen)
+	p := testPicker(tf)
+	all := bitfield(2, 0, 1)
+	p.AddPeer(all)
+	p.AddPeer(all)
+
+	a := p.Pick("a", all, 3)
+	assert.Equal(t, 3, len(a))
+	assert.False(t, p.Endgame())
+	b := p.Pick("b", all, 3)
+	// one fresh block, then duplicates of a's requests
+	assert.Equal(t, 3, len(b))
+	assert.True(t, p.Endgame())
+	b = append(b, p.Pick("b", all, 3)...)
+	assert.Equal(t, 4, len(b))
+	assert.Empty(t, p.Pick("b", all, 3))
+
+	cancel, complete, ok := p.Received("b", a[0])
+	assert.Equal(t, []any{"a"}, cancel)
+	assert.False(t, complete)
+	assert.True(t, ok)
+	// the late duplicate is ignored
+	cancel, complete, ok = p.Received("a", a[0])
+	assert.Nil(t, cancel)
+	assert.False(t, complete)
+	assert.False(t, ok)
+
+	_, complete, _ = p.Received("a", a[1])
+	assert.True(t, complete)
+	// so is a duplicate of the last block and one after the piece is done
+	_, complete, ok = p.Received("b", a[1])
+	assert.False(t, complete)
+	assert.False(t, ok)
+	p.Done(a[0].Index)
+	_, _, ok = p.Received("b", a[1])
+	assert.False(t, ok)
+
+	// aborted requests are picked again
+	p.Abort("a", a[2:])
+	p.Abort("b", b)
+	assert.False(t, p.Endgame())
+	last := 1 - a[0].Index
+	again := p.Pick("c", all, 5)
+	assert.Equal(t, 2, len(again))
+	assert.Equal(t, last, again[0].Index)
+
+	// a failed piece starts over
+	for _, blk := range again {
+		p.Received("c", blk)
+	}
+	p.Failed(last)
+	assert.Equal(t, 2, len(p.Pick("c", all, 5)))
+	p.Done(last)
+	assert.True(t, p.Complete())
+	assert.False(t, p.Endgame())
+	assert.Equal(t, bitfield(2, 0, 1), p.Have())
+}
+
+func TestPickerShortPiece(t *testing.T) {
+	tf := layoutTorrent(2*BlockLen, BlockLen+100)
+	p := testPicker(tf)
+	p.SetHave(bitfield(1))
+	blocks := p.Pick("a", bitfield(1, 0), 5)
+	assert.Equal(t, []peer.Block{blk(0, 0, BlockLen), blk(0, BlockLen, 100)}, blocks)
+	// blocks of the wrong size are refused
+	_, complete, _ := p.Received("a", blk(0, BlockLen, BlockLen))
+	assert.False(t, complete)
+	p.Received("a", blocks[0])
+	_, complete, _ = p.Received("a", blocks[1])
+	assert.True(t, complete)
+}
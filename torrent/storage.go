@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// storage maps the pieces of a torrent onto its files below dir
+type storage struct {
+	tf    *TorrentFile
+	root  string
+	files []FileInfo
+	paths []string
+}
+
+func newStorage(tf *TorrentFile, dir string) *storage {
+	s := &storage{tf: tf, root: filepath.Join(dir, tf.Name), files: tf.fileList()}
+	for _, f := range s.files {
+		path := s.root
+		if tf.IsMultiFile() {
+			path = filepath.Join(append([]string{path}, f.Path...)...)
+		}
+		s.paths = append(s.paths, path)
+	}
+	return s
+}
+
+// readPiece fills p with piece i, missing or short files are
+// reported as errors. Padding files read as zeros.
+func (s *storage) readPiece(i int, p []byte) error {
+	return s.readBlock(i, 0, p)
+}
+
+// readBlock fills p with the bytes of piece i from begin on
+func (s *storage) readBlock(i, begin int, p []byte) error {
+	for _, r := range s.tf.PieceFileRanges(i) {
+		if len(p) == 0 {
+			break
+		}
+		if begin >= r.Length {
+			begin -= r.Length
+			continue
+		}
+		n := r.Length - begin
+		if n > len(p) {
+			n = len(p)
+		}
+		if s.files[r.File].IsPadding() {
+			for j := range p[:n] {
+				p[j] = 0
+			}
+		} else if err := readFileAt(s.paths[r.File], p[:n], r.Offset+begin); err != nil {
+			return err
+		}
+		p, begin = p[n:], 0
+	}
+	return nil
+}
+
+// writePiece stores piece i, padding files are never written
+func (s *storage) writePiece(i int, p []byte) error {
+	for _, r := range s.tf.PieceFileRanges(i) {
+		if !s.files[r.File].IsPadding() && !s.files[r.File].IsSymlink() {
+			if err := writeFileAt(s.paths[r.File], p[:r.Length], r.Offset); err != nil {
+				return err
+			}
+		}
+		p = p[r.Length:]
+	}
+	return nil
+}
+
+// materialize finishes the download: empty files are created,
+// executables get their mode bits and symlinks are linked to
+// their target inside the torrent root
+func (s *storage) materialize() error {
+	for i, f := range s.files {
+		path := s.paths[i]
+		switch {
+		case f.IsPadding():
+		case f.IsSymlink():
+			target := filepath.Join(append([]string{s.root}, f.SymlinkPath...)...)
+			rel, err := filepath.Rel(filepath.Dir(path), target)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err = os.Symlink(rel, path); err != nil {
+				return err
+			}
+		default:
+			if f.Length == 0 {
+				if err := writeFileAt(path, nil, 0); err != nil {
+					return err
+				}
+			}
+			if f.IsExecutable() {
+				if err := os.Chmod(path, 0o755); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func readFileAt(path string, p []byte, off int) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.ReadAt(p, int64(off)); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func writeFileAt(path string, p []byte, off int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(p, int64(off)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,57 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageMaterialize(t *testing.T) {
+	tf := layoutTorrent(16, 10, 6, 10, 0, 0)
+	tf.Files[1].Path = []string{".pad", "6"}
+	tf.Files[1].Attr = "p"
+	tf.Files[2].Path = []string{"bin", "run"}
+	tf.Files[2].Attr = "x"
+	tf.Files[4].Path = []string{"lib", "link"}
+	tf.Files[4].Attr = "l"
+	tf.Files[4].SymlinkPath = []string{"bin", "run"}
+
+	dir := t.TempDir()
+	st := newStorage(tf, dir)
+	data := make([]byte, tf.FileLen)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	for i := 0; i < tf.NumPieces(); i++ {
+		assert.Nil(t, st.writePiece(i, data[tf.PieceOffset(i):tf.PieceOffset(i)+tf.PieceSize(i)]))
+	}
+	assert.Nil(t, st.materialize())
+
+	root := filepath.Join(dir, "t")
+	got, err := os.ReadFile(filepath.Join(root, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[:10], got)
+	_, err = os.Stat(filepath.Join(root, ".pad"))
+	assert.True(t, os.IsNotExist(err))
+
+	stat, err := os.Stat(filepath.Join(root, "bin", "run"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o755), stat.Mode().Perm())
+	stat, err = os.Stat(filepath.Join(root, "d"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+
+	target, err := os.Readlink(filepath.Join(root, "lib", "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("..", "bin", "run"), target)
+	got, err = os.ReadFile(filepath.Join(root, "lib", "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, data[16:26], got)
+
+	// the padding reads back as zeros
+	piece := make([]byte, 16)
+	assert.Nil(t, st.readPiece(0, piece))
+	assert.Equal(t, append(append([]byte{}, data[:10]...), make([]byte, 6)...), piece)
+}
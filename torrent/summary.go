@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"tutorial/bt_demo/utils"
+)
+
+// Summary is the stable JSON form of a torrent, hashes are hex and
+// lists are never null
+type Summary struct {
+	Name         string        `json:"name"`
+	InfoHash     string        `json:"info_hash,omitempty"`
+	InfoHashV2   string        `json:"info_hash_v2,omitempty"`
+	MetaVersion  int           `json:"meta_version"`
+	Private      bool          `json:"private"`
+	Source       string        `json:"source,omitempty"`
+	Comment      string        `json:"comment,omitempty"`
+	CreatedBy    string        `json:"created_by,omitempty"`
+	CreationDate string        `json:"creation_date,omitempty"`
+	Trackers     [][]string    `json:"trackers"`
+	WebSeeds     []string      `json:"web_seeds"`
+	TotalSize    int           `json:"total_size"`
+	PieceLength  int           `json:"piece_length"`
+	PieceCount   int           `json:"piece_count"`
+	Files        []SummaryFile `json:"files"`
+	Magnet       string        `json:"magnet"`
+}
+
+type SummaryFile struct {
+	Path    string `json:"path"`
+	Length  int    `json:"length"`
+	Padding bool   `json:"padding,omitempty"`
+}
+
+func (tf *TorrentFile) Summary() *Summary {
+	s := &Summary{
+		Name:        tf.Name,
+		MetaVersion: tf.MetaVersion,
+		Private:     tf.Private,
+		Source:      tf.Source,
+		Comment:     tf.Comment,
+		CreatedBy:   tf.CreatedBy,
+		Trackers:    tf.Trackers(),
+		WebSeeds:    append(append([]string{}, tf.URLList...), tf.HTTPSeeds...),
+		TotalSize:   tf.FileLen,
+		PieceLength: tf.PieceLen,
+		PieceCount:  tf.NumPieces(),
+		Files:       []SummaryFile{},
+		Magnet:      tf.Magnet().String(),
+	}
+	if s.MetaVersion == 0 {
+		s.MetaVersion = 1
+	}
+	if tf.HasV1() {
+		s.InfoHash = hex.EncodeToString(tf.InfoSHA[:])
+	}
+	if tf.HasV2() {
+		s.InfoHashV2 = hex.EncodeToString(tf.InfoSHA256[:])
+	}
+	if !tf.CreationDate.IsZero() {
+		s.CreationDate = tf.CreationDate.UTC().Format(time.RFC3339)
+	}
+	if s.Trackers == nil {
+		s.Trackers = [][]string{}
+	}
+	for _, f := range tf.fileList() {
+		s.Files = append(s.Files, SummaryFile{
+			Path:    strings.Join(f.Path, "/"),
+			Length:  f.Length,
+			Padding: f.IsPadding(),
+		})
+	}
+	return s
+}
+
+func (tf *TorrentFile) MarshalJSON() ([]byte, error) {
+	return utils.ToJson(tf.Summary()), nil
+}
+
+// WriteSummary prints a human readable report of the torrent in the
+// layout of transmission-show
+func (tf *TorrentFile) WriteSummary(wd io.Writer) error {
+	s := tf.Summary()
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+
+	line("Name: %v", s.Name)
+	line("")
+	line("GENERAL")
+	line("")
+	line("  Name: %v", s.Name)
+	if s.InfoHash != "" {
+		line("  Hash: %v", s.InfoHash)
+	}
+	if s.InfoHashV2 != "" {
+		line("  Hash v2: %v", s.InfoHashV2)
+	}
+	line("  Meta version: %v", s.MetaVersion)
+	line("  Created by: %v", valueOr(s.CreatedBy, "Unknown"))
+	if tf.CreationDate.IsZero() {
+		line("  Created on: Unknown")
+	} else {
+		line("  Created on: %v", tf.CreationDate.UTC().Format(time.RFC1123))
+	}
+	if s.Comment != "" {
+		line("  Comment: %v", s.Comment)
+	}
+	line("  Piece Count: %v", s.PieceCount)
+	line("  Piece Size: %v", FormatSize(s.PieceLength))
+	line("  Total Size: %v", FormatSize(s.TotalSize))
+	if s.Private {
+		line("  Privacy: Private torrent")
+	} else {
+		line("  Privacy: Public torrent")
+	}
+	if s.Source != "" {
+		line("  Source: %v", s.Source)
+	}
+
+	line("")
+	line("TRACKERS")
+	for i, tier := range s.Trackers {
+		line("")
+		line("  Tier #%d", i+1)
+		for _, tr := range tier {
+			line("  %v", tr)
+		}
+	}
+	if len(s.WebSeeds) > 0 {
+		line("")
+		line("WEBSEEDS")
+		line("")
+		for _, ws := range s.WebSeeds {
+			line("  %v", ws)
+		}
+	}
+
+	line("")
+	line("FILES")
+	line("")
+	for _, f := range s.Files {
+		if f.Padding {
+			continue
+		}
+		line("  %v (%v)", f.Path, FormatSize(f.Length))
+	}
+
+	_, err := io.WriteString(wd, b.String())
+	return err
+}
+
+func valueOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// FormatSize prints a byte count with binary units, e.g. 256.0 KiB
+func FormatSize(n int) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := unit, 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
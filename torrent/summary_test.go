@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"tutorial/bt_demo/utils"
+)
+
+func TestSummaryJSON(t *testing.T) {
+	file, err := os.Open(FileName)
+	assert.Nil(t, err)
+	defer file.Close()
+	tf, err := ParseTorrentFile(file)
+	assert.Nil(t, err)
+
+	res := utils.ToAny[map[string]any](utils.ToJson(tf))
+	assert.Equal(t, "28c55196f57753c40aceb6fb58617e6995a7eddb", res["info_hash"])
+	assert.NotContains(t, res, "info_hash_v2")
+	assert.Equal(t, "debian-11.2.0-amd64-netinst.iso", res["name"])
+	assert.Equal(t, float64(1512), res["piece_count"])
+	assert.Equal(t, float64(262144), res["piece_length"])
+	assert.Equal(t, float64(396361728), res["total_size"])
+	assert.Equal(t, "2021-12-18T13:22:47Z", res["creation_date"])
+	assert.Equal(t, []any{[]any{"http://bttracker.debian.org:6969/announce"}}, res["trackers"])
+	assert.Equal(t, 2, len(res["web_seeds"].([]any)))
+	assert.Equal(t, []any{map[string]any{"path": "debian-11.2.0-amd64-netinst.iso", "length": float64(396361728)}}, res["files"])
+	assert.True(t, strings.HasPrefix(res["magnet"].(string), "magnet:?xt=urn:btih:28c5"))
+
+	// empty lists are not null
+	empty := &TorrentFile{Name: "a", FileLen: 1, PieceLen: 16 << 10}
+	assert.Contains(t, string(utils.ToJson(empty)), `"trackers":[]`)
+	assert.Contains(t, string(utils.ToJson(empty)), `"web_seeds":[]`)
+}
+
+func TestWriteSummary(t *testing.T) {
+	file, err := os.Open(FileName)
+	assert.Nil(t, err)
+	defer file.Close()
+	tf, err := ParseTorrentFile(file)
+	assert.Nil(t, err)
+
+	var buf strings.Builder
+	assert.Nil(t, tf.WriteSummary(&buf))
+	out := buf.String()
+	for _, line := range []string{
+		"Name: debian-11.2.0-amd64-netinst.iso\n",
+		"  Hash: 28c55196f57753c40aceb6fb58617e6995a7eddb\n",
+		"  Created on: Sat, 18 Dec 2021 13:22:47 UTC\n",
+		"  Piece Count: 1512\n",
+		"  Piece Size: 256.0 KiB\n",
+		"  Total Size: 378.0 MiB\n",
+		"  Privacy: Public torrent\n",
+		"  Tier #1\n  http://bttracker.debian.org:6969/announce\n",
+		"FILES\n\n  debian-11.2.0-amd64-netinst.iso (378.0 MiB)\n",
+	} {
+		assert.Contains(t, out, line)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", FormatSize(0))
+	assert.Equal(t, "1023 B", FormatSize(1023))
+	assert.Equal(t, "1.0 KiB", FormatSize(1024))
+	assert.Equal(t, "1.5 MiB", FormatSize(3<<19))
+	assert.Equal(t, "2.0 GiB", FormatSize(2<<30))
+}
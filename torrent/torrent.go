@@ -2,42 +2,191 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
-	"math/rand"
-	"net/url"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 	"tutorial/bt_demo/benode"
 	"tutorial/bt_demo/utils"
 )
 
-const (
-	peerPort = 6667
-)
+type RawFileInfo struct {
+	Len         int      `benode:"length"`
+	Path        []string `benode:"path"`
+	Attr        string   `benode:"attr,omitempty"`
+	SymlinkPath []string `benode:"symlink path,omitempty"`
+	SHA1        string   `benode:"sha1,omitempty"`
+}
 
 type RawInfo struct {
-	Name     string `benode:"name"`
-	Len      int    `benode:"length"`
-	PieceLen int    `benode:"piece length"`
-	Pieces   string `benode:"pieces"`
+	Name        string         `benode:"name"`
+	Len         int            `benode:"length,omitempty"`
+	Files       []*RawFileInfo `benode:"files,omitempty"`
+	PieceLen    int            `benode:"piece length"`
+	Pieces      string         `benode:"pieces,omitempty"`
+	Private     int            `benode:"private,omitempty"`
+	Source      string         `benode:"source,omitempty"`
+	MetaVersion int            `benode:"meta version,omitempty"`
+	FileTree    map[string]any `benode:"file tree,omitempty"`
 }
 
 type RawFile struct {
-	Announce string   `benode:"announce"`
-	Info     *RawInfo `benode:"info"`
+	Announce     string            `benode:"announce,omitempty"`
+	AnnounceList [][]string        `benode:"announce-list,omitempty"`
+	CreationDate int64             `benode:"creation date,omitempty"`
+	Comment      string            `benode:"comment,omitempty"`
+	CreatedBy    string            `benode:"created by,omitempty"`
+	Encoding     string            `benode:"encoding,omitempty"`
+	URLList      any               `benode:"url-list,omitempty"`
+	HTTPSeeds    []string          `benode:"httpseeds,omitempty"`
+	Nodes        [][]any           `benode:"nodes,omitempty"`
+	PieceLayers  map[string]string `benode:"piece layers,omitempty"`
+	Info         benode.RawMessage `benode:"info"`
+}
+
+// FileInfo is one file of a multi-file torrent, Path is relative to Name
+type FileInfo struct {
+	Length int
+	Path   []string
+	// Attr holds the BEP 47 attributes: p(adding), x(ecutable),
+	// h(idden) and l(ink)
+	Attr string
+	// SymlinkPath is the link target relative to the torrent root
+	SymlinkPath []string
+	// SHA1 is the optional hash of the whole file, zero if absent
+	SHA1 [utils.SHALEN]byte
+	// PiecesRoot is the v2 merkle root, zero for empty files
+	PiecesRoot [utils.SHA256LEN]byte
+}
+
+// IsPadding reports whether the file only aligns the next one
+// to a piece boundary, its data is zeros and never stored
+func (f FileInfo) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f FileInfo) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f FileInfo) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+func (f FileInfo) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// DHTNode is a bootstrap node listed in the "nodes" key (BEP 5)
+type DHTNode struct {
+	Host string
+	Port int
+}
+
+func (n DHTNode) String() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
 }
 
 type TorrentFile struct {
-	InfoSHA   [utils.SHALEN]byte
-	Announce  string
-	Name      string
-	FileLen   int
-	PieceLen  int
-	PiecesSHA [][utils.SHALEN]byte
+	// InfoSHA is the v1 info hash, zero for v2 only torrents
+	InfoSHA [utils.SHALEN]byte
+	// InfoSHA256 is the v2 info hash and InfoSHAV2 its truncated
+	// form used by trackers and the handshake
+	InfoSHA256   [utils.SHA256LEN]byte
+	InfoSHAV2    [utils.SHALEN]byte
+	MetaVersion  int
+	Announce     string
+	AnnounceList [][]string
+	CreationDate time.Time
+	Comment      string
+	CreatedBy    string
+	Encoding     string
+	URLList      []string
+	HTTPSeeds    []string
+	Nodes        []DHTNode
+	Private      bool
+	Source       string
+	Name         string
+	Files        []FileInfo
+	FileLen      int
+	PieceLen     int
+	PiecesSHA    [][utils.SHALEN]byte
+	// PiecesRoot is the v2 merkle root of a single file torrent
+	PiecesRoot [utils.SHA256LEN]byte
+	// PieceLayers maps a pieces root to the hashes of its pieces
+	PieceLayers map[[utils.SHA256LEN]byte][][utils.SHA256LEN]byte
+
+	// info keeps the encoded info dict the torrent was loaded or
+	// created from, so writing it back keeps InfoSHA unchanged
+	info benode.RawMessage
+	// piecesLen is the raw length of the pieces string
+	piecesLen int
+}
+
+// IsMultiFile reports whether the torrent uses the "files" layout
+func (tf *TorrentFile) IsMultiFile() bool {
+	return len(tf.Files) > 0
+}
+
+// SetTrackers replaces the announce tiers, the first url becomes
+// the announce url and a single tracker needs no announce-list
+func (tf *TorrentFile) SetTrackers(tiers [][]string) {
+	tf.Announce = ""
+	tf.AnnounceList = nil
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		if tf.Announce == "" {
+			tf.Announce = tier[0]
+		}
+		tf.AnnounceList = append(tf.AnnounceList, tier)
+	}
+	if len(tf.AnnounceList) == 1 && len(tf.AnnounceList[0]) == 1 {
+		tf.AnnounceList = nil
+	}
+}
+
+// Trackers returns the announce tiers, falling back to Announce
+// when no announce-list is present (BEP 12)
+func (tf *TorrentFile) Trackers() [][]string {
+	if len(tf.AnnounceList) > 0 {
+		return tf.AnnounceList
+	}
+	if tf.Announce != "" {
+		return [][]string{{tf.Announce}}
+	}
+	return nil
+}
+
+// SwarmHash is the info hash sent to trackers and peers, the
+// truncated v2 hash for v2 only torrents
+func (tf *TorrentFile) SwarmHash() [utils.SHALEN]byte {
+	if tf.HasV1() {
+		return tf.InfoSHA
+	}
+	return tf.InfoSHAV2
 }
 
+// ParseTorrentFile loads a torrent and rejects it if Validate
+// reports any error
 func ParseTorrentFile(rd io.Reader) (tf *TorrentFile, err error) {
-	var rf *RawFile
-	var node benode.Benode
+	if tf, err = ParseTorrentFileUnchecked(rd); err != nil {
+		return nil, err
+	}
+	if err = Validate(tf).Err(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// ParseTorrentFileUnchecked loads a torrent without validating it
+func ParseTorrentFileUnchecked(rd io.Reader) (tf *TorrentFile, err error) {
+	rf := &RawFile{}
+	ri := &RawInfo{}
 	checkErr := func(fn func()) {
 		if err != nil {
 			return
@@ -49,51 +198,196 @@ func ParseTorrentFile(rd io.Reader) (tf *TorrentFile, err error) {
 		err = benode.Unmarshal(bufio.NewReader(rd), rf)
 	})
 	checkErr(func() {
-		tf = &TorrentFile{
-			Announce: rf.Announce,
-			Name:     rf.Info.Name,
-			PieceLen: rf.Info.PieceLen,
-			FileLen:  rf.Info.Len,
+		if len(rf.Info) == 0 {
+			err = fmt.Errorf("torrent: missing info dict")
+			return
 		}
+		err = benode.Unmarshal(bufio.NewReader(bytes.NewReader(rf.Info)), ri)
 	})
 	checkErr(func() {
-		node, err = benode.Marshal(rf.Info)
-	})
-	checkErr(func() {
-		tf.InfoSHA, err = benode.CalSHA(node)
+		tf, err = newTorrentFile(rf, ri)
 	})
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+func newTorrentFile(rf *RawFile, ri *RawInfo) (*TorrentFile, error) {
+	tf := &TorrentFile{
+		MetaVersion:  ri.MetaVersion,
+		Announce:     rf.Announce,
+		AnnounceList: rf.AnnounceList,
+		Comment:      rf.Comment,
+		CreatedBy:    rf.CreatedBy,
+		Encoding:     rf.Encoding,
+		HTTPSeeds:    rf.HTTPSeeds,
+		Private:      ri.Private == 1,
+		Source:       ri.Source,
+		Name:         ri.Name,
+		PieceLen:     ri.PieceLen,
+		FileLen:      ri.Len,
+	}
+	if rf.CreationDate != 0 {
+		tf.CreationDate = time.Unix(rf.CreationDate, 0)
+	}
 
-	pieces := utils.Bytes(rf.Info.Pieces)
+	// url-list may be a single string or a list of strings (BEP 19)
+	switch urls := rf.URLList.(type) {
+	case nil:
+	case string:
+		if urls != "" {
+			tf.URLList = []string{urls}
+		}
+	case []any:
+		for _, u := range urls {
+			s, ok := u.(string)
+			if !ok {
+				return nil, fmt.Errorf("torrent: invalid url-list entry %v", u)
+			}
+			tf.URLList = append(tf.URLList, s)
+		}
+	default:
+		return nil, fmt.Errorf("torrent: invalid url-list %v", urls)
+	}
+
+	for _, n := range rf.Nodes {
+		if len(n) != 2 {
+			return nil, fmt.Errorf("torrent: invalid node %v", n)
+		}
+		host, ok1 := n[0].(string)
+		port, ok2 := n[1].(int64)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("torrent: invalid node %v", n)
+		}
+		tf.Nodes = append(tf.Nodes, DHTNode{Host: host, Port: int(port)})
+	}
+
+	if len(ri.Files) > 0 {
+		tf.Files = make([]FileInfo, len(ri.Files))
+		tf.FileLen = 0
+		for i, f := range ri.Files {
+			tf.Files[i] = FileInfo{Length: f.Len, Path: f.Path, Attr: f.Attr, SymlinkPath: f.SymlinkPath}
+			if len(f.SHA1) == utils.SHALEN {
+				copy(tf.Files[i].SHA1[:], f.SHA1)
+			}
+			tf.FileLen += f.Len
+		}
+	}
+
+	pieces := utils.Bytes(ri.Pieces)
+	tf.piecesLen = len(pieces)
 	cnt := len(pieces) / utils.SHALEN
 	tf.PiecesSHA = make([][utils.SHALEN]byte, cnt)
 	for i := 0; i < cnt; i++ {
 		copy(tf.PiecesSHA[i][:], pieces[i*utils.SHALEN:(i+1)*utils.SHALEN])
 	}
 
+	if tf.MetaVersion == 0 {
+		tf.MetaVersion = 1
+	}
+	if tf.MetaVersion == 2 {
+		if err := tf.parseV2(rf, ri); err != nil {
+			return nil, err
+		}
+	}
+	tf.setInfo(rf.Info)
 	return tf, nil
 }
 
-func buildUrl(tf *TorrentFile) (link string, err error) {
-	var peerId [utils.SHALEN]byte
-	if _, err = rand.Read(peerId[:]); err != nil {
-		return "", err
+// Write encodes the torrent as a .torrent file
+func (tf *TorrentFile) Write(wd io.Writer) error {
+	info, err := tf.infoBytes()
+	if err != nil {
+		return err
 	}
-
-	base, err := url.Parse(tf.Announce)
+	node, err := benode.Marshal(tf.rawFile(info))
 	if err != nil {
-		return "", err
+		return err
 	}
+	return node.Write(wd)
+}
+
+func (tf *TorrentFile) rawFile(info benode.RawMessage) *RawFile {
+	rf := &RawFile{
+		Announce:     tf.Announce,
+		AnnounceList: tf.AnnounceList,
+		Comment:      tf.Comment,
+		CreatedBy:    tf.CreatedBy,
+		Encoding:     tf.Encoding,
+		HTTPSeeds:    tf.HTTPSeeds,
+		Info:         info,
+	}
+	if !tf.CreationDate.IsZero() {
+		rf.CreationDate = tf.CreationDate.Unix()
+	}
+	switch len(tf.URLList) {
+	case 0:
+	case 1:
+		rf.URLList = tf.URLList[0]
+	default:
+		rf.URLList = tf.URLList
+	}
+	for _, n := range tf.Nodes {
+		rf.Nodes = append(rf.Nodes, []any{n.Host, n.Port})
+	}
+	if len(tf.PieceLayers) > 0 {
+		rf.PieceLayers = make(map[string]string, len(tf.PieceLayers))
+		for root, layer := range tf.PieceLayers {
+			rf.PieceLayers[string(root[:])] = string(joinHashes(layer))
+		}
+	}
+	return rf
+}
+
+// infoBytes returns the info dict the torrent was loaded with,
+// or encodes a new one from the fields
+func (tf *TorrentFile) infoBytes() (benode.RawMessage, error) {
+	if len(tf.info) > 0 {
+		return tf.info, nil
+	}
+	return tf.encodeInfo()
+}
 
-	params := url.Values{
-		"info_hash":  []string{string(tf.InfoSHA[:])},
-		"peer_id":    []string{string(peerId[:])},
-		"port":       []string{strconv.Itoa(peerPort)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(tf.FileLen)},
+func (tf *TorrentFile) encodeInfo() (benode.RawMessage, error) {
+	ri := &RawInfo{
+		Name:     tf.Name,
+		PieceLen: tf.PieceLen,
+		Source:   tf.Source,
+	}
+	if tf.Private {
+		ri.Private = 1
+	}
+	if tf.HasV1() {
+		if tf.IsMultiFile() {
+			ri.Files = make([]*RawFileInfo, len(tf.Files))
+			for i, f := range tf.Files {
+				ri.Files[i] = &RawFileInfo{Len: f.Length, Path: f.Path, Attr: f.Attr, SymlinkPath: f.SymlinkPath}
+				if f.SHA1 != [utils.SHALEN]byte{} {
+					ri.Files[i].SHA1 = string(f.SHA1[:])
+				}
+			}
+		} else {
+			ri.Len = tf.FileLen
+		}
+		pieces := make([]byte, 0, len(tf.PiecesSHA)*utils.SHALEN)
+		for _, p := range tf.PiecesSHA {
+			pieces = append(pieces, p[:]...)
+		}
+		ri.Pieces = string(pieces)
+	}
+	if tf.HasV2() {
+		ri.MetaVersion = 2
+		ri.FileTree = tf.fileTree()
 	}
 
-	base.RawQuery = params.Encode()
-	return base.String(), nil
+	node, err := benode.Marshal(ri)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = node.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
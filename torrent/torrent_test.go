@@ -1,9 +1,11 @@
 package torrent
 
 import (
-	"fmt"
+	"encoding/hex"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,6 +20,81 @@ func TestTorrentFile(t *testing.T) {
 
 	res, err := ParseTorrentFile(file)
 	assert.Nil(t, err)
-	fmt.Printf("res: %v\n", res)
 
+	assert.Equal(t, "28c55196f57753c40aceb6fb58617e6995a7eddb", hex.EncodeToString(res.InfoSHA[:]))
+	assert.Equal(t, res.InfoSHA, res.SwarmHash())
+	assert.Equal(t, "http://bttracker.debian.org:6969/announce", res.Announce)
+	assert.Equal(t, `"Debian CD from cdimage.debian.org"`, res.Comment)
+	assert.Equal(t, time.Unix(1639833767, 0), res.CreationDate)
+	assert.Equal(t, 2, len(res.HTTPSeeds))
+	assert.Equal(t, "debian-11.2.0-amd64-netinst.iso", res.Name)
+	assert.Equal(t, 396361728, res.FileLen)
+	assert.Equal(t, 262144, res.PieceLen)
+	assert.Equal(t, 1512, len(res.PiecesSHA))
+	assert.False(t, res.Private)
+	assert.False(t, res.IsMultiFile())
+	assert.Equal(t, [][]string{{res.Announce}}, res.Trackers())
+}
+
+func TestTorrentFileMeta(t *testing.T) {
+	info := `d5:filesld6:lengthi3e4:pathl1:a5:b.txteed6:lengthi5e4:pathl1:ceee` +
+		`4:name3:dir12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa` +
+		`7:privatei1e6:source3:SRCe`
+	input := `d8:announce4:tr-113:announce-listll4:tr-14:tr-2el4:tr-3ee` +
+		`7:comment2:hi10:created by2:me13:creation datei100e8:encoding5:UTF-8` +
+		`9:httpseedsl2:hse5:nodesll5:host1i6881eee8:url-list2:ws4:info` + info + `e`
+
+	res, err := ParseTorrentFile(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"tr-1", "tr-2"}, {"tr-3"}}, res.Trackers())
+	assert.Equal(t, "hi", res.Comment)
+	assert.Equal(t, "me", res.CreatedBy)
+	assert.Equal(t, "UTF-8", res.Encoding)
+	assert.Equal(t, time.Unix(100, 0), res.CreationDate)
+	assert.Equal(t, []string{"ws"}, res.URLList)
+	assert.Equal(t, []string{"hs"}, res.HTTPSeeds)
+	assert.Equal(t, []DHTNode{{Host: "host1", Port: 6881}}, res.Nodes)
+	assert.Equal(t, "host1:6881", res.Nodes[0].String())
+	assert.True(t, res.Private)
+	assert.Equal(t, "SRC", res.Source)
+	assert.True(t, res.IsMultiFile())
+	assert.Equal(t, []FileInfo{{Length: 3, Path: []string{"a", "b.txt"}}, {Length: 5, Path: []string{"c"}}}, res.Files)
+	assert.Equal(t, 8, res.FileLen)
+
+	// url-list given as a list
+	input = strings.Replace(input, "8:url-list2:ws", "8:url-listl2:w12:w2e", 1)
+	res, err = ParseTorrentFile(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"w1", "w2"}, res.URLList)
+}
+
+func TestTorrentFileNoInfo(t *testing.T) {
+	_, err := ParseTorrentFile(strings.NewReader(`d8:announce4:tr-1e`))
+	assert.NotNil(t, err)
+}
+
+func TestFileAttributes(t *testing.T) {
+	info := `d5:filesld4:attr1:x6:lengthi3e4:pathl3:runee` +
+		`d4:attr1:p6:lengthi5e4:pathl4:.pad1:5ee` +
+		`d4:attr1:l6:lengthi0e4:pathl4:linke4:sha120:bbbbbbbbbbbbbbbbbbbb12:symlink pathl3:runee` +
+		`e4:name3:dir12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae`
+	res, err := ParseTorrentFile(strings.NewReader(`d4:info` + info + `e`))
+	assert.Nil(t, err)
+	assert.True(t, res.Files[0].IsExecutable())
+	assert.False(t, res.Files[0].IsPadding())
+	assert.True(t, res.Files[1].IsPadding())
+	assert.True(t, res.Files[2].IsSymlink())
+	assert.False(t, res.Files[2].IsHidden())
+	assert.Equal(t, []string{"run"}, res.Files[2].SymlinkPath)
+	assert.Equal(t, "bbbbbbbbbbbbbbbbbbbb", string(res.Files[2].SHA1[:]))
+
+	// the attributes survive re-encoding the info dict
+	raw, err := res.encodeInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, info, string(raw))
+
+	// link targets must stay inside the torrent
+	input := strings.Replace(`d4:info`+info+`e`, "12:symlink pathl3:rune", "12:symlink pathl2:..e", 1)
+	_, err = ParseTorrentFile(strings.NewReader(input))
+	assert.NotNil(t, err)
 }
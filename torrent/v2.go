@@ -0,0 +1,464 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"tutorial/bt_demo/benode"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+// BlockLen is the leaf size of the v2 merkle trees, it is the
+// request size of the peer protocol
+const BlockLen = peer.BlockLen
+
+type hash256 = [utils.SHA256LEN]byte
+
+// Format selects the metainfo version written by Create
+type Format int
+
+const (
+	FormatV1 Format = iota
+	FormatV2
+	// FormatHybrid carries both v1 pieces and the v2 file tree (BEP 52)
+	FormatHybrid
+)
+
+// HasV1 reports whether the torrent carries v1 pieces
+func (tf *TorrentFile) HasV1() bool {
+	return tf.MetaVersion != 2 || len(tf.PiecesSHA) > 0
+}
+
+// HasV2 reports whether the torrent carries a v2 file tree
+func (tf *TorrentFile) HasV2() bool {
+	return tf.MetaVersion == 2
+}
+
+// setInfo stores the encoded info dict and derives the info hashes
+func (tf *TorrentFile) setInfo(info benode.RawMessage) {
+	tf.info = info
+	tf.InfoSHA = [utils.SHALEN]byte{}
+	if tf.HasV1() {
+		tf.InfoSHA = sha1.Sum(info)
+	}
+	if tf.HasV2() {
+		tf.InfoSHA256 = sha256.Sum256(info)
+		copy(tf.InfoSHAV2[:], tf.InfoSHA256[:])
+	}
+}
+
+// fileList returns the files of the torrent, a single file torrent
+// is returned as one file named after the torrent
+func (tf *TorrentFile) fileList() []FileInfo {
+	if tf.IsMultiFile() {
+		return tf.Files
+	}
+	return []FileInfo{{Length: tf.FileLen, Path: []string{tf.Name}, PiecesRoot: tf.PiecesRoot}}
+}
+
+// parseV2 reads the file tree and piece layers of a v2 or hybrid torrent
+func (tf *TorrentFile) parseV2(rf *RawFile, ri *RawInfo) error {
+	var files []FileInfo
+	if err := walkFileTree(ri.FileTree, nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("torrent: empty file tree")
+	}
+
+	single := len(ri.Files) == 0 && len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tf.Name
+	switch {
+	case single:
+		if tf.HasV1() && files[0].Length != tf.FileLen {
+			return fmt.Errorf("torrent: v1 and v2 length differ")
+		}
+		tf.FileLen = files[0].Length
+		tf.PiecesRoot = files[0].PiecesRoot
+	case !tf.HasV1():
+		tf.Files = files
+		tf.FileLen = 0
+		for _, f := range files {
+			tf.FileLen += f.Length
+		}
+	default:
+		// hybrid: the v1 files are the v2 files plus padding
+		idx := 0
+		for i := range tf.Files {
+			if tf.Files[i].IsPadding() {
+				continue
+			}
+			if idx >= len(files) || !sameFile(tf.Files[i], files[idx]) {
+				return fmt.Errorf("torrent: v1 and v2 file lists differ at %v", tf.Files[i].Path)
+			}
+			tf.Files[i].PiecesRoot = files[idx].PiecesRoot
+			idx++
+		}
+		if idx != len(files) {
+			return fmt.Errorf("torrent: v1 and v2 file lists differ")
+		}
+	}
+
+	if len(rf.PieceLayers) > 0 {
+		tf.PieceLayers = make(map[hash256][]hash256, len(rf.PieceLayers))
+	}
+	for k, v := range rf.PieceLayers {
+		if len(k) != utils.SHA256LEN || len(v)%utils.SHA256LEN != 0 {
+			return fmt.Errorf("torrent: invalid piece layer")
+		}
+		var root hash256
+		copy(root[:], k)
+		tf.PieceLayers[root] = splitHashes(utils.Bytes(v))
+	}
+	return nil
+}
+
+func sameFile(a, b FileInfo) bool {
+	if a.Length != b.Length || len(a.Path) != len(b.Path) {
+		return false
+	}
+	for i := range a.Path {
+		if a.Path[i] != b.Path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dictEntries accepts the map types a benode dict decodes to
+func dictEntries(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case map[string]any:
+		return m, true
+	case map[any]any:
+		res := make(map[string]any, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			res[key] = v
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+// walkFileTree flattens a "file tree" dict in key order, a file is
+// a dict holding its length and pieces root under the "" key
+func walkFileTree(tree map[string]any, prefix []string, files *[]FileInfo) error {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := append(append([]string{}, prefix...), name)
+		node, ok := dictEntries(tree[name])
+		if !ok {
+			return fmt.Errorf("torrent: invalid file tree node %v", path)
+		}
+		leaf, isFile := node[""]
+		if !isFile {
+			if err := walkFileTree(node, path, files); err != nil {
+				return err
+			}
+			continue
+		}
+		attrs, ok := dictEntries(leaf)
+		if !ok {
+			return fmt.Errorf("torrent: invalid file tree entry %v", path)
+		}
+		length, ok := attrs["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("torrent: invalid length of %v", path)
+		}
+		f := FileInfo{Length: int(length), Path: path}
+		if root, ok := attrs["pieces root"].(string); ok {
+			if len(root) != utils.SHA256LEN {
+				return fmt.Errorf("torrent: invalid pieces root of %v", path)
+			}
+			copy(f.PiecesRoot[:], root)
+		}
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+// fileTree builds the "file tree" dict from the non padding files
+func (tf *TorrentFile) fileTree() map[string]any {
+	tree := make(map[string]any)
+	for _, f := range tf.fileList() {
+		if f.IsPadding() {
+			continue
+		}
+		dir := tree
+		for _, elem := range f.Path[:len(f.Path)-1] {
+			sub, ok := dir[elem].(map[string]any)
+			if !ok {
+				sub = make(map[string]any)
+				dir[elem] = sub
+			}
+			dir = sub
+		}
+		attrs := map[string]any{"length": f.Length}
+		if f.Length > 0 {
+			attrs["pieces root"] = string(f.PiecesRoot[:])
+		}
+		dir[f.Path[len(f.Path)-1]] = map[string]any{"": attrs}
+	}
+	return tree
+}
+
+// withPadding inserts BEP 47 padding files so that every file
+// starts at a piece boundary
+func withPadding(files []FileInfo, pieceLen int) []FileInfo {
+	res := make([]FileInfo, 0, 2*len(files))
+	for i, f := range files {
+		res = append(res, f)
+		if rem := f.Length % pieceLen; i < len(files)-1 && rem != 0 {
+			pad := pieceLen - rem
+			res = append(res, FileInfo{
+				Length: pad,
+				Path:   []string{".pad", strconv.Itoa(pad)},
+				Attr:   "p",
+			})
+		}
+	}
+	return res
+}
+
+func nextPow2(n int) int {
+	res := 1
+	for res < n {
+		res *= 2
+	}
+	return res
+}
+
+// merkleRoot hashes the layer up to its root, the layer is padded
+// to width entries with pad
+func merkleRoot(layer []hash256, width int, pad hash256) hash256 {
+	nodes := make([]hash256, width)
+	copy(nodes, layer)
+	for i := len(layer); i < width; i++ {
+		nodes[i] = pad
+	}
+	var buf [2 * utils.SHA256LEN]byte
+	for len(nodes) > 1 {
+		for i := 0; i < len(nodes)/2; i++ {
+			copy(buf[:utils.SHA256LEN], nodes[2*i][:])
+			copy(buf[utils.SHA256LEN:], nodes[2*i+1][:])
+			nodes[i] = sha256.Sum256(buf[:])
+		}
+		nodes = nodes[:len(nodes)/2]
+	}
+	return nodes[0]
+}
+
+// hashBlocks returns the merkle leaves of data
+func hashBlocks(data []byte) []hash256 {
+	res := make([]hash256, 0, (len(data)+BlockLen-1)/BlockLen)
+	for off := 0; off < len(data); off += BlockLen {
+		end := off + BlockLen
+		if end > len(data) {
+			end = len(data)
+		}
+		res = append(res, sha256.Sum256(data[off:end]))
+	}
+	return res
+}
+
+// layerRoot computes a pieces root from its piece layer
+func layerRoot(layer []hash256, pieceLen int) hash256 {
+	pad := merkleRoot(nil, pieceLen/BlockLen, hash256{})
+	return merkleRoot(layer, nextPow2(len(layer)), pad)
+}
+
+// fileMerkle computes the pieces root of a file from its leaves, and
+// its piece layer when the file is larger than one piece
+func fileMerkle(blocks []hash256, pieceLen int) (root hash256, layer []hash256) {
+	if len(blocks) == 0 {
+		return root, nil
+	}
+	perPiece := pieceLen / BlockLen
+	if len(blocks) <= perPiece {
+		return merkleRoot(blocks, nextPow2(len(blocks)), hash256{}), nil
+	}
+	for off := 0; off < len(blocks); off += perPiece {
+		end := off + perPiece
+		if end > len(blocks) {
+			end = len(blocks)
+		}
+		layer = append(layer, merkleRoot(blocks[off:end], perPiece, hash256{}))
+	}
+	return layerRoot(layer, pieceLen), layer
+}
+
+func splitHashes(data []byte) []hash256 {
+	res := make([]hash256, len(data)/utils.SHA256LEN)
+	for i := range res {
+		copy(res[i][:], data[i*utils.SHA256LEN:])
+	}
+	return res
+}
+
+func joinHashes(hashes []hash256) []byte {
+	res := make([]byte, 0, len(hashes)*utils.SHA256LEN)
+	for _, h := range hashes {
+		res = append(res, h[:]...)
+	}
+	return res
+}
+
+type filePieceJob struct {
+	file  int
+	piece int
+	data  []byte
+}
+
+// createV2 hashes every file on its own into merkle trees, hybrid
+// torrents also get v1 pieces over the padded files
+func createV2(tf *TorrentFile, paths []string, opts CreateOptions) error {
+	if tf.PieceLen < BlockLen || tf.PieceLen&(tf.PieceLen-1) != 0 {
+		return fmt.Errorf("create: v2 piece length must be a power of two of at least %v", BlockLen)
+	}
+	hybrid := opts.Format == FormatHybrid
+	files := tf.fileList()
+	blocks, pieces, err := hashFilePieces(paths, files, tf.PieceLen, hybrid, opts.Workers, opts.Progress)
+	if err != nil {
+		return err
+	}
+
+	tf.MetaVersion = 2
+	for i := range files {
+		var layer []hash256
+		files[i].PiecesRoot, layer = fileMerkle(blocks[i], tf.PieceLen)
+		if layer != nil {
+			if tf.PieceLayers == nil {
+				tf.PieceLayers = make(map[hash256][]hash256)
+			}
+			tf.PieceLayers[files[i].PiecesRoot] = layer
+		}
+	}
+	if !tf.IsMultiFile() {
+		tf.PiecesRoot = files[0].PiecesRoot
+	}
+	if hybrid {
+		tf.PiecesSHA = pieces
+		if tf.IsMultiFile() {
+			tf.Files = withPadding(files, tf.PieceLen)
+			tf.FileLen = 0
+			for _, f := range tf.Files {
+				tf.FileLen += f.Length
+			}
+		}
+	}
+	return nil
+}
+
+// hashFilePieces returns the merkle leaves of every file, and for
+// hybrid torrents the v1 piece hashes with files padded to pieces
+func hashFilePieces(paths []string, files []FileInfo, pieceLen int, hybrid bool, workers int,
+	progress func(done, total int)) ([][]hash256, [][utils.SHALEN]byte, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	total := 0
+	blocks := make([][]hash256, len(files))
+	start := make([]int, len(files))
+	cnt := 0
+	for i, f := range files {
+		total += f.Length
+		blocks[i] = make([]hash256, (f.Length+BlockLen-1)/BlockLen)
+		start[i] = cnt
+		cnt += (f.Length + pieceLen - 1) / pieceLen
+	}
+	var pieces [][utils.SHALEN]byte
+	if hybrid {
+		pieces = make([][utils.SHALEN]byte, cnt)
+	}
+
+	jobs := make(chan filePieceJob, workers)
+	done := make(chan int, workers)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(jobs)
+		readErr <- readFilePieces(paths, files, pieceLen, jobs)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				leaves := hashBlocks(job.data)
+				copy(blocks[job.file][job.piece*pieceLen/BlockLen:], leaves)
+				if hybrid {
+					data := job.data
+					// every file but the last is followed by padding
+					if job.file < len(files)-1 && len(data) < pieceLen {
+						data = append(data, make([]byte, pieceLen-len(data))...)
+					}
+					pieces[start[job.file]+job.piece] = sha1.Sum(data)
+				}
+				done <- len(job.data)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	hashed := 0
+	for n := range done {
+		hashed += n
+		if progress != nil {
+			progress(hashed, total)
+		}
+	}
+	if err := <-readErr; err != nil {
+		return nil, nil, err
+	}
+	if hashed != total {
+		return nil, nil, fmt.Errorf("create: read %v bytes, expected %v", hashed, total)
+	}
+	return blocks, pieces, nil
+}
+
+func readFilePieces(paths []string, files []FileInfo, pieceLen int, jobs chan<- filePieceJob) error {
+	for i, p := range paths {
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		// files that changed since the walk are caught by the size check
+		rd := io.LimitReader(file, int64(files[i].Length))
+		for piece := 0; ; piece++ {
+			buf := make([]byte, pieceLen)
+			n, err := io.ReadFull(rd, buf)
+			if n > 0 {
+				jobs <- filePieceJob{file: i, piece: piece, data: buf[:n]}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestFileMerkle(t *testing.T) {
+	tests := []struct {
+		size     int
+		pieceLen int
+		root     string
+		layer    int
+	}{
+		{100000, 32 << 10, "00379f7bc54348817c1d9f3f2907b573e59dca4df25fe0b4eb2161ffae748f2b", 4},
+		{16384, 32 << 10, "582bf46c154f087f3ba98b298fbe978c18f8b60cae2d67d7cb5c233396744125", 0},
+		{20000, 64 << 10, "33c7fa0aba0df1291747b4c538a10019594bcf9474ed041d207ea2b9e90d19bf", 0},
+		{1, 16 << 10, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d", 0},
+		{40000, 16 << 10, "fac26c024b79547f3cba71f5f7d8b529997503683fc676f5a534b6feb8daccb8", 3},
+	}
+	for _, tt := range tests {
+		root, layer := fileMerkle(hashBlocks(testData(tt.size)), tt.pieceLen)
+		assert.Equal(t, tt.root, hex.EncodeToString(root[:]), "size %v", tt.size)
+		assert.Equal(t, tt.layer, len(layer))
+		if len(layer) > 0 {
+			assert.Equal(t, root, layerRoot(layer, tt.pieceLen))
+		}
+	}
+	root, layer := fileMerkle(nil, 16<<10)
+	assert.Equal(t, hash256{}, root)
+	assert.Nil(t, layer)
+}
+
+func roundTrip(t *testing.T, tf *TorrentFile) *TorrentFile {
+	var buf bytes.Buffer
+	assert.Nil(t, tf.Write(&buf))
+	res, err := ParseTorrentFile(&buf)
+	assert.Nil(t, err)
+	return res
+}
+
+func TestCreateV2Single(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	writeTestFile(t, path, 100000)
+
+	tf, err := Create(CreateOptions{Path: path, PieceLen: 32 << 10, Format: FormatV2})
+	assert.Nil(t, err)
+	assert.False(t, tf.HasV1())
+	assert.True(t, tf.HasV2())
+	assert.Equal(t, [20]byte{}, tf.InfoSHA)
+	assert.Equal(t, sha256.Sum256(tf.info), tf.InfoSHA256)
+	assert.Equal(t, tf.InfoSHA256[:20], tf.InfoSHAV2[:])
+	assert.Equal(t, tf.InfoSHAV2, tf.SwarmHash())
+	assert.Equal(t, "00379f7bc54348817c1d9f3f2907b573e59dca4df25fe0b4eb2161ffae748f2b", hex.EncodeToString(tf.PiecesRoot[:]))
+	assert.Equal(t, 4, len(tf.PieceLayers[tf.PiecesRoot]))
+	assert.Empty(t, tf.PiecesSHA)
+	assert.NotContains(t, string(tf.info), "6:pieces")
+
+	res := roundTrip(t, tf)
+	assert.Equal(t, 2, res.MetaVersion)
+	assert.Equal(t, tf.InfoSHA256, res.InfoSHA256)
+	assert.Equal(t, tf.PiecesRoot, res.PiecesRoot)
+	assert.Equal(t, tf.PieceLayers, res.PieceLayers)
+	assert.Equal(t, 100000, res.FileLen)
+	assert.False(t, res.IsMultiFile())
+}
+
+func TestCreateV2Dir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	writeTestFile(t, filepath.Join(root, "a.bin"), 40000)
+	writeTestFile(t, filepath.Join(root, "a", "b.bin"), 1)
+	writeTestFile(t, filepath.Join(root, "empty"), 0)
+
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 16 << 10, Format: FormatV2})
+	assert.Nil(t, err)
+	// path elements sort before longer names
+	assert.Equal(t, [][]string{{"a", "b.bin"}, {"a.bin"}, {"empty"}}, paths(tf.Files))
+
+	res := roundTrip(t, tf)
+	assert.Equal(t, tf.Files, res.Files)
+	assert.Equal(t, 40001, res.FileLen)
+	assert.Equal(t, "fac26c024b79547f3cba71f5f7d8b529997503683fc676f5a534b6feb8daccb8", hex.EncodeToString(res.Files[1].PiecesRoot[:]))
+	assert.Equal(t, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d", hex.EncodeToString(res.Files[0].PiecesRoot[:]))
+	assert.Equal(t, hash256{}, res.Files[2].PiecesRoot)
+
+	// a broken piece layer is rejected
+	res.PieceLayers[res.Files[1].PiecesRoot][0][0] ^= 1
+	var verr *ValidationError
+	assert.True(t, errors.As(Validate(res).Err(), &verr))
+	assert.Equal(t, "piece layers", verr.Problems[0].Field)
+}
+
+func paths(files []FileInfo) (res [][]string) {
+	for _, f := range files {
+		res = append(res, f.Path)
+	}
+	return res
+}
+
+func TestCreateHybrid(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	a := writeTestFile(t, filepath.Join(root, "a.bin"), 20000)
+	b := writeTestFile(t, filepath.Join(root, "b.bin"), 40000)
+
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 16 << 10, Format: FormatHybrid})
+	assert.Nil(t, err)
+	assert.True(t, tf.HasV1())
+	assert.True(t, tf.HasV2())
+	assert.Equal(t, sha1.Sum(tf.info), tf.InfoSHA)
+	assert.Equal(t, sha256.Sum256(tf.info), tf.InfoSHA256)
+
+	// a.bin is padded to two pieces
+	assert.Equal(t, 3, len(tf.Files))
+	assert.True(t, tf.Files[1].IsPadding())
+	assert.Equal(t, []string{".pad", "12768"}, tf.Files[1].Path)
+	assert.Equal(t, 32768+40000, tf.FileLen)
+	assert.Equal(t, 5, len(tf.PiecesSHA))
+	padded := append(append([]byte{}, a[16384:]...), make([]byte, 12768)...)
+	assert.Equal(t, sha1.Sum(padded), tf.PiecesSHA[1])
+	assert.Equal(t, sha1.Sum(b[:16384]), tf.PiecesSHA[2])
+	assert.Equal(t, sha1.Sum(b[32768:]), tf.PiecesSHA[4])
+
+	res := roundTrip(t, tf)
+	assert.Equal(t, tf.InfoSHA, res.InfoSHA)
+	assert.Equal(t, tf.InfoSHAV2, res.InfoSHAV2)
+	assert.Equal(t, tf.Files, res.Files)
+	assert.Equal(t, tf.PiecesSHA, res.PiecesSHA)
+
+	// unaligned files break the hybrid layout
+	res.Files = append(res.Files[:1], res.Files[2:]...)
+	res.FileLen = 60000
+	res.PiecesSHA = res.PiecesSHA[:4]
+	assert.NotNil(t, Validate(res).Err())
+}
+
+func TestCreateV2PieceLen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	writeTestFile(t, path, 1000)
+	_, err := Create(CreateOptions{Path: path, PieceLen: 20000, Format: FormatV2})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,271 @@
+package torrent
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"tutorial/bt_demo/utils"
+)
+
+type Level int
+
+const (
+	LevelWarning Level = iota
+	LevelError
+)
+
+func (l Level) String() string {
+	if l == LevelError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem is one finding of Validate, Field names the metainfo key
+type Problem struct {
+	Level   Level
+	Field   string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v: %v: %v", p.Level, p.Field, p.Message)
+}
+
+type Report []Problem
+
+func (r Report) filter(level Level) (res []Problem) {
+	for _, p := range r {
+		if p.Level == level {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (r Report) Errors() []Problem {
+	return r.filter(LevelError)
+}
+
+func (r Report) Warnings() []Problem {
+	return r.filter(LevelWarning)
+}
+
+// Err returns a *ValidationError when the report has errors
+func (r Report) Err() error {
+	if errs := r.Errors(); len(errs) > 0 {
+		return &ValidationError{Problems: errs}
+	}
+	return nil
+}
+
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Field + ": " + p.Message
+	}
+	return "torrent: invalid metainfo: " + strings.Join(msgs, "; ")
+}
+
+type validator struct {
+	report Report
+}
+
+func (v *validator) errorf(field, format string, args ...any) {
+	v.report = append(v.report, Problem{LevelError, field, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(field, format string, args ...any) {
+	v.report = append(v.report, Problem{LevelWarning, field, fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the torrent for inconsistencies. Errors make the
+// torrent unusable, warnings are suspicious but legal.
+func Validate(tf *TorrentFile) Report {
+	v := &validator{}
+	v.checkInfo(tf)
+	v.checkTrackers(tf)
+	return v.report
+}
+
+func (v *validator) checkInfo(tf *TorrentFile) {
+	if tf.Name == "" {
+		v.errorf("info.name", "empty name")
+	} else if err := checkPathElem(tf.Name); err != "" {
+		v.errorf("info.name", "%v %q", err, tf.Name)
+	}
+
+	// 0 is a v1 torrent built in code
+	if tf.MetaVersion < 0 || tf.MetaVersion > 2 {
+		v.errorf("info.meta version", "unsupported version %v", tf.MetaVersion)
+	}
+
+	if tf.PieceLen <= 0 {
+		v.errorf("info.piece length", "must be positive, got %v", tf.PieceLen)
+	} else if tf.HasV2() {
+		if tf.PieceLen&(tf.PieceLen-1) != 0 || tf.PieceLen < BlockLen {
+			v.errorf("info.piece length", "%v is not a power of two of at least %v", tf.PieceLen, BlockLen)
+		}
+	} else {
+		if tf.PieceLen&(tf.PieceLen-1) != 0 {
+			v.errorf("info.piece length", "%v is not a power of two", tf.PieceLen)
+		}
+		if tf.PieceLen < minPieceLen {
+			v.warnf("info.piece length", "%v is below %v", tf.PieceLen, minPieceLen)
+		}
+	}
+
+	if tf.IsMultiFile() {
+		seen := make(map[string]int, len(tf.Files))
+		for i, f := range tf.Files {
+			field := fmt.Sprintf("info.files[%d]", i)
+			if f.Length < 0 {
+				v.errorf(field+".length", "negative length %v", f.Length)
+			}
+			if len(f.Path) == 0 {
+				v.errorf(field+".path", "empty path")
+				continue
+			}
+			for _, elem := range f.Path {
+				if err := checkPathElem(elem); err != "" {
+					v.errorf(field+".path", "%v %q", err, elem)
+				}
+			}
+			if f.IsSymlink() {
+				if len(f.SymlinkPath) == 0 {
+					v.errorf(field+".symlink path", "missing link target")
+				}
+				for _, elem := range f.SymlinkPath {
+					if err := checkPathElem(elem); err != "" {
+						v.errorf(field+".symlink path", "%v %q", err, elem)
+					}
+				}
+			}
+			key := strings.Join(f.Path, "/")
+			if f.IsPadding() {
+				continue
+			}
+			if j, ok := seen[key]; ok {
+				v.errorf(field+".path", "duplicates info.files[%d] %q", j, key)
+			}
+			seen[key] = i
+		}
+	}
+	if tf.FileLen <= 0 {
+		v.errorf("info.length", "must be positive, got %v", tf.FileLen)
+	}
+
+	if tf.HasV1() {
+		if tf.piecesLen%utils.SHALEN != 0 {
+			v.errorf("info.pieces", "length %v is not a multiple of %v", tf.piecesLen, utils.SHALEN)
+		}
+		if tf.PieceLen > 0 && tf.FileLen > 0 {
+			if want := (tf.FileLen + tf.PieceLen - 1) / tf.PieceLen; want != len(tf.PiecesSHA) {
+				v.errorf("info.pieces", "has %v hashes, %v bytes need %v", len(tf.PiecesSHA), tf.FileLen, want)
+			}
+		}
+	}
+	if tf.HasV2() && tf.PieceLen >= BlockLen {
+		v.checkV2(tf)
+	}
+}
+
+// checkV2 checks the pieces roots against the piece layers
+func (v *validator) checkV2(tf *TorrentFile) {
+	offset := 0
+	for i, f := range tf.fileList() {
+		field := fmt.Sprintf("info.files[%d]", i)
+		if !tf.IsMultiFile() {
+			field = "info"
+		}
+		// hybrid torrents pad every file to a piece boundary
+		if tf.HasV1() && !f.IsPadding() && offset%tf.PieceLen != 0 {
+			v.errorf(field, "file does not start at a piece boundary")
+		}
+		offset += f.Length
+		if f.IsPadding() || f.Length == 0 {
+			continue
+		}
+		if f.PiecesRoot == (hash256{}) {
+			v.errorf(field+".pieces root", "missing pieces root")
+			continue
+		}
+		if f.Length <= tf.PieceLen {
+			continue
+		}
+		layer, ok := tf.PieceLayers[f.PiecesRoot]
+		if !ok {
+			v.errorf("piece layers", "missing layer of %x", f.PiecesRoot)
+			continue
+		}
+		if want := (f.Length + tf.PieceLen - 1) / tf.PieceLen; len(layer) != want {
+			v.errorf("piece layers", "layer of %x has %v hashes, need %v", f.PiecesRoot, len(layer), want)
+		} else if layerRoot(layer, tf.PieceLen) != f.PiecesRoot {
+			v.errorf("piece layers", "layer of %x does not match its root", f.PiecesRoot)
+		}
+	}
+}
+
+// checkPathElem rejects names that would escape the download dir
+func checkPathElem(elem string) string {
+	switch {
+	case elem == "":
+		return "empty path element"
+	case elem == "." || elem == "..":
+		return "relative path element"
+	case strings.ContainsAny(elem, "/\\\x00"):
+		return "separator or NUL in path element"
+	case len(elem) >= 2 && elem[1] == ':':
+		return "drive letter in path element"
+	}
+	return ""
+}
+
+func (v *validator) checkTrackers(tf *TorrentFile) {
+	if tf.Announce != "" {
+		v.checkURL("announce", tf.Announce, "http", "https", "udp")
+	}
+	for i, tier := range tf.AnnounceList {
+		if len(tier) == 0 {
+			v.warnf(fmt.Sprintf("announce-list[%d]", i), "empty tier")
+		}
+		for j, u := range tier {
+			v.checkURL(fmt.Sprintf("announce-list[%d][%d]", i, j), u, "http", "https", "udp")
+		}
+	}
+	for i, u := range tf.URLList {
+		v.checkURL(fmt.Sprintf("url-list[%d]", i), u, "http", "https", "ftp")
+	}
+	for i, u := range tf.HTTPSeeds {
+		v.checkURL(fmt.Sprintf("httpseeds[%d]", i), u, "http", "https")
+	}
+
+	if len(tf.Trackers()) == 0 {
+		if tf.Private {
+			v.warnf("announce", "private torrent without trackers")
+		} else if len(tf.Nodes) == 0 && len(tf.URLList) == 0 && len(tf.HTTPSeeds) == 0 {
+			v.warnf("announce", "no trackers, nodes or web seeds")
+		}
+	}
+}
+
+func (v *validator) checkURL(field, link string, schemes ...string) {
+	u, err := url.Parse(link)
+	if err != nil {
+		v.warnf(field, "invalid url %q", link)
+		return
+	}
+	for _, s := range schemes {
+		if u.Scheme == s {
+			if u.Host == "" {
+				v.warnf(field, "missing host in %q", link)
+			}
+			return
+		}
+	}
+	v.warnf(field, "unsupported scheme in %q", link)
+}
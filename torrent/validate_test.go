@@ -0,0 +1,123 @@
+package torrent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validTorrent() *TorrentFile {
+	return &TorrentFile{
+		Announce:  "http://tracker/announce",
+		Name:      "data",
+		FileLen:   40000,
+		PieceLen:  16 << 10,
+		PiecesSHA: make([][20]byte, 3),
+		piecesLen: 60,
+	}
+}
+
+func fields(problems []Problem) (res []string) {
+	for _, p := range problems {
+		res = append(res, p.Field)
+	}
+	return res
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(tf *TorrentFile)
+		errors   []string
+		warnings []string
+	}{
+		{"valid", func(tf *TorrentFile) {}, nil, nil},
+		{"empty name", func(tf *TorrentFile) { tf.Name = "" }, []string{"info.name"}, nil},
+		{"unsafe name", func(tf *TorrentFile) { tf.Name = "../x" }, []string{"info.name"}, nil},
+		{"zero piece length", func(tf *TorrentFile) { tf.PieceLen = 0 }, []string{"info.piece length"}, nil},
+		{"odd piece length", func(tf *TorrentFile) {
+			tf.PieceLen = 20000
+			tf.PiecesSHA = make([][20]byte, 2)
+		}, []string{"info.piece length"}, nil},
+		{"small piece length", func(tf *TorrentFile) {
+			tf.PieceLen = 8 << 10
+			tf.PiecesSHA = make([][20]byte, 5)
+		}, nil, []string{"info.piece length"}},
+		{"truncated pieces", func(tf *TorrentFile) { tf.piecesLen = 59 }, []string{"info.pieces"}, nil},
+		{"missing pieces", func(tf *TorrentFile) { tf.PiecesSHA = tf.PiecesSHA[:2] }, []string{"info.pieces"}, nil},
+		{"extra pieces", func(tf *TorrentFile) { tf.PiecesSHA = make([][20]byte, 4) }, []string{"info.pieces"}, nil},
+		{"empty", func(tf *TorrentFile) {
+			tf.FileLen = 0
+			tf.PiecesSHA = nil
+		}, []string{"info.length"}, nil},
+		{"unsafe paths", func(tf *TorrentFile) {
+			tf.Files = []FileInfo{
+				{Length: 10000, Path: []string{"a", ".."}},
+				{Length: 10000, Path: nil},
+				{Length: 10000, Path: []string{"b/c"}},
+				{Length: 10000, Path: []string{"C:x"}},
+			}
+		}, []string{"info.files[0].path", "info.files[1].path", "info.files[2].path", "info.files[3].path"}, nil},
+		{"duplicate paths", func(tf *TorrentFile) {
+			tf.Files = []FileInfo{{Length: 20000, Path: []string{"a", "b"}}, {Length: 20000, Path: []string{"a", "b"}}}
+		}, []string{"info.files[1].path"}, nil},
+		{"negative length", func(tf *TorrentFile) {
+			tf.Files = []FileInfo{{Length: -1, Path: []string{"a"}}, {Length: 40001, Path: []string{"b"}}}
+		}, []string{"info.files[0].length"}, nil},
+		{"bad trackers", func(tf *TorrentFile) {
+			tf.Announce = "ftp://x/announce"
+			tf.AnnounceList = [][]string{{}, {"udp://"}}
+			tf.URLList = []string{"::"}
+		}, nil, []string{"announce", "announce-list[0]", "announce-list[1][0]", "url-list[0]"}},
+		{"trackerless", func(tf *TorrentFile) { tf.Announce = "" }, nil, []string{"announce"}},
+		{"dht only", func(tf *TorrentFile) {
+			tf.Announce = ""
+			tf.Nodes = []DHTNode{{"router", 6881}}
+		}, nil, nil},
+		{"private without trackers", func(tf *TorrentFile) {
+			tf.Announce = ""
+			tf.Nodes = []DHTNode{{"router", 6881}}
+			tf.Private = true
+		}, nil, []string{"announce"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := validTorrent()
+			tt.modify(tf)
+			report := Validate(tf)
+			assert.Equal(t, tt.errors, fields(report.Errors()))
+			assert.Equal(t, tt.warnings, fields(report.Warnings()))
+
+			err := report.Err()
+			if len(tt.errors) == 0 {
+				assert.Nil(t, err)
+				return
+			}
+			var verr *ValidationError
+			assert.True(t, errors.As(err, &verr))
+			assert.Equal(t, len(tt.errors), len(verr.Problems))
+		})
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	// 19 bytes of pieces: a truncated torrent
+	input := `d8:announce4:tr-14:infod6:lengthi8e4:name1:a12:piece lengthi16384e6:pieces19:aaaaaaaaaaaaaaaaaaaee`
+	_, err := ParseTorrentFile(strings.NewReader(input))
+	var verr *ValidationError
+	assert.True(t, errors.As(err, &verr))
+	assert.Equal(t, "info.pieces", verr.Problems[0].Field)
+
+	tf, err := ParseTorrentFileUnchecked(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.NotNil(t, Validate(tf).Err())
+	// piece lengths must be powers of two
+	input = `d8:announce4:tr-14:infod6:lengthi8e4:name1:a12:piece lengthi20000e6:pieces20:aaaaaaaaaaaaaaaaaaaaee`
+	_, err = ParseTorrentFile(strings.NewReader(input))
+	assert.True(t, errors.As(err, &verr))
+	assert.Equal(t, "info.piece length", verr.Problems[0].Field)
+	_, err = ParseTorrentFileUnchecked(strings.NewReader(input))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"runtime"
+	"sync"
+	"tutorial/bt_demo/utils"
+)
+
+type VerifyResult struct {
+	// Pieces has a bit set for every piece matching PiecesSHA
+	Pieces utils.Bitfield
+	Valid  int
+	// Files is the completion of every file in percent
+	Files []float64
+}
+
+// Verify hashes the data of tf found below root and checks it
+// against PiecesSHA, missing or short files fail their pieces
+func Verify(tf *TorrentFile, root string) (*VerifyResult, error) {
+	if !tf.HasV1() || tf.PieceLen <= 0 {
+		return nil, fmt.Errorf("verify: torrent has no v1 pieces")
+	}
+	st := newStorage(tf, root)
+	cnt := len(tf.PiecesSHA)
+	res := &VerifyResult{Pieces: utils.NewBitfield(cnt)}
+
+	jobs := make(chan int)
+	valid := make([]bool, cnt)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, tf.PieceLen)
+			for i := range jobs {
+				data := buf[:tf.PieceSize(i)]
+				if err := st.readPiece(i, data); err != nil {
+					continue
+				}
+				valid[i] = sha1.Sum(data) == tf.PiecesSHA[i]
+			}
+		}()
+	}
+	for i := 0; i < cnt; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, ok := range valid {
+		if ok {
+			res.Pieces.Set(i)
+			res.Valid++
+		}
+	}
+	for file := range st.paths {
+		res.Files = append(res.Files, fileCompletion(tf, valid, file))
+	}
+	return res, nil
+}
+
+// fileCompletion returns the percent of the file covered by
+// valid pieces
+func fileCompletion(tf *TorrentFile, valid []bool, file int) float64 {
+	begin, end := tf.FileByteRange(file)
+	if begin == end {
+		return 100
+	}
+	done := 0
+	first, last := tf.FilePieceRange(file)
+	for i := first; i < last && i < len(valid); i++ {
+		if !valid[i] {
+			continue
+		}
+		for _, r := range tf.PieceFileRanges(i) {
+			if r.File == file {
+				done += r.Length
+			}
+		}
+	}
+	return float64(done) * 100 / float64(end-begin)
+}
@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySingleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	writeTestFile(t, path, 40000)
+	tf, err := Create(CreateOptions{Path: path, PieceLen: 16 << 10})
+	assert.Nil(t, err)
+
+	res, err := Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Valid)
+	assert.Equal(t, []float64{100}, res.Files)
+
+	// truncated data fails the last piece
+	assert.Nil(t, os.Truncate(path, 39999))
+	res, err = Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Valid)
+	assert.True(t, res.Pieces.Has(1))
+	assert.False(t, res.Pieces.Has(2))
+	assert.InDelta(t, 32768*100/40000.0, res.Files[0], 1e-9)
+}
+
+func TestVerifyDir(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "share")
+	writeTestFile(t, filepath.Join(root, "a.bin"), 20000)
+	writeTestFile(t, filepath.Join(root, "b", "c.bin"), 30000)
+	writeTestFile(t, filepath.Join(root, "d.bin"), 0)
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 16 << 10})
+	assert.Nil(t, err)
+
+	res, err := Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, res.Valid)
+	assert.Equal(t, []float64{100, 100, 100}, res.Files)
+
+	// piece 1 spans both files
+	f, err := os.OpenFile(filepath.Join(root, "b", "c.bin"), os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	res, err = Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, res.Valid)
+	assert.False(t, res.Pieces.Has(1))
+	assert.InDelta(t, 16384*100/20000.0, res.Files[0], 1e-9)
+	assert.InDelta(t, (30000-(32768-20000))*100/30000.0, res.Files[1], 1e-9)
+
+	// a missing file fails all its pieces
+	assert.Nil(t, os.Remove(filepath.Join(root, "a.bin")))
+	res, err = Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, res.Valid)
+	assert.Equal(t, float64(0), res.Files[0])
+}
+
+func TestVerifyV2Only(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	writeTestFile(t, path, 1000)
+	tf, err := Create(CreateOptions{Path: path, Format: FormatV2})
+	assert.Nil(t, err)
+	_, err = Verify(tf, filepath.Dir(path))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyPadding(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "share")
+	writeTestFile(t, filepath.Join(root, "a.bin"), 20000)
+	writeTestFile(t, filepath.Join(root, "b.bin"), 30000)
+	tf, err := Create(CreateOptions{Path: root, PieceLen: 16 << 10, Format: FormatHybrid})
+	assert.Nil(t, err)
+	assert.True(t, tf.Files[1].IsPadding())
+
+	// padding files are zeros and are not on disk
+	res, err := Verify(tf, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(tf.PiecesSHA), res.Valid)
+	assert.Equal(t, []float64{100, 100, 100}, res.Files)
+	_, err = os.Stat(filepath.Join(root, ".pad"))
+	assert.True(t, os.IsNotExist(err))
+}
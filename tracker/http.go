@@ -0,0 +1,224 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tutorial/bt_demo/benode"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	// maxResponseLen bounds the tracker reply we are willing to read
+	maxResponseLen = 1 << 20
+)
+
+type rawResponse struct {
+	FailureReason string     `benode:"failure reason"`
+	Warning       string     `benode:"warning message"`
+	Interval      int        `benode:"interval"`
+	MinInterval   int        `benode:"min interval"`
+	TrackerID     string     `benode:"tracker id"`
+	Complete      int        `benode:"complete"`
+	Incomplete    int        `benode:"incomplete"`
+	Peers         peer.List  `benode:"peers"`
+	Peers6        peer.List6 `benode:"peers6"`
+}
+
+type rawScrape struct {
+	FailureReason string                   `benode:"failure reason,omitempty"`
+	Files         map[string]rawScrapeFile `benode:"files"`
+}
+
+type rawScrapeFile struct {
+	Complete   int `benode:"complete"`
+	Incomplete int `benode:"incomplete"`
+	Downloaded int `benode:"downloaded"`
+}
+
+// HTTPClient announces to an http or https tracker
+type HTTPClient struct {
+	URL    string
+	Client *http.Client
+
+	mu sync.Mutex
+	// trackerID is echoed back once the tracker sent one
+	trackerID string
+}
+
+func NewHTTPClient(announce string) *HTTPClient {
+	return &HTTPClient{URL: announce, Client: http.DefaultClient}
+}
+
+func (c *HTTPClient) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	c.mu.Lock()
+	trackerID := c.trackerID
+	c.mu.Unlock()
+
+	link, err := buildUrl(c.URL, req, trackerID)
+	if err != nil {
+		return nil, err
+	}
+	raw := &rawResponse{}
+	status, err := c.get(ctx, link, raw)
+	if err != nil {
+		return nil, err
+	}
+	// failures may come with any status code
+	if raw.FailureReason != "" {
+		return nil, &FailureError{Reason: raw.FailureReason}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("tracker: %v %v", status, http.StatusText(status))
+	}
+
+	if raw.TrackerID != "" {
+		c.mu.Lock()
+		c.trackerID = raw.TrackerID
+		c.mu.Unlock()
+	}
+	res := &AnnounceResponse{
+		Interval:    time.Duration(raw.Interval) * time.Second,
+		MinInterval: time.Duration(raw.MinInterval) * time.Second,
+		Complete:    raw.Complete,
+		Incomplete:  raw.Incomplete,
+		Warning:     raw.Warning,
+	}
+	res.Peers = append(res.Peers, raw.Peers...)
+	res.Peers = append(res.Peers, raw.Peers6...)
+	return res, nil
+}
+
+// Scrape asks for the swarm counts of the info hashes in a single
+// request (BEP 48)
+func (c *HTTPClient) Scrape(ctx context.Context, hashes [][utils.SHALEN]byte) (map[[utils.SHALEN]byte]ScrapeStats, error) {
+	link, err := ScrapeURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	for _, h := range hashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	base.RawQuery = params.Encode()
+
+	raw := &rawScrape{}
+	status, err := c.get(ctx, base.String(), raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw.FailureReason != "" {
+		return nil, &FailureError{Reason: raw.FailureReason}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("tracker: %v %v", status, http.StatusText(status))
+	}
+	res := make(map[[utils.SHALEN]byte]ScrapeStats, len(raw.Files))
+	for key, f := range raw.Files {
+		if len(key) != utils.SHALEN {
+			return nil, fmt.Errorf("tracker: invalid info hash %x in scrape", key)
+		}
+		var h [utils.SHALEN]byte
+		copy(h[:], key)
+		res[h] = ScrapeStats{Complete: f.Complete, Incomplete: f.Incomplete, Downloaded: f.Downloaded}
+	}
+	return res, nil
+}
+
+// ScrapeURL derives the scrape url from an announce url, it only
+// exists if the last path element starts with announce
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	last := u.Path[i+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + last[len("announce"):]
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// get sends the request and decodes the bencoded body into res, it
+// returns the status code for the caller to check after the failure
+// reason
+func (c *HTTPClient) get(ctx context.Context, link string, res any) (int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.Client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("tracker: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseLen))
+	if err != nil {
+		return 0, fmt.Errorf("tracker: %w", err)
+	}
+	node, err := benode.Parse(bufio.NewReader(bytes.NewReader(body)))
+	if err == nil {
+		err = node.Decode(res)
+	}
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("tracker: %v", resp.Status)
+		}
+		return 0, fmt.Errorf("tracker: invalid response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// buildUrl adds the announce parameters to the tracker url, keeping
+// its own query, e.g. a passkey
+func buildUrl(announce string, req *AnnounceRequest, trackerID string) (link string, err error) {
+	peerId, port := req.identity()
+
+	base, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return "", fmt.Errorf("tracker: unsupported scheme %q", base.Scheme)
+	}
+
+	params := base.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(peerId[:]))
+	params.Set("port", strconv.Itoa(port))
+	params.Set("uploaded", strconv.Itoa(req.Uploaded))
+	params.Set("downloaded", strconv.Itoa(req.Downloaded))
+	params.Set("left", strconv.Itoa(req.Left))
+	params.Set("compact", "1")
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+	if req.NumWant > 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != 0 {
+		params.Set("key", strconv.FormatUint(uint64(req.Key), 16))
+	}
+	if trackerID != "" {
+		params.Set("trackerid", trackerID)
+	}
+
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
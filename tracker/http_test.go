@@ -0,0 +1,205 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"tutorial/bt_demo/peer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testServer(t *testing.T, handler func(q url.Values) string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, handler(r.URL.Query()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	req := &AnnounceRequest{Port: 6881, Left: 1000, Uploaded: 10, Event: EventStarted, NumWant: 50}
+	copy(req.InfoHash[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(req.PeerID[:], "-SB0100-bbbbbbbbbbbb")
+
+	var got url.Values
+	peers := string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 192, 168, 1, 2, 0, 80})
+	srv := testServer(t, func(q url.Values) string {
+		got = q
+		return fmt.Sprintf("d8:completei5e10:incompletei3e8:intervali1800e12:min intervali60e"+
+			"5:peers%d:%s10:tracker id3:xyz15:warning message4:slowe", len(peers), peers)
+	})
+
+	c := NewHTTPClient(srv.URL + "/announce?passkey=k")
+	res, err := c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "aaaaaaaaaaaaaaaaaaaa", got.Get("info_hash"))
+	assert.Equal(t, "-SB0100-bbbbbbbbbbbb", got.Get("peer_id"))
+	assert.Equal(t, "6881", got.Get("port"))
+	assert.Equal(t, "10", got.Get("uploaded"))
+	assert.Equal(t, "0", got.Get("downloaded"))
+	assert.Equal(t, "1000", got.Get("left"))
+	assert.Equal(t, "1", got.Get("compact"))
+	assert.Equal(t, "started", got.Get("event"))
+	assert.Equal(t, "50", got.Get("numwant"))
+	assert.Equal(t, "k", got.Get("passkey"))
+	assert.Equal(t, "", got.Get("trackerid"))
+
+	assert.Equal(t, 1800*time.Second, res.Interval)
+	assert.Equal(t, 60*time.Second, res.MinInterval)
+	assert.Equal(t, 5, res.Complete)
+	assert.Equal(t, 3, res.Incomplete)
+	assert.Equal(t, "slow", res.Warning)
+	assert.Equal(t, 2, len(res.Peers))
+	assert.Equal(t, "10.0.0.1:6881", res.Peers[0].String())
+	assert.Equal(t, "192.168.1.2:80", res.Peers[1].String())
+
+	// the tracker id is sent back, regular announces have no event
+	req.Event = EventNone
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "xyz", got.Get("trackerid"))
+	_, ok := got["event"]
+	assert.False(t, ok)
+}
+
+func TestHTTPAnnounceDefaults(t *testing.T) {
+	var got url.Values
+	srv := testServer(t, func(q url.Values) string {
+		got = q
+		return "d8:intervali900ee"
+	})
+	c := NewHTTPClient(srv.URL)
+	for i := 0; i < 2; i++ {
+		_, err := c.Announce(context.Background(), &AnnounceRequest{})
+		assert.Nil(t, err)
+		// the id is generated once for the process
+		assert.Equal(t, peer.DefaultPeerID().String(), got.Get("peer_id"))
+		assert.Equal(t, "6667", got.Get("port"))
+	}
+}
+
+func TestHTTPAnnounceDictPeers(t *testing.T) {
+	srv := testServer(t, func(q url.Values) string {
+		return "d8:intervali900e5:peersld2:ip9:127.0.0.17:peer id20:cccccccccccccccccccc4:porti6881eed2:ip3:::14:porti1eeee"
+	})
+	res, err := NewHTTPClient(srv.URL).Announce(context.Background(), &AnnounceRequest{Event: EventCompleted})
+	assert.Nil(t, err)
+	assert.Equal(t, []peer.Addr{
+		{IP: net.ParseIP("127.0.0.1"), Port: 6881, ID: []byte("cccccccccccccccccccc")},
+		{IP: net.ParseIP("::1"), Port: 1},
+	}, res.Peers)
+	assert.Equal(t, "[::1]:1", res.Peers[1].String())
+
+	// IPv6 peers follow the IPv4 ones
+	peers6 := string(peer.Addr{IP: net.ParseIP("::2"), Port: 2}.Compact())
+	srv = testServer(t, func(q url.Values) string {
+		return "d8:intervali900e5:peers6:\x7f\x00\x00\x01\x00\x016:peers618:" + peers6 + "e"
+	})
+	res, err = NewHTTPClient(srv.URL).Announce(context.Background(), &AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:1", res.Peers[0].String())
+	assert.Equal(t, "[::2]:2", res.Peers[1].String())
+}
+
+func TestHTTPAnnounceFailure(t *testing.T) {
+	srv := testServer(t, func(q url.Values) string {
+		return "d14:failure reason12:unregisterede"
+	})
+	_, err := NewHTTPClient(srv.URL).Announce(context.Background(), &AnnounceRequest{Event: EventStopped})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unregistered", failure.Reason)
+
+	srv = testServer(t, func(q url.Values) string { return "not bencode" })
+	_, err = NewHTTPClient(srv.URL).Announce(context.Background(), &AnnounceRequest{})
+	assert.NotNil(t, err)
+
+	srv = testServer(t, func(q url.Values) string { return "d8:intervali1e5:peers5:abcdee" })
+	_, err = NewHTTPClient(srv.URL).Announce(context.Background(), &AnnounceRequest{})
+	assert.NotNil(t, err)
+
+	_, err = NewHTTPClient("udp://tracker:80").Announce(context.Background(), &AnnounceRequest{})
+	assert.NotNil(t, err)
+}
+
+func TestHTTPHostileResponse(t *testing.T) {
+	// length prefixes beyond the body are refused, not allocated
+	for _, body := range []string{
+		"d5:peers99999999999999:",
+		"d8:intervali99999999999999999999ee",
+		"d5:files9999999999999999999:ae",
+	} {
+		srv := testServer(t, func(q url.Values) string { return body })
+		c := NewHTTPClient(srv.URL + "/announce")
+		_, err := c.Announce(context.Background(), &AnnounceRequest{})
+		assert.NotNil(t, err, body)
+		_, err = c.Scrape(context.Background(), [][20]byte{{1}})
+		assert.NotNil(t, err, body)
+	}
+}
+
+func TestEventString(t *testing.T) {
+	assert.Equal(t, "", EventNone.String())
+	assert.Equal(t, "started", EventStarted.String())
+	assert.Equal(t, "stopped", EventStopped.String())
+	assert.Equal(t, "completed", EventCompleted.String())
+}
+
+func TestScrapeURL(t *testing.T) {
+	for announce, want := range map[string]string{
+		"http://example.com/announce":          "http://example.com/scrape",
+		"http://example.com/x/announce":        "http://example.com/x/scrape",
+		"http://example.com/announce.php":      "http://example.com/scrape.php",
+		"http://example.com/announce?x2%0644":  "http://example.com/scrape?x2%0644",
+		"http://example.com/a":                 "",
+		"http://example.com/announce?x=2/4":    "http://example.com/scrape?x=2/4",
+		"http://example.com/x%064announce":     "",
+		"https://example.com:8443/k/announce/": "",
+	} {
+		got, err := ScrapeURL(announce)
+		if want == "" {
+			assert.Equal(t, ErrScrapeUnsupported, err, announce)
+			continue
+		}
+		assert.Nil(t, err, announce)
+		assert.Equal(t, want, got, announce)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	a := [20]byte{'a'}
+	b := [20]byte{'b'}
+	c := [20]byte{'c'}
+	var path string
+	var got url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, got = r.URL.Path, r.URL.Query()
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10ee"+
+			"20:%sd8:completei1e10:downloadedi2e10:incompletei3eeee", a[:], b[:])
+	}))
+	defer srv.Close()
+
+	res, err := NewHTTPClient(srv.URL+"/announce").Scrape(context.Background(), [][20]byte{a, b, c})
+	assert.Nil(t, err)
+	assert.Equal(t, "/scrape", path)
+	assert.Equal(t, []string{string(a[:]), string(b[:]), string(c[:])}, got["info_hash"])
+	assert.Equal(t, map[[20]byte]ScrapeStats{
+		a: {Complete: 5, Incomplete: 10, Downloaded: 50},
+		b: {Complete: 1, Incomplete: 3, Downloaded: 2},
+	}, res)
+
+	_, err = NewHTTPClient(srv.URL+"/tracker").Scrape(context.Background(), [][20]byte{a})
+	assert.Equal(t, ErrScrapeUnsupported, err)
+
+	srv = testServer(t, func(q url.Values) string { return "d14:failure reason4:nopee" })
+	_, err = NewHTTPClient(srv.URL+"/announce").Scrape(context.Background(), [][20]byte{a})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+}
@@ -0,0 +1,318 @@
+package tracker
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+	"tutorial/bt_demo/peer"
+)
+
+const (
+	defaultInterval   = 30 * time.Minute
+	defaultMinBackoff = 15 * time.Second
+	defaultMaxBackoff = time.Hour
+	defaultTimeout    = 30 * time.Second
+	peersBuffer       = 256
+)
+
+// Status is the state of one tracker of a Manager
+type Status struct {
+	URL  string
+	Tier int
+	// Working is set while the last announce succeeded
+	Working      bool
+	LastAnnounce time.Time
+	NextAnnounce time.Time
+	// Complete, Incomplete and Peers are from the last response
+	Complete   int
+	Incomplete int
+	Peers      int
+	// Failures counts the failed announces since the last success
+	Failures int
+	Err      error
+	Warning  string
+}
+
+type trackerEntry struct {
+	status      Status
+	client      Tracker
+	started     bool
+	minInterval time.Duration
+	retryAt     time.Time
+}
+
+// Manager announces to the trackers of a torrent following the tiers
+// of BEP 12: trackers are shuffled within their tier, tried in order
+// and a working tracker is moved to the front of its tier.
+type Manager struct {
+	// Request is the template of every announce
+	Request AnnounceRequest
+	// Progress fills in the transfer counters before an announce
+	Progress func() (uploaded, downloaded, left int)
+	// Timeout bounds a single announce
+	Timeout time.Duration
+	// MinBackoff is doubled on every failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu              sync.Mutex
+	tiers           [][]*trackerEntry
+	pendingComplete bool
+
+	peers     chan peer.Addr
+	completed chan struct{}
+	wake      chan struct{}
+}
+
+// NewManager creates a manager for the announce tiers, clients are
+// made by New
+func NewManager(tiers [][]string, req AnnounceRequest) *Manager {
+	return newManager(tiers, req, New)
+}
+
+func newManager(tiers [][]string, req AnnounceRequest, newTracker func(string) (Tracker, error)) *Manager {
+	m := &Manager{
+		Request:    req,
+		Timeout:    defaultTimeout,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+		peers:      make(chan peer.Addr, peersBuffer),
+		completed:  make(chan struct{}, 1),
+		wake:       make(chan struct{}, 1),
+	}
+	for i, urls := range tiers {
+		tier := make([]*trackerEntry, 0, len(urls))
+		for _, u := range urls {
+			e := &trackerEntry{status: Status{URL: u, Tier: i}}
+			// broken urls stay in the status but are never announced to
+			e.client, e.status.Err = newTracker(u)
+			tier = append(tier, e)
+		}
+		rand.Shuffle(len(tier), func(a, b int) { tier[a], tier[b] = tier[b], tier[a] })
+		m.tiers = append(m.tiers, tier)
+	}
+	return m
+}
+
+// Peers delivers the peers of every successful announce, it is
+// closed when Run returns
+func (m *Manager) Peers() <-chan peer.Addr {
+	return m.peers
+}
+
+// Completed sends the completed event with the next announce, which
+// happens right away
+func (m *Manager) Completed() {
+	m.mu.Lock()
+	m.pendingComplete = true
+	m.mu.Unlock()
+	select {
+	case m.completed <- struct{}{}:
+	default:
+	}
+}
+
+// Reannounce asks for more peers as soon as the min interval allows
+func (m *Manager) Reannounce() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the trackers in announce order
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []Status
+	for _, tier := range m.tiers {
+		for _, e := range tier {
+			res = append(res, e.status)
+		}
+	}
+	return res
+}
+
+// Run announces until ctx is done, then sends stopped to every
+// tracker that was started
+func (m *Manager) Run(ctx context.Context) {
+	defer close(m.peers)
+	for {
+		// a wake may race the shutdown, do not start another announce
+		if ctx.Err() != nil {
+			m.stop()
+			return
+		}
+		next, minNext := m.announce(ctx)
+		deadline := next
+	wait:
+		for {
+			timer := time.NewTimer(time.Until(deadline))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				m.stop()
+				return
+			case <-timer.C:
+			case <-m.completed:
+				timer.Stop()
+			case <-m.wake:
+				timer.Stop()
+				if time.Now().Before(minNext) {
+					if minNext.Before(deadline) {
+						deadline = minNext
+					}
+					continue wait
+				}
+			}
+			break
+		}
+	}
+}
+
+// announce goes through the tiers until one tracker answers, it
+// returns when to announce next and the earliest time allowed
+func (m *Manager) announce(ctx context.Context) (next, minNext time.Time) {
+	now := time.Now()
+	for ti := range m.tiers {
+		for i, e := range m.tierSnapshot(ti) {
+			if e.client == nil || now.Before(e.retryAt) {
+				continue
+			}
+			res, err := m.announceTo(ctx, e)
+			if ctx.Err() != nil {
+				return now, now
+			}
+			if err != nil {
+				m.fail(e, err)
+				continue
+			}
+			m.succeed(ti, i, e, res)
+			for _, p := range res.Peers {
+				select {
+				case m.peers <- p:
+				case <-ctx.Done():
+					return now, now
+				}
+			}
+			return e.status.NextAnnounce, e.status.LastAnnounce.Add(e.minInterval)
+		}
+	}
+
+	// every tracker failed, wait for the first to leave its backoff
+	next = now.Add(m.MaxBackoff)
+	for ti := range m.tiers {
+		for _, e := range m.tierSnapshot(ti) {
+			if e.client != nil && e.retryAt.Before(next) {
+				next = e.retryAt
+			}
+		}
+	}
+	return next, next
+}
+
+func (m *Manager) tierSnapshot(ti int) []*trackerEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*trackerEntry{}, m.tiers[ti]...)
+}
+
+func (m *Manager) announceTo(ctx context.Context, e *trackerEntry) (*AnnounceResponse, error) {
+	req := m.Request
+	if m.Progress != nil {
+		req.Uploaded, req.Downloaded, req.Left = m.Progress()
+	}
+	m.mu.Lock()
+	switch {
+	case !e.started:
+		req.Event = EventStarted
+	case m.pendingComplete:
+		req.Event = EventCompleted
+	}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+	res, err := e.client.Announce(ctx, &req)
+	if err == nil && req.Event == EventCompleted {
+		m.mu.Lock()
+		m.pendingComplete = false
+		m.mu.Unlock()
+	}
+	return res, err
+}
+
+func (m *Manager) fail(e *trackerEntry, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.status.Failures++
+	e.status.Working = false
+	e.status.Err = err
+	backoff := m.MinBackoff << (e.status.Failures - 1)
+	if backoff > m.MaxBackoff || backoff <= 0 {
+		backoff = m.MaxBackoff
+	}
+	e.retryAt = time.Now().Add(backoff)
+	e.status.NextAnnounce = e.retryAt
+}
+
+// succeed records the response and moves the tracker to the front
+// of its tier
+func (m *Manager) succeed(ti, i int, e *trackerEntry, res *AnnounceResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e.started = true
+	e.retryAt = time.Time{}
+	e.minInterval = res.MinInterval
+	interval := res.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if interval < res.MinInterval {
+		interval = res.MinInterval
+	}
+	e.status = Status{
+		URL:          e.status.URL,
+		Tier:         ti,
+		Working:      true,
+		LastAnnounce: now,
+		NextAnnounce: now.Add(interval),
+		Complete:     res.Complete,
+		Incomplete:   res.Incomplete,
+		Peers:        len(res.Peers),
+		Warning:      res.Warning,
+	}
+
+	tier := m.tiers[ti]
+	if i < len(tier) && tier[i] == e {
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = e
+	}
+}
+
+// stop sends the stopped event to the started trackers
+func (m *Manager) stop() {
+	for ti := range m.tiers {
+		for _, e := range m.tierSnapshot(ti) {
+			if !e.started {
+				continue
+			}
+			req := m.Request
+			if m.Progress != nil {
+				req.Uploaded, req.Downloaded, req.Left = m.Progress()
+			}
+			req.Event = EventStopped
+			ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+			_, err := e.client.Announce(ctx, &req)
+			cancel()
+
+			m.mu.Lock()
+			e.started = false
+			e.status.Working = false
+			e.status.Err = err
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTracker struct {
+	mu          sync.Mutex
+	fail        bool
+	interval    time.Duration
+	minInterval time.Duration
+	peers       []peer.Addr
+	events      []Event
+	left        []int
+}
+
+func (f *fakeTracker) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, req.Event)
+	f.left = append(f.left, req.Left)
+	if f.fail {
+		return nil, errors.New("unreachable")
+	}
+	return &AnnounceResponse{Interval: f.interval, MinInterval: f.minInterval, Complete: 1, Peers: f.peers}, nil
+}
+
+func (f *fakeTracker) Scrape(ctx context.Context, hashes [][utils.SHALEN]byte) (map[[utils.SHALEN]byte]ScrapeStats, error) {
+	return nil, ErrScrapeUnsupported
+}
+
+func (f *fakeTracker) Events() []Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Event{}, f.events...)
+}
+
+func testManager(tiers [][]string, fakes map[string]*fakeTracker) *Manager {
+	m := newManager(tiers, AnnounceRequest{Port: 6881}, func(u string) (Tracker, error) {
+		if f, ok := fakes[u]; ok {
+			return f, nil
+		}
+		return New(u)
+	})
+	m.MinBackoff = 10 * time.Millisecond
+	m.MaxBackoff = 40 * time.Millisecond
+	return m
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManagerTiers(t *testing.T) {
+	p := peer.Addr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	fakes := map[string]*fakeTracker{
+		"a": {fail: true},
+		"b": {interval: time.Hour, peers: []peer.Addr{p}},
+		"c": {interval: time.Hour},
+	}
+	m := testManager([][]string{{"a", "b"}, {"c"}}, fakes)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	assert.Equal(t, p, <-m.Peers())
+	status := m.Status()
+	// the working tracker leads its tier, the next tier is untouched
+	assert.Equal(t, "b", status[0].URL)
+	assert.True(t, status[0].Working)
+	assert.Equal(t, 1, status[0].Complete)
+	assert.Equal(t, 1, status[0].Peers)
+	assert.Equal(t, "a", status[1].URL)
+	assert.Equal(t, "c", status[2].URL)
+	assert.Equal(t, 1, status[2].Tier)
+	assert.Empty(t, fakes["c"].Events())
+	assert.Equal(t, []Event{EventStarted}, fakes["b"].Events())
+
+	m.Completed()
+	waitFor(t, func() bool { return len(fakes["b"].Events()) == 2 })
+	assert.Equal(t, EventCompleted, fakes["b"].Events()[1])
+
+	cancel()
+	<-done
+	assert.Equal(t, []Event{EventStarted, EventCompleted, EventStopped}, fakes["b"].Events())
+	// the peers channel is closed, this ends once it is drained
+	for range m.Peers() {
+	}
+	// a never got started, so it is not stopped
+	for _, e := range fakes["a"].Events() {
+		assert.Equal(t, EventStarted, e)
+	}
+}
+
+func TestManagerFallback(t *testing.T) {
+	fakes := map[string]*fakeTracker{
+		"a": {fail: true},
+		"b": {interval: 20 * time.Millisecond},
+	}
+	m := testManager([][]string{{"a"}, {"b"}, {"://bad"}}, fakes)
+	m.Progress = func() (int, int, int) { return 1, 2, 3 }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// b is re-announced after its interval without an event
+	waitFor(t, func() bool { return len(fakes["b"].Events()) >= 2 })
+	assert.Equal(t, []Event{EventStarted, EventNone}, fakes["b"].Events()[:2])
+	fakes["b"].mu.Lock()
+	assert.Equal(t, 3, fakes["b"].left[0])
+	fakes["b"].mu.Unlock()
+
+	status := m.Status()
+	assert.Equal(t, "a", status[0].URL)
+	assert.False(t, status[0].Working)
+	assert.True(t, status[0].Failures >= 1)
+	assert.NotNil(t, status[0].Err)
+	assert.NotNil(t, status[2].Err)
+
+	// once b fails as well, both back off and a is tried again
+	fakes["b"].mu.Lock()
+	fakes["b"].fail = true
+	fakes["b"].mu.Unlock()
+	fakes["a"].mu.Lock()
+	fakes["a"].fail = false
+	fakes["a"].mu.Unlock()
+	waitFor(t, func() bool { return m.Status()[0].Working })
+}
+
+func TestManagerMinInterval(t *testing.T) {
+	fakes := map[string]*fakeTracker{"a": {interval: time.Hour}}
+	m := testManager([][]string{{"a"}}, fakes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	waitFor(t, func() bool { return len(fakes["a"].Events()) == 1 })
+
+	// without a min interval a reannounce happens right away
+	m.Reannounce()
+	waitFor(t, func() bool { return len(fakes["a"].Events()) == 2 })
+	assert.Equal(t, EventNone, fakes["a"].Events()[1])
+
+	// with one it waits until the min interval passed
+	fakes["a"].mu.Lock()
+	fakes["a"].minInterval = 50 * time.Millisecond
+	fakes["a"].mu.Unlock()
+	m.Reannounce()
+	waitFor(t, func() bool { return len(fakes["a"].Events()) == 3 })
+	start := time.Now()
+	m.Reannounce()
+	waitFor(t, func() bool { return len(fakes["a"].Events()) == 4 })
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestManagerCancelled(t *testing.T) {
+	fakes := map[string]*fakeTracker{"a": {interval: time.Hour}}
+	m := testManager([][]string{{"a"}}, fakes)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m.Completed()
+	m.Run(ctx)
+	// a done context stops the loop before it announces
+	assert.Empty(t, fakes["a"].Events())
+}
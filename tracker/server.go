@@ -0,0 +1,443 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tutorial/bt_demo/benode"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	defaultServerInterval = 30 * time.Minute
+	defaultNumWant        = 50
+	maxNumWant            = 200
+)
+
+// Server is an embeddable tracker answering HTTP announces and
+// scrapes as an http.Handler and UDP ones through ServeUDP
+type Server struct {
+	Storage Storage
+	// Allowlist restricts the served torrents when not nil
+	Allowlist map[[utils.SHALEN]byte]bool
+	// Interval and MinInterval are sent to the clients
+	Interval    time.Duration
+	MinInterval time.Duration
+	// PeerTTL drops peers that did not announce for that long
+	PeerTTL time.Duration
+
+	// secret signs the udp connection ids
+	secret [utils.SHALEN]byte
+	now    func() time.Time
+
+	mu         sync.Mutex
+	lastExpire time.Time
+}
+
+// NewServer returns a server keeping its swarms in memory
+func NewServer() *Server {
+	s := &Server{
+		Storage:  NewMemoryStorage(),
+		Interval: defaultServerInterval,
+		PeerTTL:  2 * defaultServerInterval,
+		now:      time.Now,
+	}
+	if _, err := rand.Read(s.secret[:]); err != nil {
+		panic(fmt.Sprintf("tracker: generate secret: %v", err))
+	}
+	return s
+}
+
+// announce records the peer and picks the peers to return, only
+// peers of the address family of ip are returned
+func (s *Server) announce(req *AnnounceRequest, ip net.IP) (*AnnounceResponse, error) {
+	if s.Allowlist != nil && !s.Allowlist[req.InfoHash] {
+		return nil, &FailureError{Reason: "unregistered torrent"}
+	}
+	if req.Port <= 0 || req.Port > 0xffff {
+		return nil, &FailureError{Reason: "invalid port"}
+	}
+	if err := s.expire(); err != nil {
+		return nil, err
+	}
+
+	res := &AnnounceResponse{Interval: s.Interval, MinInterval: s.MinInterval}
+	if req.Event == EventStopped {
+		if err := s.Storage.Delete(req.InfoHash, req.PeerID); err != nil {
+			return nil, err
+		}
+	} else {
+		p := SwarmPeer{
+			ID:   req.PeerID,
+			Addr: peer.Addr{IP: ip, Port: req.Port, ID: append([]byte{}, req.PeerID[:]...)},
+			Left: req.Left,
+			Seen: s.now(),
+		}
+		if err := s.Storage.Put(req.InfoHash, p); err != nil {
+			return nil, err
+		}
+		if req.Event == EventCompleted {
+			if err := s.Storage.Complete(req.InfoHash); err != nil {
+				return nil, err
+			}
+		}
+
+		numWant := req.NumWant
+		if numWant <= 0 {
+			numWant = defaultNumWant
+		}
+		if numWant > maxNumWant {
+			numWant = maxNumWant
+		}
+		// one more, the announcing peer may be in the sample
+		peers, err := s.Storage.Peers(req.InfoHash, numWant+1, ip.To4() != nil)
+		if err != nil {
+			return nil, err
+		}
+		res.Peers = selectPeers(peers, req.PeerID, numWant)
+	}
+
+	stats, _, err := s.Storage.Stats(req.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	res.Complete, res.Incomplete = stats.Complete, stats.Incomplete
+	return res, nil
+}
+
+// selectPeers returns up to n peers without the announcing peer
+func selectPeers(peers []SwarmPeer, id peer.PeerID, n int) []peer.Addr {
+	var res []peer.Addr
+	for _, sp := range peers {
+		if sp.ID == id || len(res) == n {
+			continue
+		}
+		res = append(res, sp.Addr)
+	}
+	return res
+}
+
+// scrape returns the stats of the known hashes, all swarms if none
+// are given
+func (s *Server) scrape(hashes [][utils.SHALEN]byte) (map[[utils.SHALEN]byte]ScrapeStats, error) {
+	if err := s.expire(); err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		all, err := s.Storage.Hashes()
+		if err != nil {
+			return nil, err
+		}
+		hashes = all
+	}
+	res := make(map[[utils.SHALEN]byte]ScrapeStats, len(hashes))
+	for _, h := range hashes {
+		if s.Allowlist != nil && !s.Allowlist[h] {
+			continue
+		}
+		stats, ok, err := s.Storage.Stats(h)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res[h] = stats
+		}
+	}
+	return res, nil
+}
+
+// expire drops stale peers at most once per minute
+func (s *Server) expire() error {
+	now := s.now()
+	s.mu.Lock()
+	if now.Sub(s.lastExpire) < time.Minute {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastExpire = now
+	s.mu.Unlock()
+	return s.Storage.Expire(now.Add(-s.PeerTTL))
+}
+
+type dictPeer struct {
+	IP     string `benode:"ip"`
+	Port   int    `benode:"port"`
+	PeerID string `benode:"peer id"`
+}
+
+type rawCompactReply struct {
+	Interval    int    `benode:"interval"`
+	MinInterval int    `benode:"min interval,omitempty"`
+	Complete    int    `benode:"complete"`
+	Incomplete  int    `benode:"incomplete"`
+	Peers       string `benode:"peers"`
+	Peers6      string `benode:"peers6,omitempty"`
+}
+
+type rawDictReply struct {
+	Interval    int        `benode:"interval"`
+	MinInterval int        `benode:"min interval,omitempty"`
+	Complete    int        `benode:"complete"`
+	Incomplete  int        `benode:"incomplete"`
+	Peers       []dictPeer `benode:"peers"`
+}
+
+type rawFailure struct {
+	FailureReason string `benode:"failure reason"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reply any
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		reply, err = s.serveAnnounce(r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		reply, err = s.serveScrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		var failure *FailureError
+		if !errors.As(err, &failure) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reply = &rawFailure{FailureReason: failure.Reason}
+	}
+
+	node, err := benode.Marshal(reply)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err = node.Write(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) serveAnnounce(r *http.Request) (any, error) {
+	q := r.URL.Query()
+	req := &AnnounceRequest{}
+	infoHash, peerId := q.Get("info_hash"), q.Get("peer_id")
+	if len(infoHash) != utils.SHALEN {
+		return nil, &FailureError{Reason: "invalid info_hash"}
+	}
+	if len(peerId) != utils.SHALEN {
+		return nil, &FailureError{Reason: "invalid peer_id"}
+	}
+	copy(req.InfoHash[:], infoHash)
+	copy(req.PeerID[:], peerId)
+	var err error
+	for key, dst := range map[string]*int{
+		"port": &req.Port, "uploaded": &req.Uploaded, "downloaded": &req.Downloaded,
+		"left": &req.Left, "numwant": &req.NumWant,
+	} {
+		if v := q.Get(key); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				return nil, &FailureError{Reason: "invalid " + key}
+			}
+		}
+	}
+	switch q.Get("event") {
+	case "started":
+		req.Event = EventStarted
+	case "stopped":
+		req.Event = EventStopped
+	case "completed":
+		req.Event = EventCompleted
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("tracker: invalid remote address %q", r.RemoteAddr)
+	}
+	res, err := s.announce(req, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.Get("compact") == "0" {
+		reply := &rawDictReply{
+			Interval:    int(res.Interval / time.Second),
+			MinInterval: int(res.MinInterval / time.Second),
+			Complete:    res.Complete,
+			Incomplete:  res.Incomplete,
+			Peers:       []dictPeer{},
+		}
+		for _, p := range res.Peers {
+			reply.Peers = append(reply.Peers, dictPeer{IP: p.IP.String(), Port: p.Port, PeerID: string(p.ID)})
+		}
+		return reply, nil
+	}
+	peers, peers6 := peer.EncodeCompact(res.Peers)
+	return &rawCompactReply{
+		Interval:    int(res.Interval / time.Second),
+		MinInterval: int(res.MinInterval / time.Second),
+		Complete:    res.Complete,
+		Incomplete:  res.Incomplete,
+		Peers:       string(peers),
+		Peers6:      string(peers6),
+	}, nil
+}
+
+func (s *Server) serveScrape(r *http.Request) (any, error) {
+	var hashes [][utils.SHALEN]byte
+	for _, h := range r.URL.Query()["info_hash"] {
+		if len(h) != utils.SHALEN {
+			return nil, &FailureError{Reason: "invalid info_hash"}
+		}
+		var hash [utils.SHALEN]byte
+		copy(hash[:], h)
+		hashes = append(hashes, hash)
+	}
+	stats, err := s.scrape(hashes)
+	if err != nil {
+		return nil, err
+	}
+	reply := &rawScrape{Files: make(map[string]rawScrapeFile, len(stats))}
+	for h, st := range stats {
+		reply.Files[string(h[:])] = rawScrapeFile{Complete: st.Complete, Incomplete: st.Incomplete, Downloaded: st.Downloaded}
+	}
+	return reply, nil
+}
+
+// ServeUDP answers BEP 15 requests on conn until it is closed
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		if resp := s.handleUDP(buf[:n], addr); resp != nil {
+			conn.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *Server) handleUDP(pkt []byte, addr *net.UDPAddr) []byte {
+	action := binary.BigEndian.Uint32(pkt[8:12])
+	resp := binary.BigEndian.AppendUint32(nil, action)
+	resp = append(resp, pkt[12:16]...)
+	fail := func(msg string) []byte {
+		binary.BigEndian.PutUint32(resp, actionError)
+		return append(resp, msg...)
+	}
+
+	if action == actionConnect {
+		if binary.BigEndian.Uint64(pkt) != udpProtocolID {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64(resp, s.connID(addr, 0))
+	}
+	// ids of the previous minute stay valid
+	if id := binary.BigEndian.Uint64(pkt); id != s.connID(addr, 0) && id != s.connID(addr, -1) {
+		return fail("invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		if len(pkt) < 98 {
+			return fail("short announce")
+		}
+		req := &AnnounceRequest{
+			Downloaded: int(binary.BigEndian.Uint64(pkt[56:64])),
+			Left:       int(binary.BigEndian.Uint64(pkt[64:72])),
+			Uploaded:   int(binary.BigEndian.Uint64(pkt[72:80])),
+			Key:        binary.BigEndian.Uint32(pkt[88:92]),
+			NumWant:    int(int32(binary.BigEndian.Uint32(pkt[92:96]))),
+			Port:       int(binary.BigEndian.Uint16(pkt[96:98])),
+		}
+		copy(req.InfoHash[:], pkt[16:36])
+		copy(req.PeerID[:], pkt[36:56])
+		switch binary.BigEndian.Uint32(pkt[80:84]) {
+		case 1:
+			req.Event = EventCompleted
+		case 2:
+			req.Event = EventStarted
+		case 3:
+			req.Event = EventStopped
+		}
+		res, err := s.announce(req, addr.IP)
+		if err != nil {
+			return fail(failureReason(err))
+		}
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.Interval/time.Second))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.Incomplete))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(res.Complete))
+		for _, p := range res.Peers {
+			resp = append(resp, p.Compact()...)
+		}
+		return resp
+	case actionScrape:
+		var hashes [][utils.SHALEN]byte
+		for h := pkt[16:]; len(h) >= utils.SHALEN && len(hashes) < udpScrapeMax; h = h[utils.SHALEN:] {
+			var hash [utils.SHALEN]byte
+			copy(hash[:], h)
+			hashes = append(hashes, hash)
+		}
+		if len(hashes) == 0 {
+			return fail("no info hash")
+		}
+		stats, err := s.scrape(hashes)
+		if err != nil {
+			return fail(failureReason(err))
+		}
+		// unknown torrents are reported with zero counts
+		for _, h := range hashes {
+			st := stats[h]
+			resp = binary.BigEndian.AppendUint32(resp, uint32(st.Complete))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(st.Downloaded))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(st.Incomplete))
+		}
+		return resp
+	}
+	return fail("unknown action")
+}
+
+func failureReason(err error) string {
+	var failure *FailureError
+	if errors.As(err, &failure) {
+		return failure.Reason
+	}
+	return "internal error"
+}
+
+// connID signs the client ip and the current minute, shifted by
+// minutes, so no state is kept per connection. The port is left out
+// as clients may send from a new socket for every request.
+func (s *Server) connID(addr *net.UDPAddr, minutes int) uint64 {
+	window := s.now().Add(time.Duration(minutes)*time.Minute).Unix() / 60
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write(addr.IP.To16())
+	binary.Write(h, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
@@ -0,0 +1,266 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPeerID(i int) peer.PeerID {
+	var id peer.PeerID
+	copy(id[:], fmt.Sprintf("-SB0100-%012d", i))
+	return id
+}
+
+func startUDPServer(t *testing.T, s *Server, network, addr string) string {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("listen %v: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.ServeUDP(conn)
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestServerHTTP(t *testing.T) {
+	s := NewServer()
+	s.MinInterval = time.Minute
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := NewHTTPClient(srv.URL + "/announce")
+	hash := [utils.SHALEN]byte{1}
+
+	// the first peer sees nobody, the second sees the first
+	req := &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(1), Port: 1001, Left: 10, Event: EventStarted}
+	res, err := c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Empty(t, res.Peers)
+	assert.Equal(t, defaultServerInterval, res.Interval)
+	assert.Equal(t, time.Minute, res.MinInterval)
+	assert.Equal(t, 1, res.Incomplete)
+
+	res, err = c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(2), Port: 1002, Event: EventCompleted})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, "127.0.0.1:1001", res.Peers[0].String())
+	assert.Equal(t, 1, res.Complete)
+	assert.Equal(t, 1, res.Incomplete)
+
+	stats, err := c.Scrape(context.Background(), [][utils.SHALEN]byte{hash, {2}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[[utils.SHALEN]byte]ScrapeStats{hash: {Complete: 1, Incomplete: 1, Downloaded: 1}}, stats)
+
+	// dict peers carry the peer id
+	resp, err := http.Get(srv.URL + "/announce?compact=0&port=1003&info_hash=" +
+		url.QueryEscape(string(hash[:])) + "&peer_id=" + testPeerID(3).String())
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "7:peer id20:-SB0100-")
+	assert.Contains(t, string(body), "2:ip9:127.0.0.1")
+
+	// stopped peers leave the swarm
+	req.Event = EventStopped
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	stats, err = c.Scrape(context.Background(), [][utils.SHALEN]byte{hash})
+	assert.Nil(t, err)
+	assert.Equal(t, ScrapeStats{Complete: 2, Incomplete: 0, Downloaded: 1}, stats[hash])
+
+	// a scrape without hashes lists every swarm
+	resp, err = http.Get(srv.URL + "/scrape")
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.True(t, strings.HasPrefix(string(body), "d5:filesd20:"))
+
+	resp, err = http.Get(srv.URL + "/other")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerAllowlist(t *testing.T) {
+	s := NewServer()
+	s.Allowlist = map[[utils.SHALEN]byte]bool{{1}: true}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := NewHTTPClient(srv.URL + "/announce")
+
+	_, err := c.Announce(context.Background(), &AnnounceRequest{InfoHash: [utils.SHALEN]byte{1}, PeerID: testPeerID(1), Port: 1})
+	assert.Nil(t, err)
+	_, err = c.Announce(context.Background(), &AnnounceRequest{InfoHash: [utils.SHALEN]byte{2}, PeerID: testPeerID(1), Port: 1})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unregistered torrent", failure.Reason)
+
+	resp, err := http.Get(srv.URL + "/announce?info_hash=short")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "d14:failure reason17:invalid info_hashe", string(body))
+}
+
+func TestServerExpire(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	s := NewServer()
+	s.now = func() time.Time { return now }
+	s.PeerTTL = 10 * time.Minute
+	hash := [utils.SHALEN]byte{1}
+	ip := net.ParseIP("10.0.0.1")
+
+	_, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(1), Port: 1, Left: 5}, ip)
+	assert.Nil(t, err)
+	now = now.Add(9 * time.Minute)
+	res, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(2), Port: 2}, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+
+	now = now.Add(2 * time.Minute)
+	res, err = s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(2), Port: 2}, ip)
+	assert.Nil(t, err)
+	assert.Empty(t, res.Peers)
+	assert.Equal(t, 0, res.Incomplete)
+	assert.Equal(t, 1, res.Complete)
+
+	_, err = s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(3)}, ip)
+	assert.NotNil(t, err)
+}
+
+func TestServerNumWant(t *testing.T) {
+	s := NewServer()
+	hash := [utils.SHALEN]byte{1}
+	for i := 0; i < 10; i++ {
+		_, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(i), Port: 1000 + i}, net.ParseIP("10.0.0.1"))
+		assert.Nil(t, err)
+	}
+	_, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(10), Port: 1}, net.ParseIP("::1"))
+	assert.Nil(t, err)
+
+	res, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(0), Port: 1000, NumWant: 3}, net.ParseIP("10.0.0.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res.Peers))
+	res, err = s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(0), Port: 1000}, net.ParseIP("10.0.0.1"))
+	assert.Nil(t, err)
+	// neither the announcing peer nor the IPv6 one
+	assert.Equal(t, 9, len(res.Peers))
+	for _, p := range res.Peers {
+		assert.NotEqual(t, 1000, p.Port)
+	}
+}
+
+func TestServerNumWantMixed(t *testing.T) {
+	s := NewServer()
+	hash := [utils.SHALEN]byte{1}
+	// 4 IPv4 peers hidden among 20 IPv6 ones
+	for i := 0; i < 24; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::%x", i+1))
+		if i < 4 {
+			ip = net.ParseIP(fmt.Sprintf("10.0.0.%d", i+1))
+		}
+		_, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(i), Port: 1000 + i}, ip)
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 20; i++ {
+		res, err := s.announce(&AnnounceRequest{InfoHash: hash, PeerID: testPeerID(0), Port: 1000, NumWant: 3}, net.ParseIP("10.0.0.1"))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(res.Peers))
+		for _, p := range res.Peers {
+			assert.NotNil(t, p.IP.To4())
+			assert.NotEqual(t, 1000, p.Port)
+		}
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	st := NewMemoryStorage()
+	hash := [utils.SHALEN]byte{1}
+	put := func(i int, ip string, left int) {
+		p := SwarmPeer{ID: testPeerID(i), Addr: peer.Addr{IP: net.ParseIP(ip), Port: i}, Left: left, Seen: time.Unix(int64(i), 0)}
+		assert.Nil(t, st.Put(hash, p))
+	}
+	for i := 0; i < 6; i++ {
+		put(i, fmt.Sprintf("10.0.0.%d", i), i%2)
+	}
+	put(6, "::1", 0)
+	// a peer may change its address and finish
+	put(1, "::2", 0)
+
+	stats, ok, err := st.Stats(hash)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, ScrapeStats{Complete: 5, Incomplete: 2}, stats)
+	peers, err := st.Peers(hash, 10, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(peers))
+
+	// samples are distinct peers of the family
+	for n := 0; n < 20; n++ {
+		peers, err = st.Peers(hash, 4, true)
+		assert.Nil(t, err)
+		seen := map[peer.PeerID]bool{}
+		for _, p := range peers {
+			assert.NotNil(t, p.Addr.IP.To4())
+			seen[p.ID] = true
+		}
+		assert.Equal(t, 4, len(seen))
+	}
+
+	assert.Nil(t, st.Delete(hash, testPeerID(0)))
+	assert.Nil(t, st.Expire(time.Unix(3, 0)))
+	stats, _, _ = st.Stats(hash)
+	assert.Equal(t, ScrapeStats{Complete: 2, Incomplete: 2}, stats)
+	peers, _ = st.Peers(hash, 10, true)
+	assert.Equal(t, 3, len(peers))
+}
+
+func TestServerUDP(t *testing.T) {
+	s := NewServer()
+	c := testUDPClient(startUDPServer(t, s, "udp4", "127.0.0.1:0"))
+	hash := [utils.SHALEN]byte{1}
+
+	_, err := c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(1), Port: 1001, Left: 3, Event: EventStarted})
+	assert.Nil(t, err)
+	res, err := c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(2), Port: 1002, Event: EventCompleted})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, "127.0.0.1:1001", res.Peers[0].String())
+	assert.Equal(t, 1, res.Complete)
+	assert.Equal(t, 1, res.Incomplete)
+
+	stats, err := c.Scrape(context.Background(), [][utils.SHALEN]byte{hash, {2}})
+	assert.Nil(t, err)
+	assert.Equal(t, ScrapeStats{Complete: 1, Incomplete: 1, Downloaded: 1}, stats[hash])
+	assert.Equal(t, ScrapeStats{}, stats[[utils.SHALEN]byte{2}])
+
+	// a stale connection id is refused
+	c.connID++
+	_, err = c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(1), Port: 1001})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "invalid connection id", failure.Reason)
+}
+
+func TestServerUDPIPv6(t *testing.T) {
+	s := NewServer()
+	c := testUDPClient(startUDPServer(t, s, "udp6", "[::1]:0"))
+	hash := [utils.SHALEN]byte{1}
+	_, err := c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(1), Port: 1001})
+	assert.Nil(t, err)
+	res, err := c.Announce(context.Background(), &AnnounceRequest{InfoHash: hash, PeerID: testPeerID(2), Port: 1002})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, "[::1]:1001", res.Peers[0].String())
+}
@@ -0,0 +1,190 @@
+package tracker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+// SwarmPeer is a peer as remembered by a Server
+type SwarmPeer struct {
+	ID   peer.PeerID
+	Addr peer.Addr
+	// Left is 0 for seeders
+	Left int
+	Seen time.Time
+}
+
+// Storage keeps the swarms of a Server, it must be safe for
+// concurrent use
+type Storage interface {
+	// Put adds or refreshes the peer in the swarm of hash
+	Put(hash [utils.SHALEN]byte, p SwarmPeer) error
+	Delete(hash [utils.SHALEN]byte, id peer.PeerID) error
+	// Complete counts a finished download
+	Complete(hash [utils.SHALEN]byte) error
+	// Peers returns up to n random peers of the swarm with an IPv4
+	// address if ipv4 is set, with an IPv6 address otherwise
+	Peers(hash [utils.SHALEN]byte, n int, ipv4 bool) ([]SwarmPeer, error)
+	// Stats returns the counts of the swarm, false if it is unknown
+	Stats(hash [utils.SHALEN]byte) (ScrapeStats, bool, error)
+	// Hashes lists the known swarms
+	Hashes() ([][utils.SHALEN]byte, error)
+	// Expire drops the peers last seen before t
+	Expire(t time.Time) error
+}
+
+type swarm struct {
+	peers map[peer.PeerID]SwarmPeer
+	// ids lists the peers by address family, 0 for IPv4 and 1 for
+	// IPv6, and pos their index, so a sample costs O(n)
+	ids        [2][]peer.PeerID
+	pos        map[peer.PeerID]int
+	complete   int
+	downloaded int
+}
+
+func newSwarm() *swarm {
+	return &swarm{peers: make(map[peer.PeerID]SwarmPeer), pos: make(map[peer.PeerID]int)}
+}
+
+func family(p SwarmPeer) int {
+	if p.Addr.IP.To4() != nil {
+		return 0
+	}
+	return 1
+}
+
+func (sw *swarm) put(p SwarmPeer) {
+	sw.remove(p.ID)
+	f := family(p)
+	sw.pos[p.ID] = len(sw.ids[f])
+	sw.ids[f] = append(sw.ids[f], p.ID)
+	sw.peers[p.ID] = p
+	if p.Left == 0 {
+		sw.complete++
+	}
+}
+
+func (sw *swarm) remove(id peer.PeerID) {
+	p, ok := sw.peers[id]
+	if !ok {
+		return
+	}
+	f, i := family(p), sw.pos[id]
+	ids := sw.ids[f]
+	last := ids[len(ids)-1]
+	ids[i], sw.pos[last] = last, i
+	sw.ids[f] = ids[:len(ids)-1]
+	delete(sw.pos, id)
+	delete(sw.peers, id)
+	if p.Left == 0 {
+		sw.complete--
+	}
+}
+
+// MemoryStorage keeps the swarms in memory
+type MemoryStorage struct {
+	mu     sync.Mutex
+	swarms map[[utils.SHALEN]byte]*swarm
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{swarms: make(map[[utils.SHALEN]byte]*swarm)}
+}
+
+func (s *MemoryStorage) Put(hash [utils.SHALEN]byte, p SwarmPeer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[hash]
+	if !ok {
+		sw = newSwarm()
+		s.swarms[hash] = sw
+	}
+	sw.put(p)
+	return nil
+}
+
+func (s *MemoryStorage) Delete(hash [utils.SHALEN]byte, id peer.PeerID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sw, ok := s.swarms[hash]; ok {
+		sw.remove(id)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Complete(hash [utils.SHALEN]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sw, ok := s.swarms[hash]; ok {
+		sw.downloaded++
+	}
+	return nil
+}
+
+// Peers draws the sample by a partial shuffle of the ids of the
+// family, it never copies the swarm
+func (s *MemoryStorage) Peers(hash [utils.SHALEN]byte, n int, ipv4 bool) ([]SwarmPeer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[hash]
+	if !ok {
+		return nil, nil
+	}
+	f := 1
+	if ipv4 {
+		f = 0
+	}
+	ids := sw.ids[f]
+	if n > len(ids) {
+		n = len(ids)
+	}
+	res := make([]SwarmPeer, 0, n)
+	for i := 0; i < n; i++ {
+		j := i + rand.Intn(len(ids)-i)
+		ids[i], ids[j] = ids[j], ids[i]
+		sw.pos[ids[i]], sw.pos[ids[j]] = i, j
+		res = append(res, sw.peers[ids[i]])
+	}
+	return res, nil
+}
+
+func (s *MemoryStorage) Stats(hash [utils.SHALEN]byte) (ScrapeStats, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[hash]
+	if !ok {
+		return ScrapeStats{}, false, nil
+	}
+	return ScrapeStats{
+		Complete:   sw.complete,
+		Incomplete: len(sw.peers) - sw.complete,
+		Downloaded: sw.downloaded,
+	}, true, nil
+}
+
+func (s *MemoryStorage) Hashes() ([][utils.SHALEN]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([][utils.SHALEN]byte, 0, len(s.swarms))
+	for h := range s.swarms {
+		res = append(res, h)
+	}
+	return res, nil
+}
+
+func (s *MemoryStorage) Expire(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sw := range s.swarms {
+		for id, p := range sw.peers {
+			if p.Seen.Before(t) {
+				sw.remove(id)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+// Event tells the tracker why an announce is sent
+type Event int
+
+const (
+	// EventNone is a regular re-announce
+	EventNone Event = iota
+	EventStarted
+	EventStopped
+	EventCompleted
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	case EventCompleted:
+		return "completed"
+	}
+	return ""
+}
+
+// DefaultPort is announced when a request has no port
+const DefaultPort = 6667
+
+type AnnounceRequest struct {
+	InfoHash [utils.SHALEN]byte
+	// PeerID defaults to peer.DefaultPeerID
+	PeerID peer.PeerID
+	// Port is the port we accept peer connections on, DefaultPort if 0
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      Event
+	// NumWant is the number of peers asked for, 0 lets the tracker choose
+	NumWant int
+	// Key identifies us to the tracker if our address changes
+	Key uint32
+}
+
+// identity returns the peer id and port to announce
+func (r *AnnounceRequest) identity() (peer.PeerID, int) {
+	id, port := r.PeerID, r.Port
+	if id.IsZero() {
+		id = peer.DefaultPeerID()
+	}
+	if port == 0 {
+		port = DefaultPort
+	}
+	return id, port
+}
+
+type AnnounceResponse struct {
+	// Interval is the time to wait before the next announce
+	Interval time.Duration
+	// MinInterval is the shortest allowed interval, 0 if not given
+	MinInterval time.Duration
+	// Complete and Incomplete count the seeders and leechers
+	Complete   int
+	Incomplete int
+	// Warning is a message of a successful announce to show the user
+	Warning string
+	// Peers holds the IPv4 peers followed by the IPv6 ones
+	Peers []peer.Addr
+}
+
+// ScrapeStats are the swarm counts of one torrent
+type ScrapeStats struct {
+	// Complete and Incomplete count the seeders and leechers
+	Complete   int
+	Incomplete int
+	// Downloaded is the number of completed downloads
+	Downloaded int
+}
+
+// ErrScrapeUnsupported is returned for trackers without a scrape url
+var ErrScrapeUnsupported = errors.New("tracker: scrape not supported")
+
+// Tracker announces a torrent and returns peers of its swarm
+type Tracker interface {
+	Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error)
+	// Scrape returns the counts of the torrents the tracker knows,
+	// unknown info hashes are missing from the result
+	Scrape(ctx context.Context, hashes [][utils.SHALEN]byte) (map[[utils.SHALEN]byte]ScrapeStats, error)
+}
+
+// New returns the client for an http, https or udp announce url
+func New(announce string) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, fmt.Errorf("tracker: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPClient(announce), nil
+	case "udp":
+		return NewUDPClient(announce), nil
+	}
+	return nil, fmt.Errorf("tracker: unsupported scheme %q", u.Scheme)
+}
+
+// FailureError is returned when the tracker rejects an announce
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker: failure: %v", e.Reason)
+}
@@ -0,0 +1,276 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+	"tutorial/bt_demo/peer"
+	"tutorial/bt_demo/utils"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	// udpTimeout and udpRetries give the 15 * 2^n seconds schedule of BEP 15
+	udpTimeout = 15 * time.Second
+	udpRetries = 8
+	// connIDLifetime is how long a client may use a connection id
+	connIDLifetime = time.Minute
+	maxPacketLen   = 1 << 16
+	// udpScrapeMax info hashes fit into one scrape packet
+	udpScrapeMax = 74
+)
+
+var errUDPTimeout = errors.New("tracker: udp timeout")
+
+// UDPClient announces to a udp tracker (BEP 15)
+type UDPClient struct {
+	URL string
+	// Timeout is the first retransmission timeout, doubled on every retry
+	Timeout time.Duration
+	// Retries is the number of retransmissions before giving up
+	Retries int
+
+	mu       sync.Mutex
+	connID   uint64
+	connTime time.Time
+}
+
+func NewUDPClient(announce string) *UDPClient {
+	return &UDPClient{URL: announce, Timeout: udpTimeout, Retries: udpRetries}
+}
+
+func (c *UDPClient) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	peerId, port := req.identity()
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+
+	body := make([]byte, 82)
+	copy(body[0:20], req.InfoHash[:])
+	copy(body[20:40], peerId[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], udpEvent(req.Event))
+	// body[68:72] is the ip, 0 lets the tracker use the sender address
+	binary.BigEndian.PutUint32(body[72:76], req.Key)
+	binary.BigEndian.PutUint32(body[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(body[80:82], uint16(port))
+
+	resp, ipv6, err := c.request(ctx, actionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 {
+		return nil, fmt.Errorf("tracker: short announce response")
+	}
+	res := &AnnounceResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Incomplete: int(binary.BigEndian.Uint32(resp[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(resp[8:12])),
+	}
+	// the peers have the address family of the tracker
+	if ipv6 {
+		res.Peers, err = peer.ParseCompact6(resp[12:])
+	} else {
+		res.Peers, err = peer.ParseCompact(resp[12:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Scrape asks for the swarm counts, at most udpScrapeMax info hashes
+// are sent per packet
+func (c *UDPClient) Scrape(ctx context.Context, hashes [][utils.SHALEN]byte) (map[[utils.SHALEN]byte]ScrapeStats, error) {
+	res := make(map[[utils.SHALEN]byte]ScrapeStats, len(hashes))
+	for len(hashes) > 0 {
+		batch := hashes
+		if len(batch) > udpScrapeMax {
+			batch = batch[:udpScrapeMax]
+		}
+		hashes = hashes[len(batch):]
+
+		body := make([]byte, 0, len(batch)*utils.SHALEN)
+		for _, h := range batch {
+			body = append(body, h[:]...)
+		}
+		resp, _, err := c.request(ctx, actionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 12*len(batch) {
+			return nil, fmt.Errorf("tracker: short scrape response")
+		}
+		for i, h := range batch {
+			entry := resp[12*i:]
+			res[h] = ScrapeStats{
+				Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+	return res, nil
+}
+
+// udpEvent maps the event to its BEP 15 code
+func udpEvent(e Event) uint32 {
+	switch e {
+	case EventCompleted:
+		return 1
+	case EventStarted:
+		return 2
+	case EventStopped:
+		return 3
+	}
+	return 0
+}
+
+// request sends the action with a fresh connection id when needed
+// and returns the response after the action and transaction id.
+// Lost packets are sent again after 15 * 2^n seconds.
+func (c *UDPClient) request(ctx context.Context, action uint32, body []byte) (resp []byte, ipv6 bool, err error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, false, err
+	}
+	if u.Scheme != "udp" {
+		return nil, false, fmt.Errorf("tracker: unsupported scheme %q", u.Scheme)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, false, fmt.Errorf("tracker: %w", err)
+	}
+	defer conn.Close()
+	ipv6 = conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+
+	// unblock reads when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	for n := 0; n <= c.Retries; n++ {
+		timeout := c.Timeout << n
+		connID, ok := c.cachedConnID()
+		if !ok {
+			var pkt [16]byte
+			binary.BigEndian.PutUint64(pkt[0:8], udpProtocolID)
+			resp, err = c.exchange(ctx, conn, actionConnect, pkt[:], timeout)
+			if err == errUDPTimeout {
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			if len(resp) < 8 {
+				return nil, false, fmt.Errorf("tracker: short connect response")
+			}
+			connID = binary.BigEndian.Uint64(resp)
+			c.setConnID(connID)
+		}
+
+		pkt := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(pkt[0:8], connID)
+		copy(pkt[16:], body)
+		resp, err = c.exchange(ctx, conn, action, pkt, timeout)
+		if err == errUDPTimeout {
+			continue
+		}
+		if err != nil {
+			// the id may be the cause, the next request reconnects
+			c.resetConnID()
+		}
+		return resp, ipv6, err
+	}
+	return nil, false, fmt.Errorf("tracker: %v did not answer", c.URL)
+}
+
+// exchange fills in the action and a transaction id, sends pkt and
+// waits up to timeout for the matching response
+func (c *UDPClient) exchange(ctx context.Context, conn net.Conn, action uint32, pkt []byte, timeout time.Duration) ([]byte, error) {
+	var txID [4]byte
+	if _, err := rand.Read(txID[:]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(pkt[8:12], action)
+	copy(pkt[12:16], txID[:])
+	if _, err := conn.Write(pkt); err != nil {
+		return nil, fmt.Errorf("tracker: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, err := conn.Read(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// the ctx timer may fire just after the read deadline
+			if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+				return nil, context.DeadlineExceeded
+			}
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tracker: %w", err)
+		}
+		// late answers to earlier transmissions are dropped
+		if n < 8 || string(buf[4:8]) != string(txID[:]) {
+			continue
+		}
+		switch got := binary.BigEndian.Uint32(buf[0:4]); got {
+		case action:
+			return append([]byte{}, buf[8:n]...), nil
+		case actionError:
+			return nil, &FailureError{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("tracker: unexpected action %v", got)
+		}
+	}
+}
+
+func (c *UDPClient) cachedConnID() (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connID, !c.connTime.IsZero() && time.Since(c.connTime) < connIDLifetime
+}
+
+func (c *UDPClient) setConnID(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connID, c.connTime = id, time.Now()
+}
+
+func (c *UDPClient) resetConnID() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connTime = time.Time{}
+}
@@ -0,0 +1,254 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"tutorial/bt_demo/peer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConnID = 0x1234
+
+// udpStandIn is a minimal BEP 15 tracker answering on loopback
+type udpStandIn struct {
+	conn net.PacketConn
+
+	mu sync.Mutex
+	// drop is the number of packets to ignore, simulating loss
+	drop      int
+	connects  int
+	announces [][]byte
+	scrapes   int
+	fail      string
+	peers     []byte
+}
+
+// listen starts serving, the stand-in must be set up before
+func (s *udpStandIn) listen(t *testing.T, network, addr string) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("listen %v: %v", addr, err)
+	}
+	s.conn = conn
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+}
+
+func (s *udpStandIn) stats() (connects int, announces [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects, s.announces
+}
+
+func (s *udpStandIn) url() string {
+	return "udp://" + s.conn.LocalAddr().String() + "/announce"
+}
+
+func (s *udpStandIn) serve() {
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, from)
+		}
+	}
+}
+
+func (s *udpStandIn) handle(pkt []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+	if len(pkt) < 16 {
+		return nil
+	}
+	action := binary.BigEndian.Uint32(pkt[8:12])
+	resp := append([]byte{0, 0, 0, 0}, pkt[12:16]...)
+	if s.fail != "" {
+		binary.BigEndian.PutUint32(resp, actionError)
+		return append(resp, s.fail...)
+	}
+	switch action {
+	case actionConnect:
+		if binary.BigEndian.Uint64(pkt) != udpProtocolID {
+			return nil
+		}
+		s.connects++
+		binary.BigEndian.PutUint32(resp, actionConnect)
+		return binary.BigEndian.AppendUint64(resp, testConnID)
+	case actionAnnounce:
+		if binary.BigEndian.Uint64(pkt) != testConnID || len(pkt) < 98 {
+			return nil
+		}
+		s.announces = append(s.announces, append([]byte{}, pkt...))
+		binary.BigEndian.PutUint32(resp, actionAnnounce)
+		resp = binary.BigEndian.AppendUint32(resp, 1800)
+		resp = binary.BigEndian.AppendUint32(resp, 2)
+		resp = binary.BigEndian.AppendUint32(resp, 3)
+		return append(resp, s.peers...)
+	case actionScrape:
+		if binary.BigEndian.Uint64(pkt) != testConnID {
+			return nil
+		}
+		s.scrapes++
+		binary.BigEndian.PutUint32(resp, actionScrape)
+		// the counts are taken from the first bytes of each hash
+		for h := pkt[16:]; len(h) >= 20; h = h[20:] {
+			resp = binary.BigEndian.AppendUint32(resp, uint32(h[0]))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(h[1]))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(h[2]))
+		}
+		return resp
+	}
+	return nil
+}
+
+func testUDPClient(url string) *UDPClient {
+	c := NewUDPClient(url)
+	c.Timeout = 20 * time.Millisecond
+	c.Retries = 3
+	return c
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := &udpStandIn{}
+	s.peers, _ = peer.EncodeCompact([]peer.Addr{{IP: net.ParseIP("10.0.0.1"), Port: 6881}})
+	s.listen(t, "udp4", "127.0.0.1:0")
+
+	req := &AnnounceRequest{Port: 6881, Left: 1000, Uploaded: 10, Downloaded: 20, Event: EventStarted, NumWant: 50, Key: 7}
+	copy(req.InfoHash[:], "aaaaaaaaaaaaaaaaaaaa")
+	copy(req.PeerID[:], "-SB0100-bbbbbbbbbbbb")
+	c := testUDPClient(s.url())
+	res, err := c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1800*time.Second, res.Interval)
+	assert.Equal(t, 2, res.Incomplete)
+	assert.Equal(t, 3, res.Complete)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, "10.0.0.1:6881", res.Peers[0].String())
+
+	_, announces := s.stats()
+	pkt := announces[0]
+	assert.Equal(t, "aaaaaaaaaaaaaaaaaaaa", string(pkt[16:36]))
+	assert.Equal(t, "-SB0100-bbbbbbbbbbbb", string(pkt[36:56]))
+	assert.Equal(t, uint64(20), binary.BigEndian.Uint64(pkt[56:64]))
+	assert.Equal(t, uint64(1000), binary.BigEndian.Uint64(pkt[64:72]))
+	assert.Equal(t, uint64(10), binary.BigEndian.Uint64(pkt[72:80]))
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(pkt[80:84]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(pkt[88:92]))
+	assert.Equal(t, uint32(50), binary.BigEndian.Uint32(pkt[92:96]))
+	assert.Equal(t, uint16(6881), binary.BigEndian.Uint16(pkt[96:98]))
+
+	// the connection id is reused within a minute
+	req.Event = EventNone
+	req.NumWant = 0
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	connects, announces := s.stats()
+	assert.Equal(t, 1, connects)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(announces[1][80:84]))
+	assert.Equal(t, uint32(0xffffffff), binary.BigEndian.Uint32(announces[1][92:96]))
+
+	c.connTime = time.Now().Add(-2 * connIDLifetime)
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	connects, _ = s.stats()
+	assert.Equal(t, 2, connects)
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	s := &udpStandIn{drop: 2}
+	s.listen(t, "udp4", "127.0.0.1:0")
+	c := testUDPClient(s.url())
+	start := time.Now()
+	_, err := c.Announce(context.Background(), &AnnounceRequest{})
+	assert.Nil(t, err)
+	// 20ms and 40ms timeouts before the third packet is answered
+	assert.True(t, time.Since(start) >= 60*time.Millisecond)
+
+	s.mu.Lock()
+	s.drop = 100
+	s.mu.Unlock()
+	_, err = c.Announce(context.Background(), &AnnounceRequest{})
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	c.Retries = 10
+	_, err = c.Announce(ctx, &AnnounceRequest{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestUDPFailure(t *testing.T) {
+	s := &udpStandIn{}
+	s.listen(t, "udp4", "127.0.0.1:0")
+	c := testUDPClient(s.url())
+	_, err := c.Announce(context.Background(), &AnnounceRequest{})
+	assert.Nil(t, err)
+
+	s.mu.Lock()
+	s.fail = "unknown torrent"
+	s.mu.Unlock()
+	_, err = c.Announce(context.Background(), &AnnounceRequest{})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unknown torrent", failure.Reason)
+
+	// the connection id is not trusted after a failure
+	s.mu.Lock()
+	s.fail = ""
+	s.mu.Unlock()
+	_, err = c.Announce(context.Background(), &AnnounceRequest{})
+	assert.Nil(t, err)
+	connects, _ := s.stats()
+	assert.Equal(t, 2, connects)
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	s := &udpStandIn{peers: peer.Addr{IP: net.ParseIP("2001:db8::1"), Port: 80}.Compact()}
+	s.listen(t, "udp6", "[::1]:0")
+	res, err := testUDPClient(s.url()).Announce(context.Background(), &AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, "[2001:db8::1]:80", res.Peers[0].String())
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := &udpStandIn{}
+	s.listen(t, "udp4", "127.0.0.1:0")
+	hashes := make([][20]byte, 100)
+	for i := range hashes {
+		hashes[i] = [20]byte{byte(i), 2, 3, 4}
+	}
+	res, err := testUDPClient(s.url()).Scrape(context.Background(), hashes)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(res))
+	assert.Equal(t, ScrapeStats{Complete: 42, Downloaded: 2, Incomplete: 3}, res[hashes[42]])
+	assert.Equal(t, ScrapeStats{Complete: 99, Downloaded: 2, Incomplete: 3}, res[hashes[99]])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, 2, s.scrapes)
+}
+
+func TestNew(t *testing.T) {
+	tr, err := New("udp://tracker:80/announce")
+	assert.Nil(t, err)
+	assert.IsType(t, &UDPClient{}, tr)
+	tr, err = New("https://tracker/announce")
+	assert.Nil(t, err)
+	assert.IsType(t, &HTTPClient{}, tr)
+	_, err = New("wss://tracker")
+	assert.NotNil(t, err)
+}
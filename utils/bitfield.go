@@ -0,0 +1,41 @@
+package utils
+
+import "math/bits"
+
+// Bitfield is a piece set in the wire format of the peer protocol,
+// the high bit of the first byte is piece 0
+type Bitfield []byte
+
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (b Bitfield) Set(i int) {
+	if i < 0 || i/8 >= len(b) {
+		return
+	}
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+func (b Bitfield) Clear(i int) {
+	if i < 0 || i/8 >= len(b) {
+		return
+	}
+	b[i/8] &^= 0x80 >> (i % 8)
+}
+
+// Count returns the number of set bits
+func (b Bitfield) Count() int {
+	res := 0
+	for _, v := range b {
+		res += bits.OnesCount8(v)
+	}
+	return res
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitfield(t *testing.T) {
+	bf := NewBitfield(10)
+	assert.Equal(t, 2, len(bf))
+	bf.Set(0)
+	bf.Set(9)
+	bf.Set(16)
+	bf.Set(-1)
+	assert.Equal(t, Bitfield{0x80, 0x40}, bf)
+	assert.True(t, bf.Has(0))
+	assert.True(t, bf.Has(9))
+	assert.False(t, bf.Has(1))
+	assert.False(t, bf.Has(16))
+	assert.Equal(t, 2, bf.Count())
+	bf.Clear(0)
+	assert.False(t, bf.Has(0))
+	assert.Equal(t, 1, bf.Count())
+}
@@ -1,3 +1,6 @@
 package utils
 
 const SHALEN = 20
+
+// SHA256LEN is the length of v2 (BEP 52) hashes
+const SHA256LEN = 32